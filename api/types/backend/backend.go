@@ -98,6 +98,10 @@ type ExecProcessConfig struct {
 type ContainerCommitConfig struct {
 	types.ContainerCommitConfig
 	Changes []string
+	// EmptyLayer commits only the configuration of the container, for
+	// changes which cannot modify its filesystem. The history entry of the
+	// image is marked as an empty layer.
+	EmptyLayer bool
 }
 
 // ProgressWriter is a data object to transport progress streams to the client
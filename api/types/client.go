@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"io"
 	"net"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
@@ -178,6 +179,128 @@ type ImageBuildOptions struct {
 	SecurityOpt []string
 	ExtraHosts  []string // List of extra hosts
 	Target      string
+	// CopyTransformers are applied, in order, to the content of every file
+	// copied by ADD and COPY. The transformed content is what ends up in the
+	// image and is used to compute the build cache key.
+	CopyTransformers []func(path string, content io.Reader) (io.Reader, error)
+	// MaxConfigBytes is the maximum size of the serialized config of the
+	// resulting image. Zero means unlimited.
+	MaxConfigBytes int
+	// AdditionalContexts are extra build contexts that can be used as the
+	// source of `COPY --from=<name>`. Each one is resolved to a local
+	// directory the first time it is referenced, and never if it isn't.
+	AdditionalContexts map[string]func() (string, error)
+	// NoUnusedStages fails the build if a named build stage is neither used
+	// by a later stage nor the target, unless it is declared with
+	// `FROM --allow-unused`.
+	NoUnusedStages bool
+	// StrictCopyDestinations fails ADD and COPY instructions whose files
+	// would be written outside of the destination through a symlink that
+	// exists in the image.
+	StrictCopyDestinations bool
+	// CacheNamespace is folded into the cache key of every instruction, so
+	// that builds using different namespaces never share cached layers. An
+	// empty namespace shares the cache with all other builds.
+	CacheNamespace string
+	// ValidateEntrypoint fails the build if the binary of the exec form
+	// ENTRYPOINT, or CMD, of the final stage does not exist or is not
+	// executable in the image.
+	ValidateEntrypoint bool
+	// RequireDigestBase fails the build if a base image is not referenced
+	// by a sha256 digest alone, as in `FROM name@sha256:<digest>`. Build
+	// stages and scratch are allowed.
+	RequireDigestBase bool
+	// Secrets holds the values of the secrets available to the build, by id.
+	// A SECRET instruction fails the build if the secret it declares is
+	// missing, and RUN --mount=type=secret mounts the declared ones.
+	Secrets map[string][]byte
+	// AutoLabels are labels set on the image at the end of the build, for
+	// the keys the Dockerfile or the base image did not already set.
+	AutoLabels map[string]string
+	// RequireModification fails the build if the final stage does not add
+	// any layer to its base image.
+	RequireModification bool
+	// ValidateOnly only checks the instructions of the Dockerfile and their
+	// arguments. Nothing is pulled, run or committed, and no image is built.
+	ValidateOnly bool
+	// AllowInsecureRun allows RUN --security=insecure, which runs the
+	// command in a privileged container.
+	AllowInsecureRun bool
+	// ImageResolver, if set, rewrites the references of the images used by
+	// FROM and COPY --from before they are looked up or pulled, for example
+	// to redirect them to a mirror.
+	ImageResolver func(ref string) string
+	// MaxOnBuildTriggers is the maximum number of ONBUILD triggers an image
+	// can declare, or run from its base image. Zero uses the default of
+	// 128, and a negative value means unlimited.
+	MaxOnBuildTriggers int
+	// StrictShell fails the build, instead of printing a warning, when the
+	// executable of a SHELL instruction looks like it belongs to another
+	// platform than the image.
+	StrictShell bool
+	// DisallowAdd fails the build on ADD instructions, so that files are
+	// only copied with COPY and downloaded explicitly.
+	DisallowAdd bool
+	// BuildArgPrefixes are prefixes of the BuildArgs which every build stage
+	// can use without declaring them, as if it started with ARG <prefix>*.
+	BuildArgPrefixes []string
+	// LabelValidator, if set, is called with the key and value of each label
+	// set by a LABEL instruction, and fails the build when it returns an
+	// error, for example to enforce the conventions of an organization.
+	LabelValidator func(key, value string) error
+	// WarnInheritedEntrypoint prints a warning when CMD is set in a stage
+	// which inherits the ENTRYPOINT of its base image, showing the command
+	// the container runs.
+	WarnInheritedEntrypoint bool
+	// PullAttempts is how many times the images of FROM and COPY --from are
+	// pulled when the pull fails with a network error. Zero pulls once.
+	PullAttempts int
+	// PullRetryDelay is the delay before the first retry of a pull, which
+	// doubles with every attempt.
+	PullRetryDelay time.Duration
+	// StrictFlags rejects the flags of instructions which take none, instead
+	// of ignoring them, and lists the valid flags of an instruction when an
+	// unknown one is used.
+	StrictFlags bool
+	// RequireExecFormRun rejects RUN instructions in shell form, so that
+	// every command is run without a shell wrapping it.
+	RequireExecFormRun bool
+	// DefaultShells are the shells used for the shell form of RUN, CMD and
+	// ENTRYPOINT without a SHELL instruction, by operating system such as
+	// "linux" or "windows", instead of the default shell of the platform.
+	DefaultShells map[string][]string
+	// StrictCopySources fails COPY instructions with a source that matches
+	// no file of the build context, before copying any of the sources.
+	StrictCopySources bool
+	// PrefetchBaseImages pulls the base images of all the build stages
+	// concurrently before the first instruction runs, instead of one after
+	// the other as each FROM is reached. Base images named with an arg are
+	// still pulled by their FROM.
+	PrefetchBaseImages bool
+	// StrictUser fails USER instructions naming a user or a group that the
+	// /etc/passwd or /etc/group file of the image does not define. Numeric
+	// ids are accepted as they are.
+	StrictUser bool
+	// MaxLayers fails the build when an instruction adds a layer to an image
+	// which already has that many layers, including the layers of its base
+	// image. Zero means no limit.
+	MaxLayers int
+	// StrictLabelKeys fails LABEL instructions with a key which is not
+	// namespaced in reverse-DNS notation, such as com.example.version, other
+	// than a few well-known keys such as maintainer. It only applies to the
+	// keys of the Dockerfile, not to the keys of AutoLabels.
+	StrictLabelKeys bool
+	// CopyAsUser makes ADD and COPY copy the files owned by the user and
+	// group of the USER instruction in effect, resolved against the image,
+	// instead of root. Without a USER instruction the files are owned by
+	// root.
+	CopyAsUser bool
+	// RunCommandFilter, if set, is called with the command of each RUN
+	// instruction, including the shell of the shell form, before it runs.
+	// It returns the command to run instead, which is also the one in the
+	// cache key, or an error to fail the build, for example to enforce a
+	// policy on the commands of a build.
+	RunCommandFilter func(args []string) ([]string, error)
 }
 
 // ImageBuildResponse holds information
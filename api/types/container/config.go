@@ -26,6 +26,11 @@ type HealthConfig struct {
 	// Retries is the number of consecutive failures needed to consider a container as unhealthy.
 	// Zero means inherit.
 	Retries int `json:",omitempty"`
+
+	// SuccessExitCodes are the exit codes of the test which mean that the
+	// container is healthy. Empty means inherit, or only 0 if there is
+	// nothing to inherit.
+	SuccessExitCodes []int `json:",omitempty"`
 }
 
 // Config contains the configuration data about a container.
@@ -14,6 +14,7 @@ import (
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/image"
+	"github.com/opencontainers/go-digest"
 	"golang.org/x/net/context"
 )
 
@@ -157,6 +158,57 @@ type Image interface {
 	RunConfig() *container.Config
 }
 
+// DigestedImage is an Image which knows the repository digests it was pulled
+// with, so that a reference by digest can be verified against them.
+type DigestedImage interface {
+	Image
+	RepoDigests() []digest.Digest
+}
+
+// LayeredImage is an Image which knows the number of layers it is made of,
+// so that the builder can limit the layers of the images it builds.
+type LayeredImage interface {
+	Image
+	Layers() int
+}
+
+// PlatformImage is an Image which knows the platform it runs on, so that the
+// builder can report the platform each build stage resolved to.
+type PlatformImage interface {
+	Image
+	// Platform returns the platform of the image as os/architecture, such
+	// as linux/amd64, or an empty string if it is unknown.
+	Platform() string
+}
+
+// ChownBackend is a Backend which can copy files into a container owned by
+// another user than root.
+type ChownBackend interface {
+	// CopyOnBuildWithOwner is like CopyOnBuild, with the copied files owned
+	// by the user uid and the group gid of the container.
+	CopyOnBuildWithOwner(containerID string, destPath string, src FileInfo, decompress bool, uid, gid int) error
+}
+
+// ArtifactBackend is a Backend which can pull the files of OCI artifacts, for
+// ADD sources of the form oci://<reference>.
+type ArtifactBackend interface {
+	// PullArtifactOnBuild pulls the OCI artifact name, and writes its files
+	// to the directory dest. It fails on artifacts which are not made of
+	// files, such as images.
+	PullArtifactOnBuild(ctx context.Context, name string, authConfigs map[string]types.AuthConfig, dest string) error
+}
+
+// LabelBackend is a Backend which can set the SELinux label of the files it
+// copies into a container.
+type LabelBackend interface {
+	// SELinuxEnabled returns whether the copied files can be labeled, which
+	// requires SELinux to be enabled on the host.
+	SELinuxEnabled() bool
+	// CopyOnBuildWithLabel is like CopyOnBuildWithOwner, with the copied
+	// files labeled with the SELinux context label.
+	CopyOnBuildWithLabel(containerID string, destPath string, src FileInfo, decompress bool, uid, gid int, label string) error
+}
+
 // ImageCacheBuilder represents a generator for stateful image cache.
 type ImageCacheBuilder interface {
 	// MakeImageCache creates a stateful image cache.
@@ -2,6 +2,7 @@ package dockerfile
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -11,6 +12,7 @@ type FlagType int
 const (
 	boolType FlagType = iota
 	stringType
+	stringsType
 )
 
 // BFlags contains all flags information for the builder
@@ -19,6 +21,9 @@ type BFlags struct {
 	flags map[string]*Flag
 	used  map[string]*Flag
 	Err   error
+
+	// Strict lists the valid flags in the error about an unknown flag.
+	Strict bool
 }
 
 // Flag contains all information for a flag
@@ -27,6 +32,8 @@ type Flag struct {
 	name     string
 	flagType FlagType
 	Value    string
+	// StringValues are the values of a flag which can be repeated.
+	StringValues []string
 }
 
 // NewBFlags returns the new BFlags struct
@@ -63,10 +70,20 @@ func (bf *BFlags) AddString(name string, def string) *Flag {
 	return flag
 }
 
+// AddStrings adds a string flag to BFlags which can be given several times,
+// its values are in StringValues.
+// Note, any error will be generated when Parse() is called (see Parse).
+func (bf *BFlags) AddStrings(name string) *Flag {
+	return bf.addFlag(name, stringsType)
+}
+
 // addFlag is a generic func used by the other AddXXX() func
 // to add a new flag to the BFlags struct.
 // Note, any error will be generated when Parse() is called (see Parse).
 func (bf *BFlags) addFlag(name string, flagType FlagType) *Flag {
+	if bf.flags == nil {
+		bf.flags = make(map[string]*Flag)
+	}
 	if _, ok := bf.flags[name]; ok {
 		bf.Err = fmt.Errorf("Duplicate flag defined: %s", name)
 		return nil
@@ -135,13 +152,20 @@ func (bf *BFlags) Parse() error {
 
 		flag, ok := bf.flags[arg]
 		if !ok {
+			if bf.Strict {
+				return fmt.Errorf("Unknown flag: %s, %s", arg, bf.validFlags())
+			}
 			return fmt.Errorf("Unknown flag: %s", arg)
 		}
 
-		if _, ok = bf.used[arg]; ok {
+		if _, ok = bf.used[arg]; ok && flag.flagType != stringsType {
 			return fmt.Errorf("Duplicate flag specified: %s", arg)
 		}
 
+		if bf.used == nil {
+			bf.used = make(map[string]*Flag)
+		}
+
 		bf.used[arg] = flag
 
 		switch flag.flagType {
@@ -166,6 +190,12 @@ func (bf *BFlags) Parse() error {
 			}
 			flag.Value = value
 
+		case stringsType:
+			if index < 0 {
+				return fmt.Errorf("Missing a value on flag: %s", arg)
+			}
+			flag.StringValues = append(flag.StringValues, value)
+
 		default:
 			panic("No idea what kind of flag we have! Should never get here!")
 		}
@@ -174,3 +204,16 @@ func (bf *BFlags) Parse() error {
 
 	return nil
 }
+
+// validFlags describes the flags which were defined, for error messages.
+func (bf *BFlags) validFlags() string {
+	if len(bf.flags) == 0 {
+		return "the instruction has no flags"
+	}
+	names := make([]string, 0, len(bf.flags))
+	for name := range bf.flags {
+		names = append(names, "--"+name)
+	}
+	sort.Strings(names)
+	return "valid flags are " + strings.Join(names, ", ")
+}
@@ -1,5 +1,10 @@
 package dockerfile
 
+import (
+	"fmt"
+	"strings"
+)
+
 // builtinAllowedBuildArgs is list of built-in allowed build args
 // these args are considered transparent and are excluded from the image history.
 // Filtering from history is implemented in dispatchers.go
@@ -22,8 +27,18 @@ type buildArgs struct {
 	allowedMetaArgs map[string]*string
 	// args referenced by the Dockerfile
 	referencedArgs map[string]struct{}
+	// args declared by the Dockerfile in each build stage, in the order of
+	// their declaration. The first stage holds the args declared before the
+	// first FROM, see StartStage()
+	stageArgs [][]ArgSpec
+	// names of the variables the instructions of the Dockerfile refer to,
+	// see MarkUsed()
+	usedArgs map[string]struct{}
 	// args provided by the user on the command line
 	argsFromOptions map[string]*string
+	// prefixes of the args provided by the user which are allowed, see
+	// AllowPrefix()
+	allowedPrefixes []string
 }
 
 func newBuildArgs(argsFromOptions map[string]*string) *buildArgs {
@@ -31,6 +46,8 @@ func newBuildArgs(argsFromOptions map[string]*string) *buildArgs {
 		allowedBuildArgs: make(map[string]*string),
 		allowedMetaArgs:  make(map[string]*string),
 		referencedArgs:   make(map[string]struct{}),
+		usedArgs:         make(map[string]struct{}),
+		stageArgs:        make([][]ArgSpec, 1),
 		argsFromOptions:  argsFromOptions,
 	}
 }
@@ -47,10 +64,131 @@ func (b *buildArgs) UnreferencedOptionArgs() []string {
 	return leftoverArgs
 }
 
+// UnusedDeclaredArgs returns the list of args that were declared by the
+// Dockerfile but never referred to by an instruction nor set from options.
+// The built-in args are left out, as programs use them without a reference.
+func (b *buildArgs) UnusedDeclaredArgs() []string {
+	unused := []string{}
+	for _, spec := range b.DeclaredArgs() {
+		arg := spec.Name
+		if _, ok := b.usedArgs[arg]; ok {
+			continue
+		}
+		if _, ok := b.argsFromOptions[arg]; ok || builtinAllowedBuildArgs[arg] || arg == sourceDateEpochArg {
+			continue
+		}
+		unused = append(unused, arg)
+	}
+	return unused
+}
+
+// MarkUsed records that an instruction of the Dockerfile refers to the
+// variable key, which may be an arg
+func (b *buildArgs) MarkUsed(key string) {
+	b.usedArgs[key] = struct{}{}
+}
+
+// StartStage starts the record of the args declared by a new build stage, for
+// FROM.
+func (b *buildArgs) StartStage() {
+	b.stageArgs = append(b.stageArgs, nil)
+}
+
+// Declare records that the current build stage declares the arg spec, unless
+// it already declared an arg of the same name.
+func (b *buildArgs) Declare(spec ArgSpec) {
+	stage := len(b.stageArgs) - 1
+	if b.declaredInStage(stage, spec.Name) {
+		return
+	}
+	b.stageArgs[stage] = append(b.stageArgs[stage], spec)
+}
+
+// DeclaredArgs returns the args declared so far by all the build stages, in
+// the order of their first declaration.
+func (b *buildArgs) DeclaredArgs() []ArgSpec {
+	var specs []ArgSpec
+	seen := make(map[string]struct{})
+	for _, args := range b.stageArgs {
+		for _, spec := range args {
+			if _, ok := seen[spec.Name]; ok {
+				continue
+			}
+			seen[spec.Name] = struct{}{}
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// IsDeclaredInOtherStage returns whether the arg key was declared before the
+// first FROM or by another build stage, but not by the current one.
+func (b *buildArgs) IsDeclaredInOtherStage(key string) bool {
+	current := len(b.stageArgs) - 1
+	if b.declaredInStage(current, key) {
+		return false
+	}
+	for stage := 0; stage < current; stage++ {
+		if b.declaredInStage(stage, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *buildArgs) declaredInStage(stage int, key string) bool {
+	for _, spec := range b.stageArgs[stage] {
+		if spec.Name == key {
+			return true
+		}
+	}
+	return false
+}
+
 // ResetAllowed clears the list of args that are allowed to be used by a
 // directive
 func (b *buildArgs) ResetAllowed() {
 	b.allowedBuildArgs = make(map[string]*string)
+	b.allowedPrefixes = nil
+}
+
+// AllowAll allows all the args provided by the user to be used by directives,
+// as if each of them was declared
+func (b *buildArgs) AllowAll() {
+	b.AllowPrefix("")
+}
+
+// AllowPrefix allows the args provided by the user whose name starts with
+// prefix to be used by directives, as if each of them was declared
+func (b *buildArgs) AllowPrefix(prefix string) {
+	b.allowedPrefixes = append(b.allowedPrefixes, prefix)
+	for key := range b.argsFromOptions {
+		if strings.HasPrefix(key, prefix) {
+			b.referencedArgs[key] = struct{}{}
+		}
+	}
+}
+
+func (b *buildArgs) hasAllowedPrefix(key string) bool {
+	for _, prefix := range b.allowedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkReferenced records that the arg provided by the user is used, even
+// though the Dockerfile may not declare it
+func (b *buildArgs) MarkReferenced(key string) {
+	b.referencedArgs[key] = struct{}{}
+}
+
+// IsAllowed returns whether the arg can be used by directives, even if it has
+// no value
+func (b *buildArgs) IsAllowed(key string) bool {
+	_, ok := b.allowedBuildArgs[key]
+	return ok
 }
 
 // AddMetaArg adds a new meta arg that can be used by FROM directives
@@ -64,6 +202,15 @@ func (b *buildArgs) AddArg(key string, value *string) {
 	b.referencedArgs[key] = struct{}{}
 }
 
+// Require returns an error if the declared arg key has no value, neither
+// provided by the user nor as a default, for ARG --required.
+func (b *buildArgs) Require(key string) error {
+	if _, ok := b.getBuildArg(key, b.allowedBuildArgs); ok {
+		return nil
+	}
+	return fmt.Errorf("ARG %s is required, set it with --build-arg %s=<value>", key, key)
+}
+
 // IsUnreferencedBuiltin checks if the key is a built-in arg, or if it has been
 // referenced by the Dockerfile. Returns true if the arg is a builtin that has
 // not been referenced in the Dockerfile.
@@ -75,7 +222,13 @@ func (b *buildArgs) IsUnreferencedBuiltin(key string) bool {
 
 // GetAllAllowed returns a mapping with all the allowed args
 func (b *buildArgs) GetAllAllowed() map[string]string {
-	return b.getAllFromMapping(b.allowedBuildArgs)
+	m := b.getAllFromMapping(b.allowedBuildArgs)
+	for key, value := range b.argsFromOptions {
+		if _, ok := m[key]; !ok && value != nil && b.hasAllowedPrefix(key) {
+			m[key] = *value
+		}
+	}
+	return m
 }
 
 // GetAllMeta returns a mapping with all the meta meta args
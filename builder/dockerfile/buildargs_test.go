@@ -1,6 +1,7 @@
 package dockerfile
 
 import (
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -62,3 +63,71 @@ func TestGetAllMeta(t *testing.T) {
 	}
 	assert.Equal(t, expected, all)
 }
+
+func TestGetAllAllowedAllowAll(t *testing.T) {
+	buildArgs := newBuildArgs(map[string]*string{
+		"CI_COMMIT":      strPtr("abc123"),
+		"CI_PIPELINE":    strPtr("42"),
+		"ArgNotProvided": nil,
+	})
+	buildArgs.AddArg("CI_PIPELINE", strPtr("fromdockerfile"))
+	buildArgs.AddArg("ArgWithDefault", strPtr("fromdockerfile"))
+
+	buildArgs.AllowAll()
+
+	expected := map[string]string{
+		"CI_COMMIT":      "abc123",
+		"CI_PIPELINE":    "42",
+		"ArgWithDefault": "fromdockerfile",
+	}
+	assert.Equal(t, expected, buildArgs.GetAllAllowed())
+	assert.Len(t, buildArgs.UnreferencedOptionArgs(), 0)
+
+	buildArgs.ResetAllowed()
+	assert.Len(t, buildArgs.GetAllAllowed(), 0)
+}
+
+func TestGetAllAllowedPrefix(t *testing.T) {
+	buildArgs := newBuildArgs(map[string]*string{
+		"BUILD_NUMBER": strPtr("42"),
+		"BUILD_URL":    strPtr("https://ci.example.com/42"),
+		"BUILDER":      strPtr("ci"),
+		"CI_COMMIT":    strPtr("abc123"),
+	})
+
+	buildArgs.AllowPrefix("BUILD_")
+
+	expected := map[string]string{
+		"BUILD_NUMBER": "42",
+		"BUILD_URL":    "https://ci.example.com/42",
+	}
+	assert.Equal(t, expected, buildArgs.GetAllAllowed())
+	unreferenced := buildArgs.UnreferencedOptionArgs()
+	sort.Strings(unreferenced)
+	assert.Equal(t, []string{"BUILDER", "CI_COMMIT"}, unreferenced)
+}
+
+func TestDeclaredArgsByStage(t *testing.T) {
+	buildArgs := newBuildArgs(map[string]*string{"FROM_CLI": strPtr("x")})
+	buildArgs.Declare(ArgSpec{Name: "VERSION", HasDefault: true, Default: "1.0", Global: true})
+	buildArgs.StartStage()
+	buildArgs.Declare(ArgSpec{Name: "TARGET"})
+	buildArgs.Declare(ArgSpec{Name: "TARGET", HasDefault: true, Default: "debug"})
+	buildArgs.Declare(ArgSpec{Name: "FROM_CLI"})
+	buildArgs.StartStage()
+	buildArgs.Declare(ArgSpec{Name: "VERSION"})
+
+	expected := []ArgSpec{
+		{Name: "VERSION", HasDefault: true, Default: "1.0", Global: true},
+		{Name: "TARGET"},
+		{Name: "FROM_CLI"},
+	}
+	assert.Equal(t, expected, buildArgs.DeclaredArgs())
+
+	assert.True(t, buildArgs.IsDeclaredInOtherStage("TARGET"))
+	assert.False(t, buildArgs.IsDeclaredInOtherStage("VERSION"))
+	assert.False(t, buildArgs.IsDeclaredInOtherStage("UNKNOWN"))
+
+	buildArgs.MarkUsed("TARGET")
+	assert.Equal(t, []string{"VERSION"}, buildArgs.UnusedDeclaredArgs())
+}
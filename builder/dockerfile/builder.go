@@ -2,11 +2,16 @@ package dockerfile
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/reference"
@@ -14,11 +19,13 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/builder/dockerfile/command"
 	"github.com/docker/docker/builder/dockerfile/parser"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/go-connections/nat"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -47,6 +54,16 @@ type Builder struct {
 	Stderr io.Writer
 	Output io.Writer
 
+	// OnInstruction, if set, is called after each instruction is dispatched
+	// successfully, with the name of the instruction, its arguments after
+	// variable expansion and whether the build cache was used for it.
+	OnInstruction func(cmd string, args []string, cacheHit bool)
+
+	// OnRunOutput, if set, is called with the path given to RUN --output and
+	// the stdout and stderr of the command, for the caller to write them
+	// relative to the build output. It is not called when the cache is used.
+	OnRunOutput func(path string, output []byte) error
+
 	docker    builder.Backend
 	context   builder.Context
 	clientCtx context.Context
@@ -61,22 +78,90 @@ type Builder struct {
 	cmdSet        bool
 	disableCommit bool
 	cacheBusted   bool
+	cacheHit      bool // whether the cache was used for the current instruction
+	skipCacheOnce bool // whether the current instruction skips the cache, see skipCache()
+	skipped       bool // whether the current instruction was skipped, with RUN --if
 	buildArgs     *buildArgs
 	escapeToken   rune
+	deprecations  []Deprecation
+	secrets       map[string]struct{} // ids of the secrets declared with SECRET
+
+	imageCache    builder.ImageCache
+	from          builder.Image
+	downloadCache *downloadCache // remote files downloaded by ADD, may be nil
+
+	// whether the ENTRYPOINT and CMD of the current stage were declared in
+	// exec form, see checkEntrypoint()
+	entrypointExecForm bool
+	cmdExecForm        bool
+
+	// whether the current stage added a layer to its base image, see
+	// checkModification()
+	layerCreated bool
+
+	// the modification time of the files copied by ADD and COPY, set from
+	// the SOURCE_DATE_EPOCH build arg
+	sourceDateEpoch *time.Time
+
+	// the args which warnOnUndeclaredArgs() warned about
+	undeclaredArgWarnings map[string]struct{}
+
+	// the here-documents of the instruction being dispatched
+	heredocs []parser.Heredoc
+
+	// whether the current stage declared an ENTRYPOINT, rather than
+	// inheriting the one of its base image
+	entrypointSet bool
+
+	// the working directories of the current stage before each WORKDIR, for
+	// WORKDIR - to go back to
+	workdirStack []string
+
+	// the base images pulled before the build, see prefetchBaseImages()
+	prefetchedImages map[string]prefetchedImage
+
+	// the instruction being dispatched, such as RUN, and the number of
+	// layers of the current image, see addLayer()
+	instruction string
+	layers      int
+}
+
+// Deprecation describes a deprecated usage found in a Dockerfile during a
+// build.
+type Deprecation struct {
+	// Instruction is the instruction that uses the deprecated form.
+	Instruction string
+	// Message explains what is deprecated and what to use instead.
+	Message string
+}
 
-	imageCache builder.ImageCache
-	from       builder.Image
+// ArgSpec describes a build arg declared with ARG in a Dockerfile.
+type ArgSpec struct {
+	// Name is the name of the arg.
+	Name string
+	// HasDefault is whether the ARG instruction sets a default value.
+	HasDefault bool
+	// Default is the default value as written in the Dockerfile, without
+	// expanding the args it references.
+	Default string
+	// Global is whether the arg is declared before the first FROM, where it
+	// can be used by the FROM instructions.
+	Global bool
+	// Required is whether the arg is declared with ARG --required, which
+	// fails the build when it has no value.
+	Required bool
 }
 
 // BuildManager implements builder.Backend and is shared across all Builder objects.
 type BuildManager struct {
-	backend   builder.Backend
-	pathCache *pathCache // TODO: make this persistent
+	backend       builder.Backend
+	pathCache     *pathCache     // TODO: make this persistent
+	downloadCache *downloadCache // TODO: make this persistent
 }
 
 // NewBuildManager creates a BuildManager.
 func NewBuildManager(b builder.Backend) (bm *BuildManager) {
-	return &BuildManager{backend: b, pathCache: &pathCache{}}
+	return &BuildManager{backend: b, pathCache: &pathCache{}, downloadCache: &downloadCache{}}
 }
 
 // BuildFromContext builds a new image from a given context.
@@ -102,6 +187,7 @@ func (bm *BuildManager) BuildFromContext(ctx context.Context, src io.ReadCloser,
 		return "", err
 	}
 	b.imageContexts.cache = bm.pathCache
+	b.downloadCache = bm.downloadCache
 	return b.build(pg.StdoutFormatter, pg.StderrFormatter, pg.Output)
 }
 
@@ -114,18 +200,93 @@ func NewBuilder(clientCtx context.Context, config *types.ImageBuildOptions, back
 	}
 	b = &Builder{
 		clientCtx:     clientCtx,
-		options:       config,
 		Stdout:        os.Stdout,
 		Stderr:        os.Stderr,
 		docker:        backend,
-		context:       buildContext,
+		imageContexts: &imageContexts{},
+	}
+	if err := b.Reset(config, buildContext); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reset clears the state of the Dockerfile processed by the builder, such as
+// its config, args, build stages and maintainer, so that the builder can
+// process another Dockerfile with the given options and build context. The
+// backend, the output writers and callbacks, and the caches of images,
+// copied paths and downloads are kept. Temporary containers left by the
+// previous Dockerfile are removed if its options set Remove or ForceRemove,
+// and kept otherwise. An error releasing the build stages of the previous
+// Dockerfile is returned once the builder is reset.
+//
+// A Builder processes a single Dockerfile at a time and is not safe for
+// concurrent use: Reset must not be called while a build is running, and a
+// pool of builders must hand each one to a single goroutine at a time.
+func (b *Builder) Reset(config *types.ImageBuildOptions, buildContext builder.Context) error {
+	if config == nil {
+		config = new(types.ImageBuildOptions)
+	}
+	var sourceDateEpoch *time.Time
+	if epoch := config.BuildArgs[sourceDateEpochArg]; epoch != nil {
+		t, err := parseSourceDateEpoch(*epoch)
+		if err != nil {
+			return err
+		}
+		sourceDateEpoch = &t
+	}
+
+	if b.options != nil && (b.options.Remove || b.options.ForceRemove) {
+		b.clearTmp()
+	}
+	var err error
+	if b.imageContexts != nil {
+		err = b.imageContexts.unmount()
+	}
+
+	*b = Builder{
+		options:       config,
+		Stdout:        b.Stdout,
+		Stderr:        b.Stderr,
+		Output:        b.Output,
+		OnInstruction: b.OnInstruction,
+		OnRunOutput:   b.OnRunOutput,
+
+		docker:    b.docker,
+		context:   buildContext,
+		clientCtx: b.clientCtx,
+
+		disableCommit:   config.ValidateOnly,
+		imageCache:      b.imageCache,
+		downloadCache:   b.downloadCache,
+		sourceDateEpoch: sourceDateEpoch,
+
 		runConfig:     new(container.Config),
 		tmpContainers: map[string]struct{}{},
 		buildArgs:     newBuildArgs(config.BuildArgs),
 		escapeToken:   parser.DefaultEscapeToken,
+		imageContexts: &imageContexts{cache: b.imageContexts.cache},
 	}
-	b.imageContexts = &imageContexts{b: b}
-	return b, nil
+	b.imageContexts.b = b
+	if b.sourceDateEpoch != nil {
+		// the builder itself uses the arg, it is never unused
+		b.buildArgs.MarkReferenced(sourceDateEpochArg)
+	}
+	return err
+}
+
+// sourceDateEpochArg is the build arg setting the timestamp of the files
+// copied by ADD and COPY, for reproducible builds.
+const sourceDateEpochArg = "SOURCE_DATE_EPOCH"
+
+// parseSourceDateEpoch parses a SOURCE_DATE_EPOCH value, a number of seconds
+// since the Unix epoch.
+func parseSourceDateEpoch(value string) (time.Time, error) {
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid %s %q, must be an integer number of seconds since the Unix epoch", sourceDateEpochArg, value)
+	}
+	return time.Unix(sec, 0).UTC(), nil
 }
 
 func (b *Builder) resetImageCache() {
@@ -196,17 +357,72 @@ func (b *Builder) build(stdout io.Writer, stderr io.Writer, out io.Writer) (stri
 		return "", err
 	}
 
+	stages, err := parseStages(dockerfile.AST)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkTarget(stages, b.options.Target); err != nil {
+		return "", err
+	}
+
+	if b.options.NoUnusedStages {
+		if err := checkUnusedStages(stages, b.options.Target); err != nil {
+			return "", err
+		}
+	}
+
+	if b.options.PrefetchBaseImages && !b.options.ValidateOnly {
+		b.prefetchBaseImages(dockerfile.AST, stages)
+	}
+
 	shortImageID, err := b.dispatchDockerfileWithCancellation(dockerfile)
 	if err != nil {
 		return "", err
 	}
 
+	if b.options.ValidateOnly {
+		b.warnOnUnusedBuildArgs()
+		b.warnOnUnusedArgs()
+		b.warnOnUnusedStages(stages)
+		b.warnOnDeprecations()
+		fmt.Fprintln(b.Stdout, "Dockerfile is valid")
+		return "", nil
+	}
+
 	b.warnOnUnusedBuildArgs()
+	b.warnOnUnusedArgs()
+	b.warnOnUnusedStages(stages)
+	b.warnOnDeprecations()
 
 	if b.image == "" {
 		return "", errors.New("No image was generated. Is your Dockerfile empty?")
 	}
 
+	if err := b.applyAutoLabels(); err != nil {
+		return "", err
+	}
+	shortImageID = stringid.TruncateID(b.image)
+	if b.options.Remove {
+		b.clearTmp()
+	}
+
+	if err := checkConfigSize(b.runConfig, b.options.MaxConfigBytes); err != nil {
+		return "", err
+	}
+
+	if b.options.ValidateEntrypoint {
+		if err := b.checkEntrypoint(); err != nil {
+			return "", err
+		}
+	}
+
+	if b.options.RequireModification {
+		if err := b.checkModification(); err != nil {
+			return "", err
+		}
+	}
+
 	if b.options.Squash {
 		if err := b.squashBuild(); err != nil {
 			return "", err
@@ -226,6 +442,7 @@ func (b *Builder) dispatchDockerfileWithCancellation(dockerfile *parser.Result)
 
 	total := len(dockerfile.AST.Children)
 	var shortImgID string
+	var validationErrs []string
 	for i, n := range dockerfile.AST.Children {
 		select {
 		case <-b.clientCtx.Done():
@@ -241,10 +458,18 @@ func (b *Builder) dispatchDockerfileWithCancellation(dockerfile *parser.Result)
 		}
 
 		if err := b.dispatch(i, total, n); err != nil {
+			if b.options.ValidateOnly {
+				// keep going to report every error of the Dockerfile
+				validationErrs = append(validationErrs, withDockerfileLine(err, n).Error())
+				continue
+			}
 			if b.options.ForceRemove {
 				b.clearTmp()
 			}
-			return "", err
+			return "", withDockerfileLine(err, n)
+		}
+		if b.options.ValidateOnly {
+			continue
 		}
 
 		shortImgID = stringid.TruncateID(b.image)
@@ -258,6 +483,10 @@ func (b *Builder) dispatchDockerfileWithCancellation(dockerfile *parser.Result)
 		return "", errors.Errorf("failed to reach build target %s in Dockerfile", b.options.Target)
 	}
 
+	if len(validationErrs) > 0 {
+		return "", errors.Errorf("Dockerfile is not valid:\n%s", strings.Join(validationErrs, "\n"))
+	}
+
 	return shortImgID, nil
 }
 
@@ -283,6 +512,79 @@ func addNodesForLabelOption(dockerfile *parser.Node, labels map[string]string) {
 	dockerfile.Children = append(dockerfile.Children, node)
 }
 
+// checkModification returns an error if the final stage did not add any
+// layer to its base image, with a RUN, COPY, ADD or WORKDIR instruction.
+func (b *Builder) checkModification() error {
+	if !b.layerCreated {
+		return errors.New("the build did not add any layer to the base image, the Dockerfile needs at least one RUN, COPY, ADD or WORKDIR instruction")
+	}
+	return nil
+}
+
+// applyAutoLabels sets the labels of the AutoLabels option which are not
+// already set on the image, so that labels set in the Dockerfile, or
+// inherited from the base image, take precedence.
+func (b *Builder) applyAutoLabels() error {
+	var keys []string
+	for key := range b.options.AutoLabels {
+		if _, ok := b.runConfig.Labels[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	if b.runConfig.Labels == nil {
+		b.runConfig.Labels = map[string]string{}
+	}
+	// the labels are set as given, they are not Dockerfile words, so their
+	// quotes, escapes and variables are not processed like LABEL's
+	commitStr := "LABEL"
+	for _, key := range keys {
+		value := b.options.AutoLabels[key]
+		if validate := b.options.LabelValidator; validate != nil {
+			if err := validate(key, value); err != nil {
+				return errors.Wrapf(err, "invalid LABEL %s", key)
+			}
+		}
+		b.runConfig.Labels[key] = value
+		commitStr += " " + key + "=" + value
+	}
+	return b.commit("", b.runConfig.Cmd, commitStr)
+}
+
+// checkConfigSize returns an error if the serialized config is larger than
+// maxBytes, naming the largest of the env and labels sections as the most
+// likely candidate for trimming. A maxBytes of zero means unlimited.
+func checkConfigSize(config *container.Config, maxBytes int) error {
+	if maxBytes <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if len(data) <= maxBytes {
+		return nil
+	}
+
+	env, err := json.Marshal(config.Env)
+	if err != nil {
+		return err
+	}
+	labels, err := json.Marshal(config.Labels)
+	if err != nil {
+		return err
+	}
+	section, sectionSize := "env", len(env)
+	if len(labels) > sectionSize {
+		section, sectionSize = "labels", len(labels)
+	}
+	return errors.Errorf("image config is %d bytes, which exceeds the maximum of %d bytes (largest section is %s with %d bytes)", len(data), maxBytes, section, sectionSize)
+}
+
 // check if there are any leftover build-args that were passed but not
 // consumed during build. Print a warning, if there are any.
 func (b *Builder) warnOnUnusedBuildArgs() {
@@ -292,6 +594,107 @@ func (b *Builder) warnOnUnusedBuildArgs() {
 	}
 }
 
+// prefetchedImage is the result of pulling a base image before the build.
+type prefetchedImage struct {
+	image builder.Image
+	err   error
+}
+
+// prefetchBaseImages pulls the base images of the stages which are built
+// concurrently, or gets them from the daemon as their FROM would. The images,
+// or the errors, are used when each FROM is reached, so that a failed pull
+// fails the build at its FROM.
+func (b *Builder) prefetchBaseImages(dockerfile *parser.Node, stages []*buildStage) {
+	var names []string
+	for _, name := range baseImageNames(dockerfile, stages, b.options.Target) {
+		if b.options.RequireDigestBase && checkDigestOnly(name) != nil {
+			// rejected by its FROM, without pulling it
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	fmt.Fprintf(b.Output, "Prefetching base images %s\n", strings.Join(names, ", "))
+
+	// the pulls write their progress concurrently
+	output := b.Output
+	b.Output = &lockedWriter{w: output}
+	defer func() { b.Output = output }()
+
+	results := make([]prefetchedImage, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			image, err := pullOrGetImage(b, name)
+			results[i] = prefetchedImage{image: image, err: err}
+		}(i, name)
+	}
+	wg.Wait()
+
+	b.prefetchedImages = make(map[string]prefetchedImage)
+	for i, name := range names {
+		b.prefetchedImages[name] = results[i]
+	}
+}
+
+// lockedWriter serializes the writes to w.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// warnOnUnusedArgs prints a warning listing the args declared by the
+// Dockerfile that no instruction refers to and that were not set with
+// --build-arg.
+func (b *Builder) warnOnUnusedArgs() {
+	unusedArgs := b.buildArgs.UnusedDeclaredArgs()
+	if len(unusedArgs) > 0 {
+		fmt.Fprintf(b.Stdout, "[Warning] One or more args %v were declared but never used\n", unusedArgs)
+	}
+}
+
+// warnOnUnusedStages prints a warning listing the named build stages that
+// are built but neither the target of the build nor referred to by a later
+// FROM or COPY --from, see unusedStages().
+func (b *Builder) warnOnUnusedStages(stages []*buildStage) {
+	var names []string
+	for _, s := range unusedStages(stages, b.options.Target) {
+		names = append(names, s.name)
+	}
+	if len(names) > 0 {
+		fmt.Fprintf(b.Stdout, "[Warning] One or more build stages %v are never used by a later FROM or COPY --from\n", names)
+	}
+}
+
+// deprecate records a deprecated usage of instruction for the deprecation
+// report.
+func (b *Builder) deprecate(instruction, message string) {
+	b.deprecations = append(b.deprecations, Deprecation{Instruction: instruction, Message: message})
+}
+
+// DeprecationReport returns the deprecated usages found so far, in the order
+// they were encountered.
+func (b *Builder) DeprecationReport() []Deprecation {
+	return append([]Deprecation(nil), b.deprecations...)
+}
+
+// print a warning for each deprecated usage found during the build.
+func (b *Builder) warnOnDeprecations() {
+	for _, d := range b.deprecations {
+		fmt.Fprintf(b.Stderr, "[Warning] %s: %s\n", d.Instruction, d.Message)
+	}
+}
+
 func (b *Builder) tagImages(repoAndTags []reference.Named) error {
 	imageID := image.ID(b.image)
 	for _, rt := range repoAndTags {
@@ -303,8 +706,138 @@ func (b *Builder) tagImages(repoAndTags []reference.Named) error {
 	return nil
 }
 
+// StageNames returns the names of the build stages seen so far, in the order
+// they appear in the Dockerfile. Anonymous stages are returned as an empty
+// string.
+func (b *Builder) StageNames() []string {
+	return b.imageContexts.names()
+}
+
+// StagePlatform returns the platform, as os/architecture, which the base image
+// of the build stage called name resolved to. The stage can also be given by
+// its index, as for COPY --from. It returns an empty string for a stage which
+// is not known yet, FROM scratch, or whose image doesn't tell its platform.
+func (b *Builder) StagePlatform(name string) string {
+	return b.imageContexts.platform(name)
+}
+
+// DeclaredArgs returns the args declared so far, in the order they appear in
+// the Dockerfile. An arg declared more than once, for example in several build
+// stages, is only returned for its first declaration.
+func (b *Builder) DeclaredArgs() []ArgSpec {
+	return b.buildArgs.DeclaredArgs()
+}
+
+// Dispatch runs the instruction cmd with the arguments args as if it was a
+// line of the Dockerfile, for example for a caller to add a LABEL to the image
+// without editing the Dockerfile. The arguments are those the parser would
+// produce, such as name value pairs for LABEL and ENV, or the command line as
+// a single argument for the shell form of RUN. Flags are not supported. For
+// ONBUILD, the first argument is the instruction of the trigger.
+func (b *Builder) Dispatch(cmd string, args []string) error {
+	node, err := newInstructionNode(cmd, args)
+	if err != nil {
+		return err
+	}
+	return b.dispatch(0, 1, node)
+}
+
+// newInstructionNode returns the parser node of the instruction cmd with the
+// arguments args.
+func newInstructionNode(cmd string, args []string) (*parser.Node, error) {
+	cmd = strings.ToLower(cmd)
+	if _, ok := evaluateTable[cmd]; !ok {
+		return nil, errors.Errorf("unknown instruction: %s", strings.ToUpper(cmd))
+	}
+	node := &parser.Node{
+		Value:    cmd,
+		Original: strings.TrimSpace(strings.ToUpper(cmd) + " " + strings.Join(args, " ")),
+	}
+	if cmd == command.Onbuild {
+		if len(args) == 0 {
+			return nil, errAtLeastOneArgument("ONBUILD")
+		}
+		trigger, err := newInstructionNode(args[0], args[1:])
+		if err != nil {
+			return nil, err
+		}
+		node.Next = &parser.Node{Children: []*parser.Node{trigger}}
+		return node, nil
+	}
+	prev := node
+	for _, arg := range args {
+		prev.Next = &parser.Node{Value: arg}
+		prev = prev.Next
+	}
+	return node, nil
+}
+
+// FinalConfig returns a copy of the config of the image built, as set by the
+// instructions of the last build stage, for example for callers to check the
+// metadata of the image without inspecting it. Changes to the returned config
+// don't affect the builder.
+func (b *Builder) FinalConfig() *container.Config {
+	return copyRunConfig(b.runConfig)
+}
+
+// copyRunConfig returns a deep copy of config.
+func copyRunConfig(config *container.Config) *container.Config {
+	if config == nil {
+		return nil
+	}
+	c := *config
+	if config.ExposedPorts != nil {
+		c.ExposedPorts = make(nat.PortSet, len(config.ExposedPorts))
+		for port := range config.ExposedPorts {
+			c.ExposedPorts[port] = struct{}{}
+		}
+	}
+	if config.Volumes != nil {
+		c.Volumes = make(map[string]struct{}, len(config.Volumes))
+		for volume := range config.Volumes {
+			c.Volumes[volume] = struct{}{}
+		}
+	}
+	if config.Labels != nil {
+		c.Labels = make(map[string]string, len(config.Labels))
+		for key, value := range config.Labels {
+			c.Labels[key] = value
+		}
+	}
+	if config.Healthcheck != nil {
+		healthcheck := *config.Healthcheck
+		healthcheck.Test = copyStrings(config.Healthcheck.Test)
+		if config.Healthcheck.SuccessExitCodes != nil {
+			healthcheck.SuccessExitCodes = append([]int{}, config.Healthcheck.SuccessExitCodes...)
+		}
+		c.Healthcheck = &healthcheck
+	}
+	if config.StopTimeout != nil {
+		stopTimeout := *config.StopTimeout
+		c.StopTimeout = &stopTimeout
+	}
+	c.Env = copyStrings(config.Env)
+	c.OnBuild = copyStrings(config.OnBuild)
+	c.Cmd = strslice.StrSlice(copyStrings(config.Cmd))
+	c.Entrypoint = strslice.StrSlice(copyStrings(config.Entrypoint))
+	c.Shell = strslice.StrSlice(copyStrings(config.Shell))
+	return &c
+}
+
+// copyStrings returns a copy of strs, which is nil if strs is nil.
+func copyStrings(strs []string) []string {
+	if strs == nil {
+		return nil
+	}
+	return append([]string{}, strs...)
+}
+
 // hasFromImage returns true if the builder has processed a `FROM <image>` line
 func (b *Builder) hasFromImage() bool {
+	if b.options.ValidateOnly {
+		// base images are not pulled when only validating the Dockerfile
+		return len(b.imageContexts.list) > 0
+	}
 	return b.image != "" || b.noBaseImage
 }
 
@@ -359,6 +892,39 @@ func checkDispatchDockerfile(dockerfile *parser.Node) error {
 	return nil
 }
 
+// checkTarget verifies that target, if set, names one of the build stages
+// declared in the Dockerfile, so that a typo is reported before any of the
+// stages are built. The stages declared with FROM --internal can only be used
+// by other stages, so neither the target nor the last stage can be one.
+func checkTarget(stages []*buildStage, target string) error {
+	if target == "" {
+		if len(stages) > 0 && stages[len(stages)-1].internal {
+			last := stages[len(stages)-1]
+			return errors.Errorf("the last build stage %s (line %d) is declared with FROM --internal and can't be the built image, set a target to build another stage", last.name, last.line)
+		}
+		return nil
+	}
+	var validTargets []string
+	for _, s := range stages {
+		if s.name == "" {
+			continue
+		}
+		if strings.EqualFold(s.name, target) {
+			if s.internal {
+				return errors.Errorf("build target %s is declared with FROM --internal, it can only be used by other build stages", s.name)
+			}
+			return nil
+		}
+		if !s.internal {
+			validTargets = append(validTargets, s.name)
+		}
+	}
+	if len(validTargets) == 0 {
+		return errors.Errorf("failed to reach build target %s in Dockerfile: no named build stages", target)
+	}
+	return errors.Errorf("failed to reach build target %s in Dockerfile, valid targets are: %s", target, strings.Join(validTargets, ", "))
+}
+
 func dispatchFromDockerfile(b *Builder, result *parser.Result) error {
 	// TODO: pass this to dispatchRequest instead
 	b.escapeToken = result.EscapeToken
@@ -1,11 +1,26 @@
 package dockerfile
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/docker/builder"
 	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/go-connections/nat"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 func TestAddNodesForLabelOption(t *testing.T) {
@@ -32,3 +47,464 @@ func TestAddNodesForLabelOption(t *testing.T) {
 		assert.Equal(t, expected[i], v.Original)
 	}
 }
+
+func TestStageNames(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	assert.Len(t, b.StageNames(), 0)
+
+	for _, args := range [][]string{
+		{"busybox", "AS", "Build"},
+		{"busybox"},
+		{"busybox", "as", "final"},
+	} {
+		b.flags = NewBFlags()
+		assert.NoError(t, from(b, args, nil, ""))
+	}
+
+	assert.Equal(t, []string{"build", "", "final"}, b.StageNames())
+}
+
+func TestStagePlatform(t *testing.T) {
+	var output bytes.Buffer
+	b := newBuilderWithMockBackend()
+	b.Output = &output
+	b.docker.(*MockBackend).getImageOnBuildFunc = func(name string) (builder.Image, error) {
+		if name == "arm64v8/golang" {
+			return &mockImage{id: "arm64id", platform: "linux/arm64"}, nil
+		}
+		return &mockImage{id: "amd64id", platform: "linux/amd64"}, nil
+	}
+
+	for _, args := range [][]string{
+		{"arm64v8/golang", "AS", "build"},
+		{"build"},
+		{"busybox", "as", "final"},
+	} {
+		b.flags = NewBFlags()
+		require.NoError(t, from(b, args, nil, ""))
+	}
+
+	assert.Equal(t, "linux/arm64", b.StagePlatform("build"))
+	assert.Equal(t, "linux/arm64", b.StagePlatform("1"))
+	assert.Equal(t, "linux/amd64", b.StagePlatform("FINAL"))
+	assert.Equal(t, "", b.StagePlatform("3"))
+	assert.Equal(t, "", b.StagePlatform("missing"))
+	assert.Equal(t, "Build stage build: arm64v8/golang resolved to platform linux/arm64\n"+
+		"Build stage 1: build resolved to platform linux/arm64\n"+
+		"Build stage final: busybox resolved to platform linux/amd64\n", output.String())
+}
+
+func TestCheckTarget(t *testing.T) {
+	dockerfile := `FROM busybox AS build
+RUN make
+FROM busybox
+FROM scratch AS final
+`
+	stages := parseTestStages(t, dockerfile)
+
+	assert.NoError(t, checkTarget(stages, ""))
+	assert.NoError(t, checkTarget(stages, "build"))
+	assert.NoError(t, checkTarget(stages, "FINAL"))
+	assert.EqualError(t, checkTarget(stages, "biuld"),
+		"failed to reach build target biuld in Dockerfile, valid targets are: build, final")
+
+	stages = parseTestStages(t, "FROM busybox\n")
+	assert.EqualError(t, checkTarget(stages, "build"),
+		"failed to reach build target build in Dockerfile: no named build stages")
+}
+
+func TestCheckTargetInternal(t *testing.T) {
+	dockerfile := `FROM --internal golang AS build
+RUN make
+FROM busybox AS final
+COPY --from=build /app /app
+FROM --internal busybox AS test
+`
+	stages := parseTestStages(t, dockerfile)
+
+	assert.NoError(t, checkTarget(stages, "final"))
+	assert.EqualError(t, checkTarget(stages, "Build"),
+		"build target build is declared with FROM --internal, it can only be used by other build stages")
+	assert.EqualError(t, checkTarget(stages, "biuld"),
+		"failed to reach build target biuld in Dockerfile, valid targets are: final")
+	assert.EqualError(t, checkTarget(stages, ""),
+		"the last build stage test (line 5) is declared with FROM --internal and can't be the built image, set a target to build another stage")
+
+	stages = parseTestStages(t, "FROM --internal golang AS build\nFROM busybox\nCOPY --from=build /app /app\n")
+	assert.NoError(t, checkTarget(stages, ""))
+
+	stages = parseTestStages(t, "FROM --internal=true golang AS build\nFROM --internal=false busybox AS final\n")
+	assert.NoError(t, checkTarget(stages, ""))
+	assert.NoError(t, checkTarget(stages, "final"))
+	assert.Error(t, checkTarget(stages, "build"))
+}
+
+func TestFromInternal(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.options.StrictFlags = true
+	b.Stdout = ioutil.Discard
+
+	result, err := parser.Parse(strings.NewReader("FROM --internal busybox AS build\n"))
+	require.NoError(t, err)
+	assert.NoError(t, b.dispatch(0, 1, result.AST.Children[0]))
+	assert.Equal(t, []string{"build"}, b.StageNames())
+}
+
+func parseTestStages(t *testing.T, dockerfile string) []*buildStage {
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	require.NoError(t, err)
+	stages, err := parseStages(result.AST)
+	require.NoError(t, err)
+	return stages
+}
+
+func TestCheckConfigSize(t *testing.T) {
+	config := &container.Config{
+		Env:    []string{"PATH=/usr/bin"},
+		Labels: map[string]string{"org.example.description": strings.Repeat("x", 256)},
+	}
+	data, err := json.Marshal(config)
+	assert.NoError(t, err)
+	size := len(data)
+
+	assert.NoError(t, checkConfigSize(config, 0))
+	assert.NoError(t, checkConfigSize(config, size))
+
+	err = checkConfigSize(config, size-1)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("image config is %d bytes, which exceeds the maximum of %d bytes", size, size-1))
+	assert.Contains(t, err.Error(), "largest section is labels")
+}
+
+func TestApplyAutoLabels(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	b.runConfig.Labels = map[string]string{"built-by": "dockerfile", "maintainer": "base"}
+	b.options.AutoLabels = map[string]string{
+		"built-by":    "ci",
+		"build-date":  "2017-06-01",
+		"pipeline-id": "42",
+	}
+
+	require.NoError(t, b.applyAutoLabels())
+
+	expected := map[string]string{
+		"built-by":    "dockerfile",
+		"maintainer":  "base",
+		"build-date":  "2017-06-01",
+		"pipeline-id": "42",
+	}
+	assert.Equal(t, expected, b.runConfig.Labels)
+}
+
+func TestApplyAutoLabelsStrictLabelKeys(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	b.options.StrictLabelKeys = true
+	b.options.AutoLabels = map[string]string{
+		"built-by":    "ci",
+		"pipeline-id": "42",
+	}
+
+	require.NoError(t, b.applyAutoLabels())
+	assert.Equal(t, b.options.AutoLabels, b.runConfig.Labels)
+}
+
+func TestApplyAutoLabelsLiteralValues(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	b.options.AutoLabels = map[string]string{
+		"owner": "O'Brien",
+		"agent": `C:\agents\1`,
+		"cost":  "cost $5",
+	}
+
+	require.NoError(t, b.applyAutoLabels())
+	assert.Equal(t, b.options.AutoLabels, b.runConfig.Labels)
+}
+
+func TestValidateOnly(t *testing.T) {
+	dockerfile := `FROM busybox AS build
+RUN --network=bridge make
+WORKDIR /src
+USER
+FROM build
+ADD http://example.com/app.tar /app/
+COPY --from=build /out /out
+RUN make install
+`
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	require.NoError(t, err)
+
+	mockBackend := &MockBackend{}
+	mockBackend.getImageOnBuildFunc = func(name string) (builder.Image, error) {
+		t.Fatalf("unexpected image lookup for %s", name)
+		return nil, nil
+	}
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		t.Fatal("unexpected container creation")
+		return container.ContainerCreateCreatedBody{}, nil
+	}
+
+	options := &types.ImageBuildOptions{ValidateOnly: true}
+	b, err := NewBuilder(context.Background(), options, mockBackend, nil)
+	require.NoError(t, err)
+	b.Stdout = ioutil.Discard
+	b.Stderr = ioutil.Discard
+
+	_, err = b.dispatchDockerfileWithCancellation(result)
+	assert.EqualError(t, err, `Dockerfile is not valid:
+Dockerfile:2: Invalid network "bridge" for RUN, must be one of none, default or host
+Dockerfile:4: USER requires exactly one argument`)
+	assert.Equal(t, "", b.image)
+}
+
+func TestNoUnusedStagesCopyFromList(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	dockerfile := `FROM busybox AS cache
+FROM golang AS build
+FROM busybox AS assets
+FROM scratch
+COPY --from=cache,build /out /out
+COPY --from=2 /assets /assets
+`
+	createTestTempFile(t, contextDir, builder.DefaultDockerfileName, dockerfile, 0644)
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	options := &types.ImageBuildOptions{NoUnusedStages: true, ValidateOnly: true}
+	b, err := NewBuilder(context.Background(), options, &MockBackend{}, buildContext)
+	require.NoError(t, err)
+	_, err = b.build(ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	assert.NoError(t, err)
+}
+
+func TestDisallowAdd(t *testing.T) {
+	result, err := parser.Parse(strings.NewReader("FROM busybox\nENV APP=/app\nADD app.tar.gz $APP/\n"))
+	require.NoError(t, err)
+
+	options := &types.ImageBuildOptions{DisallowAdd: true}
+	b, err := NewBuilder(context.Background(), options, &MockBackend{}, nil)
+	require.NoError(t, err)
+	b.Stdout = ioutil.Discard
+	b.disableCommit = true
+
+	_, err = b.dispatchDockerfileWithCancellation(result)
+	assert.EqualError(t, err, "Dockerfile:3: ADD is not allowed by the builder, use COPY to copy files from the build context, and RUN to download remote files")
+}
+
+func TestDeclaredArgs(t *testing.T) {
+	dockerfile := `ARG VERSION=1.0
+FROM busybox:${VERSION} AS build
+ARG TARGET
+ARG OUTPUT=/out/${TARGET}
+FROM busybox
+ARG TARGET=release
+ARG *
+`
+	b := newBuilderWithMockBackend()
+	b.options.BuildArgs = map[string]*string{"TARGET": strPtr("debug")}
+	b.buildArgs = newBuildArgs(b.options.BuildArgs)
+	_, _, err := dispatchTestDockerfile(t, b, dockerfile)
+	require.NoError(t, err)
+
+	expected := []ArgSpec{
+		{Name: "VERSION", HasDefault: true, Default: "1.0", Global: true},
+		{Name: "TARGET"},
+		{Name: "OUTPUT", HasDefault: true, Default: "/out/${TARGET}"},
+	}
+	assert.Equal(t, expected, b.DeclaredArgs())
+}
+
+func TestFinalConfig(t *testing.T) {
+	dockerfile := `FROM busybox
+ARG PORT=8080
+ENV APP_PORT=${PORT}
+LABEL maintainer=team
+EXPOSE ${PORT}
+HEALTHCHECK --interval=5s --exit-success=0,3 CMD ["wget", "-q", "localhost:8080"]
+ENTRYPOINT ["/app"]
+CMD ["--verbose"]
+`
+	b := newBuilderWithMockBackend()
+	_, _, err := dispatchTestDockerfile(t, b, dockerfile)
+	require.NoError(t, err)
+
+	config := b.FinalConfig()
+	assert.Contains(t, config.Env, "APP_PORT=8080")
+	assert.Equal(t, map[string]string{"maintainer": "team"}, config.Labels)
+	assert.Equal(t, nat.PortSet{"8080/tcp": {}}, config.ExposedPorts)
+	assert.Equal(t, strslice.StrSlice{"/app"}, config.Entrypoint)
+	assert.Equal(t, strslice.StrSlice{"--verbose"}, config.Cmd)
+	require.NotNil(t, config.Healthcheck)
+	assert.Equal(t, []string{"CMD", "wget", "-q", "localhost:8080"}, config.Healthcheck.Test)
+	assert.Equal(t, 5*time.Second, config.Healthcheck.Interval)
+
+	config.Labels["maintainer"] = "someone else"
+	config.Env = append(config.Env[:0], "APP_PORT=80")
+	config.Healthcheck.Test[0] = "NONE"
+	config.Healthcheck.SuccessExitCodes[1] = 4
+	assert.Equal(t, "team", b.runConfig.Labels["maintainer"])
+	assert.Contains(t, b.runConfig.Env, "APP_PORT=8080")
+	assert.Equal(t, "CMD", b.runConfig.Healthcheck.Test[0])
+	assert.Equal(t, []int{0, 3}, b.runConfig.Healthcheck.SuccessExitCodes)
+}
+
+func TestReset(t *testing.T) {
+	backend := &MockBackend{}
+	b, err := NewBuilder(context.Background(), &types.ImageBuildOptions{
+		ValidateOnly: true,
+		BuildArgs:    map[string]*string{"VERSION": strPtr("2.0"), sourceDateEpochArg: strPtr("0")},
+	}, backend, nil)
+	require.NoError(t, err)
+	b.Stdout = ioutil.Discard
+	cache := &pathCache{}
+	b.imageContexts.cache = cache
+
+	dispatch := func(dockerfile string) {
+		result, err := parser.Parse(strings.NewReader(dockerfile))
+		require.NoError(t, err)
+		n := result.AST
+		for i, child := range n.Children {
+			require.NoError(t, b.dispatch(i, len(n.Children), child))
+		}
+	}
+
+	dispatch("FROM busybox AS build\nMAINTAINER someone\nARG VERSION\nLABEL version=$VERSION\nWORKDIR /app\n")
+	require.Equal(t, []string{"build"}, b.StageNames())
+	require.Equal(t, "2.0", b.runConfig.Labels["version"])
+
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+	options := &types.ImageBuildOptions{
+		ValidateOnly: true,
+		BuildArgs:    map[string]*string{"VERSION": strPtr("3.0")},
+	}
+	require.NoError(t, b.Reset(options, buildContext))
+	assert.Equal(t, &container.Config{}, b.runConfig)
+	assert.Equal(t, "", b.maintainer)
+	assert.Empty(t, b.StageNames())
+	assert.Empty(t, b.DeclaredArgs())
+	assert.Empty(t, b.tmpContainers)
+	assert.Equal(t, ioutil.Discard, b.Stdout)
+	assert.True(t, b.docker == backend)
+	assert.True(t, b.options == options)
+	assert.True(t, b.context == buildContext)
+	assert.True(t, b.imageContexts.cache == cache)
+	assert.True(t, b.imageContexts.b == b)
+	assert.True(t, b.disableCommit)
+	assert.Nil(t, b.sourceDateEpoch)
+	assert.Equal(t, []string{"VERSION"}, b.buildArgs.UnreferencedOptionArgs())
+
+	dispatch("FROM busybox AS final\nARG VERSION\nLABEL version=$VERSION\n")
+	assert.Equal(t, []string{"final"}, b.StageNames())
+	assert.Equal(t, map[string]string{"version": "3.0"}, b.runConfig.Labels)
+	assert.Equal(t, "", b.runConfig.WorkingDir)
+
+	err = b.Reset(&types.ImageBuildOptions{BuildArgs: map[string]*string{sourceDateEpochArg: strPtr("soon")}}, nil)
+	assert.EqualError(t, err, `invalid SOURCE_DATE_EPOCH "soon", must be an integer number of seconds since the Unix epoch`)
+}
+
+func TestSyntheticInstruction(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	b.image = "baseimage"
+
+	require.NoError(t, b.Dispatch("ENV", []string{"VERSION", "1.2.3"}))
+	require.NoError(t, b.Dispatch("label", []string{"git.sha", "3f2a1b", "version", "${VERSION}"}))
+	assert.Equal(t, map[string]string{"git.sha": "3f2a1b", "version": "1.2.3"}, b.runConfig.Labels)
+
+	require.NoError(t, b.Dispatch("ONBUILD", []string{"RUN", "make"}))
+	assert.Equal(t, []string{"RUN make"}, b.runConfig.OnBuild)
+
+	err := b.Dispatch("LABLE", []string{"git.sha", "3f2a1b"})
+	assert.EqualError(t, err, "unknown instruction: LABLE")
+
+	err = b.Dispatch("ONBUILD", []string{"RUNN", "make"})
+	assert.EqualError(t, err, "unknown instruction: RUNN")
+
+	err = b.Dispatch("LABEL", []string{"git.sha"})
+	assert.EqualError(t, err, "Bad input to LABEL, too many arguments")
+}
+
+func TestUnusedStagesWarning(t *testing.T) {
+	dockerfile := `FROM busybox AS deps
+FROM busybox AS tools
+FROM busybox AS stale
+FROM --allow-unused busybox AS docs
+FROM --allow-unused=false busybox AS lint
+FROM busybox
+FROM deps AS app
+COPY --from=tools /tool /usr/bin/
+COPY --from=1 /tool /usr/local/bin/
+FROM busybox AS later
+`
+	b := newBuilderWithMockBackend()
+	buf := &bytes.Buffer{}
+	b.Stdout = buf
+	// the stages after the target are not built
+	b.options.Target = "app"
+	b.warnOnUnusedStages(parseTestStages(t, dockerfile))
+	assert.Equal(t, "[Warning] One or more build stages [stale lint] are never used by a later FROM or COPY --from\n", buf.String())
+
+	buf.Reset()
+	b.options.Target = ""
+	b.warnOnUnusedStages(parseTestStages(t, "FROM busybox AS build\nFROM build\n"))
+	assert.Equal(t, "", buf.String())
+}
+
+func TestPrefetchBaseImages(t *testing.T) {
+	dockerfile := `FROM busybox AS base
+FROM alpine AS tools
+FROM base
+COPY --from=tools /bin/tool /bin/
+FROM debian
+`
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	require.NoError(t, err)
+	stages, err := parseStages(result.AST)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	pulled := map[string]int{}
+	// each pull waits for the others, which only succeeds if they run
+	// concurrently
+	var started sync.WaitGroup
+	started.Add(3)
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.options.PullParent = true
+	b.docker.(*MockBackend).pullOnBuildFunc = func(name string) (builder.Image, error) {
+		mu.Lock()
+		pulled[name]++
+		mu.Unlock()
+		started.Done()
+		started.Wait()
+		if name == "debian" {
+			return nil, errors.New("manifest for debian:latest not found")
+		}
+		return &mockImage{id: name + "-id"}, nil
+	}
+	output := &bytes.Buffer{}
+	b.Output = output
+
+	b.prefetchBaseImages(result.AST, stages)
+	assert.Equal(t, map[string]int{"busybox": 1, "alpine": 1, "debian": 1}, pulled)
+	assert.Equal(t, "Prefetching base images busybox, alpine, debian\n", output.String())
+	assert.Equal(t, output, b.Output)
+
+	image, err := b.getFromImage("alpine")
+	require.NoError(t, err)
+	assert.Equal(t, "alpine-id", image.ImageID())
+	_, err = b.getFromImage("debian")
+	assert.EqualError(t, err, "manifest for debian:latest not found")
+	assert.Equal(t, map[string]int{"busybox": 1, "alpine": 1, "debian": 1}, pulled)
+}
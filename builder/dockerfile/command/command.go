@@ -16,6 +16,7 @@ const (
 	Maintainer  = "maintainer"
 	Onbuild     = "onbuild"
 	Run         = "run"
+	Secret      = "secret"
 	Shell       = "shell"
 	StopSignal  = "stopsignal"
 	User        = "user"
@@ -38,6 +39,7 @@ var Commands = map[string]struct{}{
 	Maintainer:  {},
 	Onbuild:     {},
 	Run:         {},
+	Secret:      {},
 	Shell:       {},
 	StopSignal:  {},
 	User:        {},
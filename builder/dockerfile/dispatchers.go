@@ -9,22 +9,37 @@ package dockerfile
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"bytes"
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/opts"
+	"github.com/docker/docker/pkg/ioutils"
 	"github.com/docker/docker/pkg/signal"
+	"github.com/docker/docker/pkg/urlutil"
 	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -33,6 +48,15 @@ import (
 // Sets the environment variable foo to bar, also makes interpolation
 // in the dockerfile available from the next statement on via ${foo}.
 //
+// With --file, the values are paths of files in the build context and the
+// variables are set to the content of those files.
+//
+// ENV --unset foo removes the variable foo inherited from the base image or
+// set by a previous ENV.
+//
+// With --interpret-escapes, escape sequences such as \n in the values are
+// replaced by the characters they stand for, see interpretEscapes().
+//
 func env(b *Builder, args []string, attributes map[string]bool, original string) error {
 	if len(args) == 0 {
 		return errAtLeastOneArgument("ENV")
@@ -43,9 +67,27 @@ func env(b *Builder, args []string, attributes map[string]bool, original string)
 		return errTooManyArguments("ENV")
 	}
 
+	flFile := b.flags.AddBool("file", false)
+	flUnset := b.flags.AddBool("unset", false)
+	flInterpretEscapes := b.flags.AddBool("interpret-escapes", false)
+
 	if err := b.flags.Parse(); err != nil {
 		return err
 	}
+	if flInterpretEscapes.IsTrue() {
+		if flFile.IsTrue() {
+			return errors.New("ENV --interpret-escapes can't be used with --file")
+		}
+		if flUnset.IsTrue() {
+			return errors.New("ENV --interpret-escapes can't be used with --unset")
+		}
+	}
+	if flUnset.IsTrue() {
+		if flFile.IsTrue() {
+			return errors.New("ENV --unset can't be used with --file")
+		}
+		return unsetEnv(b, args)
+	}
 
 	commitMessage := bytes.NewBufferString("ENV")
 
@@ -55,20 +97,46 @@ func env(b *Builder, args []string, attributes map[string]bool, original string)
 		}
 		name := args[j]
 		value := args[j+1]
-		newVar := name + "=" + value
-		commitMessage.WriteString(" " + newVar)
+		if flFile.IsTrue() {
+			var err error
+			if value, err = b.readContextFile(value); err != nil {
+				return errors.Wrapf(err, "failed to read value of %s", name)
+			}
+		}
+		if flInterpretEscapes.IsTrue() {
+			var err error
+			if value, err = interpretEscapes(value); err != nil {
+				return errors.Wrapf(err, "ENV --interpret-escapes: invalid value of %s", name)
+			}
+		}
+		// NAME+=value appends to the current value of NAME, if any
+		appendValue := strings.HasSuffix(name, "+")
+		if appendValue {
+			name = strings.TrimSuffix(name, "+")
+			if len(name) == 0 {
+				return errBlankCommandNames("ENV")
+			}
+		}
 
-		gotOne := false
+		envIndex := -1
 		for i, envVar := range b.runConfig.Env {
 			envParts := strings.SplitN(envVar, "=", 2)
 			compareFrom := envParts[0]
 			if equalEnvKeys(compareFrom, name) {
-				b.runConfig.Env[i] = newVar
-				gotOne = true
+				envIndex = i
+				if appendValue && len(envParts) == 2 {
+					value = envParts[1] + value
+				}
 				break
 			}
 		}
-		if !gotOne {
+
+		newVar := name + "=" + value
+		commitMessage.WriteString(" " + newVar)
+
+		if envIndex >= 0 {
+			b.runConfig.Env[envIndex] = newVar
+		} else {
 			b.runConfig.Env = append(b.runConfig.Env, newVar)
 		}
 	}
@@ -76,6 +144,62 @@ func env(b *Builder, args []string, attributes map[string]bool, original string)
 	return b.commit("", b.runConfig.Cmd, commitMessage.String())
 }
 
+// unsetEnv removes variables from the config, for ENV --unset. The names are
+// parsed into pairs with an empty value, like the other forms of ENV.
+// Removing a variable that isn't set is not an error, so that the instruction
+// doesn't depend on the base image.
+func unsetEnv(b *Builder, args []string) error {
+	commitMessage := bytes.NewBufferString("ENV --unset")
+	for j := 0; j < len(args); j += 2 {
+		name := args[j]
+		if len(name) == 0 {
+			return errBlankCommandNames("ENV")
+		}
+		if strings.Contains(name, "=") || args[j+1] != "" {
+			return errors.Errorf("ENV --unset takes the names of the variables to remove, not a value: %s", name)
+		}
+		commitMessage.WriteString(" " + name)
+
+		env := make([]string, 0, len(b.runConfig.Env))
+		for _, envVar := range b.runConfig.Env {
+			if !equalEnvKeys(strings.SplitN(envVar, "=", 2)[0], name) {
+				env = append(env, envVar)
+			}
+		}
+		b.runConfig.Env = env
+	}
+
+	return b.commit("", b.runConfig.Cmd, commitMessage.String())
+}
+
+// interpretEscapes replaces the escape sequences of a Go string literal in
+// value, such as \n, \t, \\ or \x41, by the characters they stand for.
+func interpretEscapes(value string) (string, error) {
+	var result bytes.Buffer
+	for len(value) > 0 {
+		if value[0] != '\\' {
+			i := strings.IndexByte(value, '\\')
+			if i < 0 {
+				i = len(value)
+			}
+			result.WriteString(value[:i])
+			value = value[i:]
+			continue
+		}
+		r, multibyte, tail, err := strconv.UnquoteChar(value, 0)
+		if err != nil {
+			return "", errors.Errorf("unknown escape sequence at %q", value)
+		}
+		if r < utf8.RuneSelf || !multibyte {
+			result.WriteByte(byte(r))
+		} else {
+			result.WriteRune(r)
+		}
+		value = tail
+	}
+	return result.String(), nil
+}
+
 // MAINTAINER some text <maybe@an.email.address>
 //
 // Sets the maintainer metadata.
@@ -88,13 +212,18 @@ func maintainer(b *Builder, args []string, attributes map[string]bool, original
 		return err
 	}
 
+	b.deprecate("MAINTAINER", "MAINTAINER is deprecated, use a LABEL such as maintainer instead")
 	b.maintainer = args[0]
 	return b.commit("", b.runConfig.Cmd, fmt.Sprintf("MAINTAINER %s", b.maintainer))
 }
 
 // LABEL some json data describing the image
 //
-// Sets the Label variable foo to bar,
+// Sets the Label variable foo to bar, build args and environment variables
+// are replaced in bar but not in foo, see expandLabelValue().
+//
+// LABEL --unset foo removes the label foo inherited from the base image or
+// set by a previous LABEL.
 //
 func label(b *Builder, args []string, attributes map[string]bool, original string) error {
 	if len(args) == 0 {
@@ -105,9 +234,14 @@ func label(b *Builder, args []string, attributes map[string]bool, original strin
 		return errTooManyArguments("LABEL")
 	}
 
+	flUnset := b.flags.AddBool("unset", false)
+
 	if err := b.flags.Parse(); err != nil {
 		return err
 	}
+	if flUnset.IsTrue() {
+		return unsetLabels(b, args)
+	}
 
 	commitStr := "LABEL"
 
@@ -119,19 +253,108 @@ func label(b *Builder, args []string, attributes map[string]bool, original strin
 		// name  ==> args[j]
 		// value ==> args[j+1]
 
+		var err error
+		if args[j], err = ProcessQuotes(args[j], b.escapeToken); err != nil {
+			return err
+		}
 		if len(args[j]) == 0 {
 			return errBlankCommandNames("LABEL")
 		}
+		if strings.Contains(args[j], "$") {
+			fmt.Fprintf(b.Stdout, "[Warning] LABEL key %s contains $, variables are not replaced in label keys\n", args[j])
+		}
+		if b.options.StrictLabelKeys {
+			if err := checkLabelKey(args[j]); err != nil {
+				return err
+			}
+		}
+		if args[j+1], err = b.expandLabelValue(args[j+1]); err != nil {
+			return err
+		}
+
+		if validate := b.options.LabelValidator; validate != nil {
+			if err := validate(args[j], args[j+1]); err != nil {
+				return errors.Wrapf(err, "invalid LABEL %s", args[j])
+			}
+		}
 
 		newVar := args[j] + "=" + args[j+1] + ""
 		commitStr += " " + newVar
 
+		// label keys are case-sensitive, but keys differing only by case
+		// are usually a mistake
+		for key := range b.runConfig.Labels {
+			if key != args[j] && strings.EqualFold(key, args[j]) {
+				fmt.Fprintf(b.Stdout, "[Warning] LABEL %s differs only by case from existing label %s\n", args[j], key)
+			}
+		}
+
 		b.runConfig.Labels[args[j]] = args[j+1]
 		j++
 	}
 	return b.commit("", b.runConfig.Cmd, commitStr)
 }
 
+// wellKnownLabelKeys are the label keys without a namespace which
+// StrictLabelKeys accepts, as they are commonly used by images.
+var wellKnownLabelKeys = map[string]bool{
+	"description": true,
+	"license":     true,
+	"maintainer":  true,
+	"name":        true,
+	"vendor":      true,
+	"version":     true,
+}
+
+// reverseDNSLabelKey matches label keys namespaced in reverse-DNS notation:
+// at least two dot-separated components of lowercase letters and digits,
+// possibly joined by hyphens.
+var reverseDNSLabelKey = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*(\.[a-z0-9]+(-[a-z0-9]+)*)+$`)
+
+// checkLabelKey returns an error if key is neither namespaced in reverse-DNS
+// notation nor a well-known key, for the StrictLabelKeys option.
+func checkLabelKey(key string) error {
+	if wellKnownLabelKeys[key] || reverseDNSLabelKey.MatchString(key) {
+		return nil
+	}
+	if !strings.Contains(key, ".") {
+		return fmt.Errorf("LABEL key %s is not namespaced, use a reverse-DNS key such as com.example.%s", key, strings.ToLower(key))
+	}
+	return fmt.Errorf("LABEL key %s is not a valid reverse-DNS key, use dot-separated lowercase letters, digits and hyphens", key)
+}
+
+// unsetLabels removes labels from the config, for LABEL --unset. The names
+// are parsed into pairs with an empty value, like the other form of LABEL.
+// Removing a label that isn't set is not an error, so that the instruction
+// doesn't depend on the base image.
+func unsetLabels(b *Builder, args []string) error {
+	commitStr := "LABEL --unset"
+	for j := 0; j < len(args); j += 2 {
+		name, err := ProcessQuotes(args[j], b.escapeToken)
+		if err != nil {
+			return err
+		}
+		if len(name) == 0 {
+			return errBlankCommandNames("LABEL")
+		}
+		if strings.Contains(name, "=") || args[j+1] != "" {
+			return errors.Errorf("LABEL --unset takes the names of the labels to remove, not a value: %s", name)
+		}
+		commitStr += " " + name
+		delete(b.runConfig.Labels, name)
+	}
+	return b.commit("", b.runConfig.Cmd, commitStr)
+}
+
+// expandLabelValue replaces the build args and environment variables in the
+// value of a label. They are never replaced in the keys, which only have
+// their quotes removed, so that two labels can't end up with the same key
+// depending on the build.
+func (b *Builder) expandLabelValue(value string) (string, error) {
+	envs := append(b.runConfig.Env, b.buildArgsWithoutConfigEnv()...)
+	return ProcessWord(value, envs, b.escapeToken)
+}
+
 // ADD foo /path
 //
 // Add the file 'foo' to '/path'. Tarball and Remote URL (git, http) handling
@@ -141,12 +364,30 @@ func add(b *Builder, args []string, attributes map[string]bool, original string)
 	if len(args) < 2 {
 		return errAtLeastTwoArguments("ADD")
 	}
+	if b.options.DisallowAdd {
+		return errors.New("ADD is not allowed by the builder, use COPY to copy files from the build context, and RUN to download remote files")
+	}
+
+	flNoCache := b.flags.AddBool("no-cache", false)
+	flIgnoreFile := b.flags.AddString("ignorefile", "")
+	flDecompress := b.flags.AddBool("decompress", true)
+	flSELinuxLabel := b.flags.AddString("selinux-label", "")
 
 	if err := b.flags.Parse(); err != nil {
 		return err
 	}
+	b.skipCache(flNoCache)
 
-	return b.runContextCommand(args, true, true, "ADD", nil)
+	fileOpts := copyFileOptions{}
+	if err := b.applyIgnoreFile(&fileOpts, flIgnoreFile); err != nil {
+		return err
+	}
+	var err error
+	if fileOpts.selinuxLabel, err = parseSELinuxLabel(flSELinuxLabel, "ADD"); err != nil {
+		return err
+	}
+
+	return b.runContextCommand(args, true, flDecompress.IsTrue(), "ADD", nil, fileOpts)
 }
 
 // COPY foo /path
@@ -159,21 +400,193 @@ func dispatchCopy(b *Builder, args []string, attributes map[string]bool, origina
 	}
 
 	flFrom := b.flags.AddString("from", "")
+	flNormalizePerms := b.flags.AddBool("normalize-perms", false)
+	flURL := b.flags.AddBool("url", false)
+	flChmod := b.flags.AddString("chmod", "")
+	flChmodDir := b.flags.AddString("chmod-dir", "")
+	flNoCache := b.flags.AddBool("no-cache", false)
+	flIgnoreFile := b.flags.AddString("ignorefile", "")
+	flFollowSymlinks := b.flags.AddBool("follow-symlinks", false)
+	flTimestamp := b.flags.AddString("timestamp", "")
+	flRename := b.flags.AddBool("rename", false)
+	flSELinuxLabel := b.flags.AddString("selinux-label", "")
 
 	if err := b.flags.Parse(); err != nil {
 		return err
 	}
+	b.skipCache(flNoCache)
+
+	fileOpts := copyFileOptions{
+		normalizePerms: flNormalizePerms.IsTrue(),
+		rename:         flRename.IsTrue(),
+	}
+	if flFollowSymlinks.IsUsed() {
+		follow := flFollowSymlinks.IsTrue()
+		fileOpts.followSymlinks = &follow
+	}
+	if flTimestamp.Value != "" {
+		timestamp, err := parseCopyTimestamp(flTimestamp.Value)
+		if err != nil {
+			return err
+		}
+		fileOpts.timestamp = &timestamp
+	}
+	if err := b.applyIgnoreFile(&fileOpts, flIgnoreFile); err != nil {
+		return err
+	}
+	var err error
+	if fileOpts.chmod, err = parseCopyMode(flChmod); err != nil {
+		return err
+	}
+	if fileOpts.chmodDir, err = parseCopyMode(flChmodDir); err != nil {
+		return err
+	}
+	if fileOpts.selinuxLabel, err = parseSELinuxLabel(flSELinuxLabel, "COPY"); err != nil {
+		return err
+	}
 
 	var im *imageMount
-	if flFrom.IsUsed() {
-		var err error
-		im, err = b.imageContexts.get(flFrom.Value)
+	if flFrom.IsUsed() && !strings.EqualFold(flFrom.Value, buildContextName) {
+		if b.options.ValidateOnly {
+			// the sources are in another image, which is not available
+			// when only validating the Dockerfile
+			return nil
+		}
+		if froms := strings.Split(flFrom.Value, ","); len(froms) > 1 {
+			im, err = b.firstImageContaining(froms, args[:len(args)-1])
+		} else {
+			im, err = b.imageContexts.get(flFrom.Value)
+		}
 		if err != nil {
 			return err
 		}
 	}
 
-	return b.runContextCommand(args, false, false, "COPY", im)
+	if b.options.StrictCopySources && im == nil {
+		if err := b.checkCopySources(args[:len(args)-1]); err != nil {
+			return err
+		}
+	}
+
+	// remote sources are only allowed with --url, and unlike ADD they are
+	// never extracted
+	return b.runContextCommand(args, flURL.IsTrue(), false, "COPY", im, fileOpts)
+}
+
+// parseCopyMode parses the octal mode of COPY --chmod or --chmod-dir, it
+// returns nil if the flag is not set.
+func parseCopyMode(flag *Flag) (*os.FileMode, error) {
+	if flag.Value == "" {
+		return nil, nil
+	}
+	mode, err := strconv.ParseUint(flag.Value, 8, 32)
+	if err != nil || mode > 07777 {
+		return nil, fmt.Errorf("Invalid --%s %q for COPY, must be an octal mode such as 0755", flag.name, flag.Value)
+	}
+	fileMode := os.FileMode(mode)
+	return &fileMode, nil
+}
+
+// selinuxContext loosely matches an SELinux context, user:role:type followed
+// by an optional level which can contain colons itself.
+var selinuxContext = regexp.MustCompile(`^[^:\s]+:[^:\s]+:[^:\s]+(:\S+)?$`)
+
+// parseSELinuxLabel parses the SELinux context of ADD or COPY
+// --selinux-label, see copyLabel().
+func parseSELinuxLabel(flag *Flag, cmdName string) (string, error) {
+	if flag.Value != "" && !selinuxContext.MatchString(flag.Value) {
+		return "", fmt.Errorf("Invalid --selinux-label %q for %s, must be an SELinux context such as system_u:object_r:container_file_t:s0", flag.Value, cmdName)
+	}
+	return flag.Value, nil
+}
+
+// parseCopyTimestamp parses the value of COPY --timestamp, an RFC 3339 date
+// or a number of seconds since the Unix epoch.
+func parseCopyTimestamp(value string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid --timestamp %q for COPY, must be an RFC 3339 date or a number of seconds since the Unix epoch", value)
+	}
+	return t.UTC(), nil
+}
+
+// firstImageContaining returns the first of the stages or images froms that
+// contains all the sources srcs, for COPY --from with a list of values.
+func (b *Builder) firstImageContaining(froms []string, srcs []string) (*imageMount, error) {
+	for _, from := range froms {
+		im, err := b.imageContexts.get(strings.TrimSpace(from))
+		if err != nil {
+			return nil, err
+		}
+		ok, err := b.containsSources(im, srcs)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return im, nil
+		}
+	}
+	return nil, errors.Errorf("none of %s contain %s", strings.Join(froms, ", "), strings.Join(srcs, " "))
+}
+
+// containsSources returns whether the sources srcs, which may contain
+// wildcards, all exist in the image mount im.
+func (b *Builder) containsSources(im *imageMount, srcs []string) (bool, error) {
+	for _, src := range srcs {
+		infos, err := b.calcCopyInfo("COPY", src, false, true, im)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				return false, nil
+			}
+			return false, err
+		}
+		if len(infos) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkCopySources returns an error if a source of COPY, other than remote
+// files and here-documents, matches no file of the build context.
+func (b *Builder) checkCopySources(srcs []string) error {
+	for _, src := range srcs {
+		if _, ok := b.heredocSource(src); ok || urlutil.IsURL(src) {
+			continue
+		}
+		infos, err := b.calcCopyInfo("COPY", src, false, true, nil)
+		if err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return err
+		}
+		if err != nil || len(infos) == 0 {
+			return errors.Errorf("COPY source %s matches no file in the build context", src)
+		}
+	}
+	return nil
+}
+
+// applyIgnoreFile sets fileOpts to exclude the files matched by the ignore
+// file of the --ignorefile flag, if it is set.
+func (b *Builder) applyIgnoreFile(fileOpts *copyFileOptions, flIgnoreFile *Flag) error {
+	if flIgnoreFile.Value == "" {
+		return nil
+	}
+	ignore, err := b.readIgnoreFile(flIgnoreFile.Value)
+	if err != nil {
+		return errors.Wrap(err, "failed to read --ignorefile")
+	}
+	fileOpts.ignore, fileOpts.ignoreFile = ignore, flIgnoreFile.Value
+	return nil
+}
+
+// skipCache makes the instruction run even if the cache has a result for it,
+// when its --no-cache flag is set. Only this instruction skips the cache, the
+// ones that follow it miss it anyway when their parent image is new.
+func (b *Builder) skipCache(flNoCache *Flag) {
+	b.skipCacheOnce = flNoCache.IsTrue()
 }
 
 // FROM imagename[:tag | @digest] [AS build-stage-name]
@@ -185,11 +598,18 @@ func from(b *Builder, args []string, attributes map[string]bool, original string
 		return err
 	}
 
+	// only used by the unused stages checks, see checkUnusedStages() and
+	// warnOnUnusedStages()
+	b.flags.AddBool("allow-unused", false)
+	// only used by the target check, see checkTarget()
+	b.flags.AddBool("internal", false)
+
 	if err := b.flags.Parse(); err != nil {
 		return err
 	}
 	b.resetImageCache()
-	if _, err := b.imageContexts.add(ctxName); err != nil {
+	im, err := b.imageContexts.add(ctxName)
+	if err != nil {
 		return err
 	}
 
@@ -199,10 +619,27 @@ func from(b *Builder, args []string, attributes map[string]bool, original string
 	}
 	if image != nil {
 		b.imageContexts.update(image.ImageID(), image.RunConfig())
+		if platformImage, ok := image.(builder.PlatformImage); ok && platformImage.Platform() != "" {
+			im.platform = platformImage.Platform()
+			stage := ctxName
+			if stage == "" {
+				stage = strconv.Itoa(len(b.imageContexts.list) - 1)
+			}
+			fmt.Fprintf(b.Output, "Build stage %s: %s resolved to platform %s\n", stage, args[0], im.platform)
+		}
 	}
 	b.from = image
+	b.entrypointExecForm = false
+	b.entrypointSet = false
+	b.workdirStack = nil
+	b.cmdExecForm = false
+	b.layerCreated = false
 
+	b.buildArgs.StartStage()
 	b.buildArgs.ResetAllowed()
+	for _, prefix := range b.options.BuildArgPrefixes {
+		b.buildArgs.AllowPrefix(prefix)
+	}
 	return b.processImageFrom(image)
 }
 
@@ -214,6 +651,9 @@ func parseBuildStageName(args []string) (string, error) {
 		if ok, _ := regexp.MatchString("^[a-z][a-z0-9-_\\.]*$", stageName); !ok {
 			return "", errors.Errorf("invalid name for build stage: %q, name can't start with a number or contain symbols", stageName)
 		}
+		if stageName == buildContextName {
+			return "", errors.Errorf("invalid name for build stage: %q, name is reserved for the build context", stageName)
+		}
 	case len(args) != 1:
 		return "", errors.New("FROM requires either one or three arguments")
 	}
@@ -249,9 +689,38 @@ func (b *Builder) getFromImage(name string) (builder.Image, error) {
 		b.noBaseImage = true
 		return nil, nil
 	}
+
+	if b.options.RequireDigestBase {
+		if err := checkDigestOnly(name); err != nil {
+			return nil, err
+		}
+	}
+	if b.options.ValidateOnly {
+		// only check the reference, the image is not pulled
+		_, err := reference.ParseNormalizedNamed(name)
+		return nil, err
+	}
+	if prefetched, ok := b.prefetchedImages[name]; ok {
+		return prefetched.image, prefetched.err
+	}
 	return pullOrGetImage(b, name)
 }
 
+// checkDigestOnly returns an error unless name references an image by a
+// sha256 digest, without a tag.
+func checkDigestOnly(name string) error {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return err
+	}
+	_, tagged := ref.(reference.Tagged)
+	digested, ok := ref.(reference.Digested)
+	if tagged || !ok || digested.Digest().Algorithm() != digest.SHA256 {
+		return errors.Errorf("base image %s must be referenced by digest only, as in name@sha256:<digest>", name)
+	}
+	return nil
+}
+
 // ONBUILD RUN echo yo
 //
 // ONBUILD triggers run when the image is used in a FROM statement.
@@ -278,12 +747,33 @@ func onbuild(b *Builder, args []string, attributes map[string]bool, original str
 		return fmt.Errorf("%s isn't allowed as an ONBUILD trigger", triggerInstruction)
 	}
 
+	if err := checkOnBuildTrigger(triggerInstruction, args[1:], attributes); err != nil {
+		return err
+	}
+
+	if max := b.maxOnBuildTriggers(); max > 0 && len(b.runConfig.OnBuild) >= max {
+		return errors.Errorf("image already has %d ONBUILD triggers, the maximum is %d", len(b.runConfig.OnBuild), max)
+	}
+
 	original = regexp.MustCompile(`(?i)^\s*ONBUILD\s*`).ReplaceAllString(original, "")
 
 	b.runConfig.OnBuild = append(b.runConfig.OnBuild, original)
 	return b.commit("", b.runConfig.Cmd, fmt.Sprintf("ONBUILD %s", original))
 }
 
+// defaultMaxOnBuildTriggers is the maximum number of ONBUILD triggers of an
+// image when the MaxOnBuildTriggers option is not set.
+const defaultMaxOnBuildTriggers = 128
+
+// maxOnBuildTriggers returns the maximum number of ONBUILD triggers of an
+// image, or a negative value if there is no limit.
+func (b *Builder) maxOnBuildTriggers() int {
+	if b.options.MaxOnBuildTriggers == 0 {
+		return defaultMaxOnBuildTriggers
+	}
+	return b.options.MaxOnBuildTriggers
+}
+
 // WORKDIR /tmp
 //
 // Set the working directory for future RUN/CMD/etc statements.
@@ -298,11 +788,32 @@ func workdir(b *Builder, args []string, attributes map[string]bool, original str
 		return err
 	}
 
-	// This is from the Dockerfile and will not necessarily be in platform
-	// specific semantics, hence ensure it is converted.
-	b.runConfig.WorkingDir, err = normaliseWorkdir(b.runConfig.WorkingDir, args[0])
-	if err != nil {
-		return err
+	// A relative WORKDIR is resolved against the current working directory,
+	// which a scratch image doesn't have until one is set.
+	warnRelative := b.noBaseImage && b.runConfig.WorkingDir == "" && !filepath.IsAbs(filepath.FromSlash(args[0]))
+
+	if args[0] == "-" {
+		// WORKDIR - goes back to the working directory before the last
+		// WORKDIR of the stage, like popd
+		if len(b.workdirStack) == 0 {
+			return errors.New("WORKDIR - requires a previous WORKDIR in the build stage to go back from")
+		}
+		b.runConfig.WorkingDir = b.workdirStack[len(b.workdirStack)-1]
+		b.workdirStack = b.workdirStack[:len(b.workdirStack)-1]
+		warnRelative = false
+	} else {
+		previous := b.runConfig.WorkingDir
+		// This is from the Dockerfile and will not necessarily be in platform
+		// specific semantics, hence ensure it is converted.
+		b.runConfig.WorkingDir, err = normaliseWorkdir(b.runConfig.WorkingDir, args[0])
+		if err != nil {
+			return err
+		}
+		b.workdirStack = append(b.workdirStack, previous)
+	}
+
+	if warnRelative {
+		fmt.Fprintf(b.Stderr, "[Warning] WORKDIR %s is relative and the scratch image has no working directory, it resolves to %s\n", args[0], b.runConfig.WorkingDir)
 	}
 
 	// For performance reasons, we explicitly do a create/mkdir now
@@ -319,9 +830,12 @@ func workdir(b *Builder, args []string, attributes map[string]bool, original str
 	cmd := b.runConfig.Cmd
 	comment := "WORKDIR " + b.runConfig.WorkingDir
 	// reset the command for cache detection
-	b.runConfig.Cmd = strslice.StrSlice(append(getShell(b.runConfig), "#(nop) "+comment))
+	b.runConfig.Cmd = b.cacheCmd(strslice.StrSlice(append(b.getShell(b.runConfig), "#(nop) "+comment)))
 	defer func(cmd strslice.StrSlice) { b.runConfig.Cmd = cmd }(cmd)
 
+	if err := b.addLayer(); err != nil {
+		return err
+	}
 	if hit, err := b.probeCache(); err != nil {
 		return err
 	} else if hit {
@@ -354,19 +868,209 @@ func workdir(b *Builder, args []string, attributes map[string]bool, original str
 // RUN echo hi          # cmd /S /C echo hi   (Windows)
 // RUN [ "echo", "hi" ] # echo hi
 //
+// The --network flag runs the command with the given network mode instead of
+// the one of the build, and --tty allocates a pseudo-TTY for the command.
+//
 func run(b *Builder, args []string, attributes map[string]bool, original string) error {
 	if !b.hasFromImage() {
 		return errors.New("Please provide a source image with `from` prior to run")
 	}
 
+	flNetwork := b.flags.AddString("network", runNetworkDefault)
+	flTTY := b.flags.AddBool("tty", false)
+	flCacheFromFiles := b.flags.AddString("cache-from-files", "")
+	flWorkdir := b.flags.AddString("workdir", "")
+	flSecurity := b.flags.AddString("security", runSecuritySandbox)
+	flTimeout := b.flags.AddString("timeout", "")
+	flOutput := b.flags.AddString("output", "")
+	flNoCache := b.flags.AddBool("no-cache", false)
+	flIf := b.flags.AddString("if", "")
+	flUlimits := b.flags.AddStrings("ulimit")
+	flMemory := b.flags.AddString("memory", "")
+	flCPUs := b.flags.AddString("cpus", "")
+	flMounts := b.flags.AddStrings("mount")
+	flShellFlag := b.flags.AddString("shell-flag", "")
+
 	if err := b.flags.Parse(); err != nil {
 		return err
 	}
+	if b.options.RequireExecFormRun && !attributes["json"] {
+		return fmt.Errorf("RUN in shell form is not allowed by this build, use the exec form as in RUN [\"executable\", \"param1\"] instead of: %s", original)
+	}
+	if flIf.IsUsed() {
+		ok, err := b.evalRunCondition(flIf.Value)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// the skipped command is committed as a no-op, so that the
+			// following instructions are cached per condition
+			fmt.Fprintf(b.Stdout, " ---> Skipping, --if=%s is false\n", flIf.Value)
+			b.skipped = true
+			return b.commit("", b.runConfig.Cmd, fmt.Sprintf("RUN --if=%s (skipped) %s", flIf.Value, strings.Join(args, " ")))
+		}
+	}
+	b.skipCache(flNoCache)
+
+	// non-default flags that change how the command runs are part of the
+	// cache key, see prependRunFlags()
+	var runFlags []string
+
+	network := strings.ToLower(flNetwork.Value)
+	if !validRunNetworks[network] {
+		return fmt.Errorf("Invalid network %q for RUN, must be one of none, default or host", flNetwork.Value)
+	}
+	if network != runNetworkDefault {
+		runFlags = append(runFlags, "network="+network)
+	}
+	if flTTY.IsTrue() {
+		runFlags = append(runFlags, "tty")
+	}
+	security := strings.ToLower(flSecurity.Value)
+	switch security {
+	case runSecuritySandbox:
+	case runSecurityInsecure:
+		if !b.options.AllowInsecureRun {
+			return errors.New("RUN --security=insecure is not allowed, the builder must be started with insecure RUN instructions allowed")
+		}
+		runFlags = append(runFlags, "security="+security)
+	default:
+		return fmt.Errorf("Invalid security mode %q for RUN, must be one of sandbox or insecure", flSecurity.Value)
+	}
+	workdir := b.runConfig.WorkingDir
+	if flWorkdir.Value != "" {
+		var err error
+		if workdir, err = normaliseWorkdir(b.runConfig.WorkingDir, flWorkdir.Value); err != nil {
+			return err
+		}
+		runFlags = append(runFlags, "workdir="+workdir)
+	}
+	timeout, err := parseOptInterval(flTimeout)
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		runFlags = append(runFlags, "timeout="+timeout.String())
+	}
+	ulimits, err := parseRunUlimits(flUlimits.StringValues)
+	if err != nil {
+		return err
+	}
+	for _, ulimit := range ulimits {
+		runFlags = append(runFlags, "ulimit="+ulimit.String())
+	}
+	memory, err := parseRunMemory(flMemory.Value)
+	if err != nil {
+		return err
+	}
+	if memory > 0 {
+		if b.options.MemorySwap > 0 && b.options.MemorySwap < memory {
+			return fmt.Errorf("Invalid --memory %q for RUN, it is above the memory-swap limit of the build", flMemory.Value)
+		}
+		runFlags = append(runFlags, "memory="+strconv.FormatInt(memory, 10))
+	}
+	nanoCPUs, err := parseRunCPUs(flCPUs.Value)
+	if err != nil {
+		return err
+	}
+	if nanoCPUs > 0 {
+		runFlags = append(runFlags, "cpus="+strconv.FormatFloat(float64(nanoCPUs)/1e9, 'f', -1, 64))
+	}
+	if flShellFlag.IsUsed() {
+		if attributes["json"] {
+			return errors.New("RUN --shell-flag only applies to the shell form of RUN")
+		}
+		if !strings.HasPrefix(flShellFlag.Value, "-") || len(strings.Fields(flShellFlag.Value)) != 1 {
+			return fmt.Errorf("Invalid --shell-flag %q for RUN, must be a single flag starting with -", flShellFlag.Value)
+		}
+		runFlags = append(runFlags, "shell-flag="+flShellFlag.Value)
+	}
+	mounts, err := parseRunMounts(flMounts.StringValues)
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if _, ok := b.secrets[mount.id]; mount.mountType == "secret" && !ok {
+			return errors.Errorf("RUN --mount secret %s must be declared with SECRET first", mount.id)
+		}
+		runFlags = append(runFlags, "mount="+mount.String())
+	}
+	if flCacheFromFiles.Value != "" {
+		var digests []string
+		for _, path := range strings.Split(flCacheFromFiles.Value, ",") {
+			dgst, err := b.contextFileDigest(path)
+			if err != nil {
+				return errors.Wrap(err, "failed to read --cache-from-files")
+			}
+			digests = append(digests, path+"="+dgst)
+		}
+		runFlags = append(runFlags, "cache-from-files="+strings.Join(digests, ","))
+	}
+	// the output is only a copy of what the command prints, it is not part
+	// of the cache key
+	outputPath := flOutput.Value
+	if outputPath != "" {
+		outputPath = filepath.ToSlash(filepath.Clean(filepath.FromSlash(outputPath)))
+		if filepath.IsAbs(outputPath) || outputPath == ".." || strings.HasPrefix(outputPath, "../") {
+			return fmt.Errorf("Invalid --output %q for RUN, must be a path relative to the build output", flOutput.Value)
+		}
+	}
+
+	if b.options.ValidateOnly {
+		return nil
+	}
+	if outputPath != "" && b.OnRunOutput == nil {
+		return errors.New("RUN --output is not supported by this build, its output cannot be written anywhere")
+	}
+	// the content of the mounts is not part of the cache key, only where
+	// they are mounted from, like the command itself
+	var binds []string
+	var secretsDir string
+	for i, mount := range mounts {
+		if mount.mountType == "secret" {
+			if secretsDir == "" {
+				if secretsDir, err = ioutils.TempDir("", "docker-build-secrets"); err != nil {
+					return err
+				}
+				defer os.RemoveAll(secretsDir)
+			}
+			source := filepath.Join(secretsDir, strconv.Itoa(i))
+			if err := ioutil.WriteFile(source, b.options.Secrets[mount.id], 0444); err != nil {
+				return errors.Wrapf(err, "failed to mount secret %s for RUN", mount.id)
+			}
+			binds = append(binds, source+":"+mount.target+":ro")
+			continue
+		}
+		source, err := b.contextMountSource(mount.source)
+		if err != nil {
+			return errors.Wrapf(err, "failed to mount %s for RUN", mount.source)
+		}
+		binds = append(binds, source+":"+mount.target+":ro")
+	}
 
 	args = handleJSONArgs(args, attributes)
 
 	if !attributes["json"] {
-		args = append(getShell(b.runConfig), args...)
+		if len(b.heredocs) > 0 {
+			args = []string{heredocScript(args[0], b.heredocs)}
+		}
+		shell := b.getShell(b.runConfig)
+		if flShellFlag.IsUsed() {
+			// the flag replaces the last word of the shell, -c by default
+			if len(shell) < 2 {
+				return fmt.Errorf("RUN --shell-flag requires a shell ending with a flag such as -c, the shell is %v", shell)
+			}
+			shell[len(shell)-1] = flShellFlag.Value
+		}
+		args = append(shell, args...)
+	}
+	if filter := b.options.RunCommandFilter; filter != nil {
+		if args, err = filter(args); err != nil {
+			return errors.Wrap(err, "RUN command rejected")
+		}
+		if len(args) == 0 {
+			return errors.New("RUN command rejected: the command filter returned an empty command")
+		}
 	}
 	config := &container.Config{
 		Cmd:   strslice.StrSlice(args),
@@ -400,8 +1104,12 @@ func run(b *Builder, args []string, attributes map[string]bool, original string)
 		tmpEnv := append([]string{fmt.Sprintf("|%d", len(cmdBuildEnv))}, cmdBuildEnv...)
 		saveCmd = strslice.StrSlice(append(tmpEnv, saveCmd...))
 	}
+	saveCmd = b.cacheCmd(prependRunFlags(saveCmd, runFlags))
 
 	b.runConfig.Cmd = saveCmd
+	if err := b.addLayer(); err != nil {
+		return err
+	}
 	hit, err := b.probeCache()
 	if err != nil {
 		return err
@@ -419,12 +1127,52 @@ func run(b *Builder, args []string, attributes map[string]bool, original string)
 
 	logrus.Debugf("[BUILDER] Command to be executed: %v", b.runConfig.Cmd)
 
-	cID, err := b.create()
+	hostConfig := b.hostConfig()
+	if network != runNetworkDefault {
+		hostConfig.NetworkMode = container.NetworkMode(network)
+	}
+	if security == runSecurityInsecure {
+		hostConfig.Privileged = true
+	}
+	if len(ulimits) > 0 {
+		hostConfig.Ulimits = mergeUlimits(hostConfig.Ulimits, ulimits)
+	}
+	if memory > 0 {
+		hostConfig.Memory = memory
+	}
+	if len(binds) > 0 {
+		hostConfig.Binds = binds
+	}
+	if nanoCPUs > 0 {
+		// the daemon rejects a quota or period along with nano CPUs, the
+		// flag replaces the CPU quota of the build for this step
+		hostConfig.NanoCPUs = nanoCPUs
+		hostConfig.CPUQuota = 0
+		hostConfig.CPUPeriod = 0
+	}
+	// the tty and working directory override only apply to the build
+	// container, the image config must not keep them
+	tty, workingDir := b.runConfig.Tty, b.runConfig.WorkingDir
+	b.runConfig.Tty = tty || flTTY.IsTrue()
+	b.runConfig.WorkingDir = workdir
+	cID, err := b.create(hostConfig)
+	b.runConfig.Tty, b.runConfig.WorkingDir = tty, workingDir
 	if err != nil {
 		return err
 	}
 
-	if err := b.run(cID); err != nil {
+	var output *lockedBuffer
+	if outputPath != "" {
+		output = &lockedBuffer{}
+	}
+	err = b.run(cID, timeout, output)
+	if output != nil {
+		// the output of a failed command is the most useful to keep
+		if outputErr := b.OnRunOutput(outputPath, output.Bytes()); outputErr != nil && err == nil {
+			err = errors.Wrapf(outputErr, "failed to write the output of RUN to %s", outputPath)
+		}
+	}
+	if err != nil {
 		return err
 	}
 
@@ -449,11 +1197,71 @@ func run(b *Builder, args []string, attributes map[string]bool, original string)
 		sort.Strings(tmpBuildEnv)
 		tmpEnv := append([]string{fmt.Sprintf("|%d", len(tmpBuildEnv))}, tmpBuildEnv...)
 		saveCmd = strslice.StrSlice(append(tmpEnv, saveCmd...))
+		saveCmd = b.cacheCmd(prependRunFlags(saveCmd, runFlags))
 	}
 	b.runConfig.Cmd = saveCmd
 	return b.commit(cID, cmd, "run")
 }
 
+// heredocToken matches a word which is only a here-document, such as <<EOF,
+// as the command line of RUN or a source of COPY.
+var heredocToken = regexp.MustCompile(`^<<-?(?:'(\w+)'|"(\w+)"|(\w+))$`)
+
+// heredocScript returns the shell command of a RUN instruction with
+// here-documents. When the command line is only the here-document, such as
+// RUN <<EOF, its content is the script. Otherwise the here-documents are
+// appended to the command line, for the shell to feed them to the command.
+func heredocScript(cmdline string, heredocs []parser.Heredoc) string {
+	if len(heredocs) == 1 && heredocToken.MatchString(strings.TrimSpace(cmdline)) {
+		if heredocs[0].Chomp {
+			return trimHeredocTabs(heredocs[0].Content)
+		}
+		return heredocs[0].Content
+	}
+	script := cmdline + "\n"
+	for _, heredoc := range heredocs {
+		script += heredoc.Content + heredoc.Name + "\n"
+	}
+	return script
+}
+
+// trimHeredocTabs strips the leading tabs of each line of a <<- here-document.
+func trimHeredocTabs(content string) string {
+	lines := strings.SplitAfter(content, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimLeft(line, "\t")
+	}
+	return strings.Join(lines, "")
+}
+
+const runNetworkDefault = "default"
+
+var validRunNetworks = map[string]bool{
+	"none":            true,
+	runNetworkDefault: true,
+	"host":            true,
+}
+
+const (
+	runSecuritySandbox  = "sandbox"
+	runSecurityInsecure = "insecure"
+)
+
+// prependRunFlags adds the non-default RUN flags to the command used for
+// cache lookups, so that changing them invalidates the cache. Like the
+// build-time env vars, each flag is prefixed with "|" to avoid conflicts with
+// the command itself.
+func prependRunFlags(cmd strslice.StrSlice, flags []string) strslice.StrSlice {
+	if len(flags) == 0 {
+		return cmd
+	}
+	prefixed := make([]string, 0, len(flags)+len(cmd))
+	for _, flag := range flags {
+		prefixed = append(prefixed, "|"+flag)
+	}
+	return strslice.StrSlice(append(prefixed, cmd...))
+}
+
 // CMD foo
 //
 // Set the default command to run in the container (which may be empty).
@@ -467,12 +1275,17 @@ func cmd(b *Builder, args []string, attributes map[string]bool, original string)
 	cmdSlice := handleJSONArgs(args, attributes)
 
 	if !attributes["json"] {
-		cmdSlice = append(getShell(b.runConfig), cmdSlice...)
+		cmdSlice = append(b.getShell(b.runConfig), cmdSlice...)
 	}
 
 	b.runConfig.Cmd = strslice.StrSlice(cmdSlice)
 	// set config as already being escaped, this prevents double escaping on windows
 	b.runConfig.ArgsEscaped = true
+	b.cmdExecForm = attributes["json"]
+
+	if !b.entrypointSet && len(b.runConfig.Entrypoint) > 0 {
+		b.noteInheritedEntrypoint()
+	}
 
 	if err := b.commit("", b.runConfig.Cmd, fmt.Sprintf("CMD %q", cmdSlice)); err != nil {
 		return err
@@ -485,6 +1298,18 @@ func cmd(b *Builder, args []string, attributes map[string]bool, original string)
 	return nil
 }
 
+// noteInheritedEntrypoint logs the command a container of the image runs when
+// CMD is set below an ENTRYPOINT inherited from the base image: CMD is then
+// passed as arguments to that ENTRYPOINT, which is easy to overlook.
+func (b *Builder) noteInheritedEntrypoint() {
+	effective := append(strslice.StrSlice{}, b.runConfig.Entrypoint...)
+	effective = append(effective, b.runConfig.Cmd...)
+	logrus.Debugf("[BUILDER] CMD %q is passed to the inherited ENTRYPOINT %q, the container runs %q", []string(b.runConfig.Cmd), []string(b.runConfig.Entrypoint), []string(effective))
+	if b.options.WarnInheritedEntrypoint {
+		fmt.Fprintf(b.Stdout, "[Warning] CMD %q is passed as arguments to the ENTRYPOINT %q inherited from the base image, the container runs %q\n", []string(b.runConfig.Cmd), []string(b.runConfig.Entrypoint), []string(effective))
+	}
+}
+
 // parseOptInterval(flag) is the duration of flag.Value, or 0 if
 // empty. An error is reported if the value is given and less than 1 second.
 func parseOptInterval(f *Flag) (time.Duration, error) {
@@ -505,11 +1330,15 @@ func parseOptInterval(f *Flag) (time.Duration, error) {
 // HEALTHCHECK foo
 //
 // Set the default healthcheck command to run in the container (which may be empty).
-// Argument handling is the same as RUN.
+// Argument handling is the same as RUN. When only flags are given, the timings
+// of the inherited healthcheck are updated.
 //
 func healthcheck(b *Builder, args []string, attributes map[string]bool, original string) error {
 	if len(args) == 0 {
-		return errAtLeastOneArgument("HEALTHCHECK")
+		if len(b.flags.Args) == 0 {
+			return errAtLeastOneArgument("HEALTHCHECK")
+		}
+		return updateHealthcheck(b)
 	}
 	typ := strings.ToUpper(args[0])
 	args = args[1:]
@@ -517,6 +1346,9 @@ func healthcheck(b *Builder, args []string, attributes map[string]bool, original
 		if len(args) != 0 {
 			return errors.New("HEALTHCHECK NONE takes no arguments")
 		}
+		if b.flags.Strict && len(b.flags.Args) > 0 {
+			return errors.New("HEALTHCHECK NONE takes no flags")
+		}
 		test := strslice.StrSlice{typ}
 		b.runConfig.Healthcheck = &container.HealthConfig{
 			Test: test,
@@ -531,10 +1363,7 @@ func healthcheck(b *Builder, args []string, attributes map[string]bool, original
 
 		healthcheck := container.HealthConfig{}
 
-		flInterval := b.flags.AddString("interval", "")
-		flTimeout := b.flags.AddString("timeout", "")
-		flStartPeriod := b.flags.AddString("start-period", "")
-		flRetries := b.flags.AddString("retries", "")
+		flags := addHealthcheckFlags(b.flags)
 
 		if err := b.flags.Parse(); err != nil {
 			return err
@@ -546,6 +1375,13 @@ func healthcheck(b *Builder, args []string, attributes map[string]bool, original
 			if len(cmdSlice) == 0 {
 				return errors.New("Missing command after HEALTHCHECK CMD")
 			}
+			// the healthcheck would fail every time, instead of the build
+			if strings.TrimSpace(cmdSlice[0]) == "" {
+				if attributes["json"] {
+					return errors.New("Missing command after HEALTHCHECK CMD, the executable of the exec form is blank")
+				}
+				return errors.New("Missing command after HEALTHCHECK CMD, the command is blank")
+			}
 
 			if !attributes["json"] {
 				typ = "CMD-SHELL"
@@ -556,26 +1392,91 @@ func healthcheck(b *Builder, args []string, attributes map[string]bool, original
 			return fmt.Errorf("Unknown type %#v in HEALTHCHECK (try CMD)", typ)
 		}
 
-		interval, err := parseOptInterval(flInterval)
-		if err != nil {
+		if err := flags.apply(&healthcheck); err != nil {
 			return err
 		}
-		healthcheck.Interval = interval
 
-		timeout, err := parseOptInterval(flTimeout)
-		if err != nil {
+		b.runConfig.Healthcheck = &healthcheck
+	}
+
+	return b.commit("", b.runConfig.Cmd, healthcheckComment(b.runConfig.Healthcheck))
+}
+
+// updateHealthcheck handles HEALTHCHECK with flags and no command, which
+// updates the timings of the inherited healthcheck and keeps its test.
+func updateHealthcheck(b *Builder) error {
+	flags := addHealthcheckFlags(b.flags)
+
+	if err := b.flags.Parse(); err != nil {
+		return err
+	}
+
+	inherited := b.runConfig.Healthcheck
+	if inherited == nil || len(inherited.Test) == 0 || inherited.Test[0] == "NONE" {
+		return errors.New("HEALTHCHECK without a command requires a healthcheck inherited from the base image")
+	}
+
+	healthcheck := *inherited
+	if err := flags.apply(&healthcheck); err != nil {
+		return err
+	}
+	b.runConfig.Healthcheck = &healthcheck
+
+	return b.commit("", b.runConfig.Cmd, healthcheckComment(b.runConfig.Healthcheck))
+}
+
+// healthcheckComment formats the healthcheck set by HEALTHCHECK for the
+// commit message, which is also its cache key.
+func healthcheckComment(hc *container.HealthConfig) string {
+	comment := fmt.Sprintf("HEALTHCHECK %q interval=%s timeout=%s start-period=%s retries=%d", hc.Test, hc.Interval, hc.Timeout, hc.StartPeriod, hc.Retries)
+	if len(hc.SuccessExitCodes) > 0 {
+		comment += fmt.Sprintf(" exit-success=%v", hc.SuccessExitCodes)
+	}
+	return comment
+}
+
+// healthcheckFlags are the flags setting the timings of a HEALTHCHECK.
+type healthcheckFlags struct {
+	interval    *Flag
+	timeout     *Flag
+	startPeriod *Flag
+	retries     *Flag
+	exitSuccess *Flag
+}
+
+func addHealthcheckFlags(bf *BFlags) healthcheckFlags {
+	return healthcheckFlags{
+		interval:    bf.AddString("interval", ""),
+		timeout:     bf.AddString("timeout", ""),
+		startPeriod: bf.AddString("start-period", ""),
+		retries:     bf.AddString("retries", ""),
+		exitSuccess: bf.AddString("exit-success", ""),
+	}
+}
+
+// apply sets the timings of healthcheck for each of the flags that is used,
+// leaving the others unchanged.
+func (f healthcheckFlags) apply(healthcheck *container.HealthConfig) error {
+	var err error
+	if f.interval.IsUsed() {
+		if healthcheck.Interval, err = parseOptInterval(f.interval); err != nil {
 			return err
 		}
-		healthcheck.Timeout = timeout
-
-		startPeriod, err := parseOptInterval(flStartPeriod)
-		if err != nil {
+	}
+	if f.timeout.IsUsed() {
+		if healthcheck.Timeout, err = parseOptInterval(f.timeout); err != nil {
 			return err
 		}
-		healthcheck.StartPeriod = startPeriod
-
-		if flRetries.Value != "" {
-			retries, err := strconv.ParseInt(flRetries.Value, 10, 32)
+	}
+	if f.startPeriod.IsUsed() {
+		if healthcheck.StartPeriod, err = parseOptInterval(f.startPeriod); err != nil {
+			return err
+		}
+	}
+	if f.retries.IsUsed() {
+		healthcheck.Retries = 0
+		if f.retries.Value != "" {
+			retries, err := strconv.ParseInt(f.retries.Value, 10, 32)
 			if err != nil {
 				return err
 			}
@@ -583,14 +1484,30 @@ func healthcheck(b *Builder, args []string, attributes map[string]bool, original
 				return fmt.Errorf("--retries must be at least 1 (not %d)", retries)
 			}
 			healthcheck.Retries = int(retries)
-		} else {
-			healthcheck.Retries = 0
 		}
-
-		b.runConfig.Healthcheck = &healthcheck
 	}
+	if f.exitSuccess.IsUsed() {
+		codes, err := parseExitCodes(f.exitSuccess.Value)
+		if err != nil {
+			return err
+		}
+		healthcheck.SuccessExitCodes = codes
+	}
+	return nil
+}
 
-	return b.commit("", b.runConfig.Cmd, fmt.Sprintf("HEALTHCHECK %q", b.runConfig.Healthcheck))
+// parseExitCodes parses the comma separated list of exit codes of the
+// --exit-success flag of HEALTHCHECK.
+func parseExitCodes(value string) ([]int, error) {
+	var codes []int
+	for _, s := range strings.Split(value, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || code < 0 || code > 255 {
+			return nil, fmt.Errorf("--exit-success must be a comma separated list of exit codes between 0 and 255 (not %q)", value)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
 }
 
 // ENTRYPOINT /usr/sbin/nginx
@@ -617,9 +1534,12 @@ func entrypoint(b *Builder, args []string, attributes map[string]bool, original
 		b.runConfig.Entrypoint = nil
 	default:
 		// ENTRYPOINT echo hi
-		b.runConfig.Entrypoint = strslice.StrSlice(append(getShell(b.runConfig), parsed[0]))
+		b.runConfig.Entrypoint = strslice.StrSlice(append(b.getShell(b.runConfig), parsed[0]))
 	}
 
+	b.entrypointExecForm = attributes["json"]
+	b.entrypointSet = true
+
 	// when setting the entrypoint if a CMD was not explicitly set then
 	// set the command to nil
 	if !b.cmdSet {
@@ -633,47 +1553,102 @@ func entrypoint(b *Builder, args []string, attributes map[string]bool, original
 	return nil
 }
 
+var validExposeProtocols = map[string]bool{
+	"tcp":  true,
+	"udp":  true,
+	"sctp": true,
+}
+
 // EXPOSE 6667/tcp 7000/tcp
 //
 // Expose ports for links and port mappings. This all ends up in
-// b.runConfig.ExposedPorts for runconfig.
+// b.runConfig.ExposedPorts for runconfig. Ports without an explicit protocol
+// default to tcp, or to the protocol given with --protocol.
 //
 func expose(b *Builder, args []string, attributes map[string]bool, original string) error {
-	portsTab := args
-
 	if len(args) == 0 {
 		return errAtLeastOneArgument("EXPOSE")
 	}
 
+	flProtocol := b.flags.AddString("protocol", "tcp")
+
 	if err := b.flags.Parse(); err != nil {
 		return err
 	}
 
+	protocol := strings.ToLower(flProtocol.Value)
+	if !validExposeProtocols[protocol] {
+		return fmt.Errorf("Invalid protocol %q for EXPOSE, must be one of tcp, udp or sctp", flProtocol.Value)
+	}
+
 	if b.runConfig.ExposedPorts == nil {
 		b.runConfig.ExposedPorts = make(nat.PortSet)
 	}
 
-	ports, _, err := nat.ParsePortSpecs(portsTab)
-	if err != nil {
-		return err
+	ports := make(nat.PortSet)
+	for _, port := range args {
+		// ports without an explicit protocol get the one set with --protocol
+		proto := protocol
+		if i := strings.Index(port, "/"); i >= 0 {
+			if p := strings.ToLower(port[i+1:]); p != "" {
+				proto = p
+			}
+			port = port[:i]
+		}
+		if !validExposeProtocols[proto] {
+			return fmt.Errorf("Invalid protocol %q for EXPOSE %s, must be one of tcp, udp or sctp", proto, port)
+		}
+		parsed, err := parseExposedPorts(port, proto)
+		if err != nil {
+			return err
+		}
+		for _, p := range parsed {
+			ports[p] = struct{}{}
+		}
 	}
 
 	// instead of using ports directly, we build a list of ports and sort it so
 	// the order is consistent. This prevents cache burst where map ordering
 	// changes between builds
 	portList := make([]string, len(ports))
+	var duplicates []string
 	var i int
 	for port := range ports {
 		if _, exists := b.runConfig.ExposedPorts[port]; !exists {
 			b.runConfig.ExposedPorts[port] = struct{}{}
+		} else {
+			duplicates = append(duplicates, string(port))
 		}
 		portList[i] = string(port)
 		i++
 	}
 	sort.Strings(portList)
+	if len(duplicates) > 0 {
+		sort.Strings(duplicates)
+		fmt.Fprintf(b.Stdout, "[Warning] EXPOSE %s: already exposed by the image, the duplicates can be removed\n", strings.Join(duplicates, ", "))
+	}
 	return b.commit("", b.runConfig.Cmd, fmt.Sprintf("EXPOSE %s", strings.Join(portList, " ")))
 }
 
+// parseExposedPorts parses a port or range of ports exposed with the given
+// protocol. nat does not know about sctp, so the port spec is validated as tcp
+// and the protocol is swapped back in afterwards.
+func parseExposedPorts(port, proto string) ([]nat.Port, error) {
+	mappings, err := nat.ParsePortSpec(port + "/tcp")
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]nat.Port, 0, len(mappings))
+	for _, mapping := range mappings {
+		p, err := nat.NewPort(proto, mapping.Port.Port())
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
 // USER foo
 //
 // Set the user to 'foo' for future commands and when running the
@@ -688,6 +1663,12 @@ func user(b *Builder, args []string, attributes map[string]bool, original string
 		return err
 	}
 
+	if b.options.StrictUser && !b.options.ValidateOnly && runtime.GOOS != "windows" {
+		if err := b.checkUser(args[0]); err != nil {
+			return err
+		}
+	}
+
 	b.runConfig.User = args[0]
 	return b.commit("", b.runConfig.Cmd, fmt.Sprintf("USER %v", args))
 }
@@ -721,21 +1702,43 @@ func volume(b *Builder, args []string, attributes map[string]bool, original stri
 	return nil
 }
 
-// STOPSIGNAL signal
+// STOPSIGNAL signal[,signal...]
 //
-// Set the signal that will be used to kill the container.
+// Set the signal that will be used to kill the container. With a list of
+// signals, each one is sent after the previous one failed to stop it: the
+// first one is the StopSignal of the image, the others are kept in the
+// signal.StopSignalsLabel label.
 func stopSignal(b *Builder, args []string, attributes map[string]bool, original string) error {
 	if len(args) != 1 {
 		return errExactlyOneArgument("STOPSIGNAL")
 	}
 
+	// The argument has already been expanded, so an unset variable leaves
+	// nothing to parse.
 	sig := args[0]
-	_, err := signal.ParseSignal(sig)
-	if err != nil {
-		return err
+	if sig == "" {
+		return errors.New("STOPSIGNAL requires a signal, the argument expanded to an empty value")
+	}
+	// a list of signals is sent in order by the daemon, escalating to the
+	// next one when the container did not stop in time
+	var signals []string
+	for _, s := range strings.Split(sig, ",") {
+		s = strings.TrimSpace(s)
+		if _, err := signal.ParseSignal(s); err != nil {
+			return err
+		}
+		signals = append(signals, s)
 	}
 
-	b.runConfig.StopSignal = sig
+	b.runConfig.StopSignal = signals[0]
+	if len(signals) > 1 {
+		if b.runConfig.Labels == nil {
+			b.runConfig.Labels = map[string]string{}
+		}
+		b.runConfig.Labels[signal.StopSignalsLabel] = strings.Join(signals[1:], ",")
+	} else {
+		delete(b.runConfig.Labels, signal.StopSignalsLabel)
+	}
 	return b.commit("", b.runConfig.Cmd, fmt.Sprintf("STOPSIGNAL %v", args))
 }
 
@@ -744,11 +1747,21 @@ func stopSignal(b *Builder, args []string, attributes map[string]bool, original
 // Adds the variable foo to the trusted list of variables that can be passed
 // to builder using the --build-arg flag for expansion/substitution or passing to 'run'.
 // Dockerfile author may optionally set a default value of this variable.
+// ARG * adds all the variables passed with --build-arg, and ARG PREFIX_* the
+// ones whose name starts with PREFIX_.
+//
+// ARG --required name fails the build if the variable has no value.
 func arg(b *Builder, args []string, attributes map[string]bool, original string) error {
 	if len(args) != 1 {
 		return errExactlyOneArgument("ARG")
 	}
 
+	flRequired := b.flags.AddBool("required", false)
+
+	if err := b.flags.Parse(); err != nil {
+		return err
+	}
+
 	var (
 		name       string
 		newValue   string
@@ -756,6 +1769,16 @@ func arg(b *Builder, args []string, attributes map[string]bool, original string)
 	)
 
 	arg := args[0]
+	if strings.HasSuffix(arg, "*") && !strings.Contains(arg, "=") {
+		if flRequired.IsTrue() {
+			return fmt.Errorf("ARG --required can't be used with %s, declare the required args by name", arg)
+		}
+		if arg == "*" {
+			return b.allowAllBuildArgs()
+		}
+		return b.allowBuildArgPrefix(strings.TrimSuffix(arg, "*"))
+	}
+
 	// 'arg' can just be a name or name-value pair. Note that this is different
 	// from 'env' that handles the split of name and value at the parser level.
 	// The reason for doing it differently for 'arg' is that we support just
@@ -767,8 +1790,12 @@ func arg(b *Builder, args []string, attributes map[string]bool, original string)
 			return errBlankCommandNames("ARG")
 		}
 
+		var err error
 		name = parts[0]
-		newValue = parts[1]
+		if newValue, err = b.expandArgDefault(parts[1]); err != nil {
+			return err
+		}
+		arg = name + "=" + newValue
 		hasDefault = true
 	} else {
 		name = arg
@@ -780,6 +1807,18 @@ func arg(b *Builder, args []string, attributes map[string]bool, original string)
 		value = &newValue
 	}
 	b.buildArgs.AddArg(name, value)
+	// the args are not given when only validating the Dockerfile
+	if flRequired.IsTrue() && !b.options.ValidateOnly {
+		if err := b.buildArgs.Require(name); err != nil {
+			return err
+		}
+	}
+	spec := ArgSpec{Name: name, HasDefault: hasDefault, Global: !b.hasFromImage(), Required: flRequired.IsTrue()}
+	if hasDefault {
+		// the default as written, the expanded one depends on the build
+		spec.Default = strings.SplitN(args[0], "=", 2)[1]
+	}
+	b.buildArgs.Declare(spec)
 
 	// Arg before FROM doesn't add a layer
 	if !b.hasFromImage() {
@@ -789,6 +1828,273 @@ func arg(b *Builder, args []string, attributes map[string]bool, original string)
 	return b.commit("", b.runConfig.Cmd, fmt.Sprintf("ARG %s", arg))
 }
 
+// allowAllBuildArgs handles ARG *, which passes all the build args given to
+// the build to the instructions of the stage without declaring each of them.
+func (b *Builder) allowAllBuildArgs() error {
+	if !b.hasFromImage() {
+		return errors.New("ARG * is only allowed after FROM")
+	}
+	fmt.Fprintln(b.Stdout, "[Warning] ARG * passes every build arg to the following instructions, which makes the build depend on how it is invoked; declare the args that are used instead")
+	b.buildArgs.AllowAll()
+	return b.commit("", b.runConfig.Cmd, "ARG *")
+}
+
+// allowBuildArgPrefix handles ARG PREFIX_*, which passes the build args given
+// to the build whose name starts with PREFIX_ to the instructions of the stage.
+func (b *Builder) allowBuildArgPrefix(prefix string) error {
+	if strings.Contains(prefix, "*") {
+		return errors.Errorf("ARG %s* is not a valid prefix, only a trailing * is allowed", prefix)
+	}
+	if !b.hasFromImage() {
+		return errors.Errorf("ARG %s* is only allowed after FROM", prefix)
+	}
+	b.buildArgs.AllowPrefix(prefix)
+	return b.commit("", b.runConfig.Cmd, fmt.Sprintf("ARG %s*", prefix))
+}
+
+// parseRunUlimits parses the values of RUN --ulimit, such as nofile=1024:2048,
+// and returns the limits sorted by name.
+func parseRunUlimits(values []string) ([]*units.Ulimit, error) {
+	var ulimits []*units.Ulimit
+	names := map[string]bool{}
+	for _, value := range values {
+		ulimit, err := units.ParseUlimit(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid --ulimit %q for RUN", value)
+		}
+		if names[ulimit.Name] {
+			return nil, fmt.Errorf("Invalid --ulimit %q for RUN, %s is already limited", value, ulimit.Name)
+		}
+		names[ulimit.Name] = true
+		ulimits = append(ulimits, ulimit)
+	}
+	sort.Slice(ulimits, func(i, j int) bool { return ulimits[i].Name < ulimits[j].Name })
+	return ulimits, nil
+}
+
+// runMinMemory is the smallest memory limit of a container accepted by the
+// daemon.
+const runMinMemory = 4 * 1024 * 1024
+
+// parseRunMemory parses the value of RUN --memory, a size such as 512m, and
+// returns it in bytes, or 0 when it is empty.
+func parseRunMemory(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	memory, err := units.RAMInBytes(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid --memory %q for RUN", value)
+	}
+	if memory < runMinMemory {
+		return 0, fmt.Errorf("Invalid --memory %q for RUN, the minimum is 4MB", value)
+	}
+	return memory, nil
+}
+
+// parseRunCPUs parses the value of RUN --cpus, a decimal number of CPUs such
+// as 1.5, and returns it in nano CPUs, or 0 when it is empty.
+func parseRunCPUs(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	nanoCPUs, err := opts.ParseCPUs(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Invalid --cpus %q for RUN", value)
+	}
+	if nanoCPUs <= 0 {
+		return 0, fmt.Errorf("Invalid --cpus %q for RUN, must be above 0", value)
+	}
+	if max := int64(runtime.NumCPU()) * 1e9; nanoCPUs > max {
+		return 0, fmt.Errorf("Invalid --cpus %q for RUN, must be at most %d, the number of CPUs of the daemon", value, runtime.NumCPU())
+	}
+	return nanoCPUs, nil
+}
+
+// runMount is a read-only bind mount of the build context, or of a path
+// below it, or of a secret declared with SECRET, given with RUN --mount.
+type runMount struct {
+	mountType string // bind or secret
+	source    string // path relative to the build context, for bind mounts
+	id        string // id of the secret, for secret mounts
+	target    string // absolute path in the container
+}
+
+// String returns the mount in the form of RUN --mount, such as
+// type=bind,source=.,target=/src,ro. The value of a secret is not part of
+// it, only its id.
+func (m runMount) String() string {
+	if m.mountType == "secret" {
+		return "type=secret,id=" + m.id + ",target=" + m.target
+	}
+	return "type=bind,source=" + m.source + ",target=" + m.target + ",ro"
+}
+
+// parseRunMounts parses the values of RUN --mount, such as
+// type=bind,source=.,target=/src,ro or type=secret,id=npmrc. The source of a
+// bind mount defaults to the root of the build context, which is always
+// mounted read-only, and the target of a secret to /run/secrets/<id>.
+func parseRunMounts(values []string) ([]runMount, error) {
+	var mounts []runMount
+	targets := map[string]bool{}
+	for _, value := range values {
+		var sourceSet bool
+		mount := runMount{source: "."}
+		for _, field := range strings.Split(value, ",") {
+			parts := strings.SplitN(field, "=", 2)
+			key := strings.ToLower(strings.TrimSpace(parts[0]))
+			switch key {
+			case "type", "source", "src", "id", "target", "dst", "destination":
+				if len(parts) != 2 || parts[1] == "" {
+					return nil, fmt.Errorf("Invalid --mount %q for RUN, %s requires a value", value, key)
+				}
+			}
+			switch key {
+			case "type":
+				mount.mountType = strings.ToLower(parts[1])
+			case "source", "src":
+				mount.source = parts[1]
+				sourceSet = true
+			case "id":
+				mount.id = parts[1]
+			case "target", "dst", "destination":
+				mount.target = parts[1]
+			case "ro", "readonly":
+				if len(parts) == 2 {
+					ro, err := strconv.ParseBool(parts[1])
+					if err != nil {
+						return nil, fmt.Errorf("Invalid --mount %q for RUN, %s must be a boolean", value, key)
+					}
+					if !ro {
+						return nil, fmt.Errorf("Invalid --mount %q for RUN, the build context can only be mounted read-only", value)
+					}
+				}
+			default:
+				return nil, fmt.Errorf("Invalid --mount %q for RUN, unknown option %s", value, key)
+			}
+		}
+		switch mount.mountType {
+		case "bind":
+			if mount.id != "" {
+				return nil, fmt.Errorf("Invalid --mount %q for RUN, id only applies to secret mounts", value)
+			}
+			source := filepath.ToSlash(filepath.Clean(filepath.FromSlash(mount.source)))
+			if filepath.IsAbs(source) || strings.HasPrefix(source, "/") || source == ".." || strings.HasPrefix(source, "../") {
+				return nil, fmt.Errorf("Invalid --mount %q for RUN, the source must be a path within the build context", value)
+			}
+			mount.source = source
+		case "secret":
+			if sourceSet {
+				return nil, fmt.Errorf("Invalid --mount %q for RUN, source only applies to bind mounts", value)
+			}
+			if mount.id == "" {
+				return nil, fmt.Errorf("Invalid --mount %q for RUN, a secret id is required", value)
+			}
+			mount.source = ""
+			if mount.target == "" {
+				mount.target = "/run/secrets/" + mount.id
+			}
+		default:
+			return nil, fmt.Errorf("Invalid --mount %q for RUN, type must be bind or secret", value)
+		}
+		if mount.target == "" {
+			return nil, fmt.Errorf("Invalid --mount %q for RUN, a target is required", value)
+		}
+		target := path.Clean(filepath.ToSlash(mount.target))
+		if !path.IsAbs(target) || target == "/" {
+			return nil, fmt.Errorf("Invalid --mount %q for RUN, the target must be an absolute path other than /", value)
+		}
+		if targets[target] {
+			return nil, fmt.Errorf("Invalid --mount %q for RUN, %s is already mounted", value, target)
+		}
+		targets[target] = true
+		mount.target = target
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// mergeUlimits returns the limits of base, the ulimits of the build, with
+// those of the same name replaced by the limits of overrides.
+func mergeUlimits(base, overrides []*units.Ulimit) []*units.Ulimit {
+	merged := append([]*units.Ulimit{}, overrides...)
+	for _, ulimit := range base {
+		overridden := false
+		for _, override := range overrides {
+			if override.Name == ulimit.Name {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged = append(merged, ulimit)
+		}
+	}
+	return merged
+}
+
+// evalRunCondition returns whether the condition of RUN --if is true, after
+// expanding the build args and the environment in it. Only simple values
+// are supported, not expressions.
+func (b *Builder) evalRunCondition(condition string) (bool, error) {
+	envs := append(b.runConfig.Env, b.buildArgsWithoutConfigEnv()...)
+	value, err := ProcessWord(condition, envs, b.escapeToken)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "", "0", "false", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid --if %q for RUN, %q must be one of true, false, yes, no, on, off, 1, 0 or empty", condition, value)
+}
+
+// expandArgDefault expands the references to build args in the default value
+// of an ARG. Before the first FROM these are the meta args, and after it the
+// args declared in the current stage and the environment.
+func (b *Builder) expandArgDefault(value string) (string, error) {
+	var envs []string
+	if !b.hasFromImage() {
+		for key, value := range b.buildArgs.GetAllMeta() {
+			envs = append(envs, key+"="+value)
+		}
+	} else {
+		envs = append(b.runConfig.Env, b.buildArgsWithoutConfigEnv()...)
+	}
+	return ProcessWord(value, envs, b.escapeToken)
+}
+
+// SECRET id=mysecret
+//
+// Declares a secret required by the build, which fails early when the secret
+// was not provided. The value of the secret is never committed.
+func secret(b *Builder, args []string, attributes map[string]bool, original string) error {
+	if len(args) != 1 {
+		return errExactlyOneArgument("SECRET")
+	}
+
+	if err := b.flags.Parse(); err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(args[0], "=", 2)
+	if len(parts) != 2 || parts[0] != "id" || parts[1] == "" {
+		return errors.Errorf("SECRET requires an argument of the form id=<id>, got %s", args[0])
+	}
+	id := parts[1]
+	if _, ok := b.options.Secrets[id]; !ok {
+		return errors.Errorf("secret %s is required but was not provided", id)
+	}
+
+	if b.secrets == nil {
+		b.secrets = make(map[string]struct{})
+	}
+	b.secrets[id] = struct{}{}
+	return nil
+}
+
 // SHELL powershell -command
 //
 // Set the non-default shell to use.
@@ -803,6 +2109,12 @@ func shell(b *Builder, args []string, attributes map[string]bool, original strin
 		return errAtLeastOneArgument("SHELL")
 	case attributes["json"]:
 		// SHELL ["powershell", "-command"]
+		if mismatch := shellPlatformMismatch(shellSlice[0], runtime.GOOS); mismatch != "" {
+			if b.options.StrictShell {
+				return errors.New(mismatch)
+			}
+			fmt.Fprintf(b.Stdout, "[Warning] %s\n", mismatch)
+		}
 		b.runConfig.Shell = strslice.StrSlice(shellSlice)
 	default:
 		// SHELL powershell -command - not JSON
@@ -811,6 +2123,60 @@ func shell(b *Builder, args []string, attributes map[string]bool, original strin
 	return b.commit("", b.runConfig.Cmd, fmt.Sprintf("SHELL %v", shellSlice))
 }
 
+var windowsDrivePathRegexp = regexp.MustCompile(`^[a-zA-Z]:[\\/]`)
+
+// shellPlatformMismatch returns a description of the problem if the SHELL
+// executable looks like it belongs to another platform than goos, the
+// platform of the image, or an empty string if it doesn't.
+func shellPlatformMismatch(executable, goos string) string {
+	if goos == "windows" {
+		if strings.HasPrefix(executable, "/") {
+			return fmt.Sprintf("SHELL executable %s is a Unix path, but the image is built for windows", executable)
+		}
+		return ""
+	}
+	lower := strings.ToLower(executable)
+	if strings.HasSuffix(lower, ".exe") || lower == "cmd" || strings.Contains(executable, `\`) || windowsDrivePathRegexp.MatchString(executable) {
+		return fmt.Sprintf("SHELL executable %s is a Windows executable, but the image is built for %s", executable, goos)
+	}
+	return ""
+}
+
+// checkOnBuildTrigger returns an error if the ONBUILD trigger instruction,
+// with the arguments args, is sure to fail when it runs in a later build,
+// because of its number of arguments or of a malformed JSON form. Only RUN,
+// ADD, COPY and ENV are checked.
+func checkOnBuildTrigger(instruction string, args []string, attributes map[string]bool) error {
+	name := "ONBUILD " + instruction
+	switch instruction {
+	case "RUN", "ADD", "COPY":
+		// the parser falls back to the shell form for invalid JSON, such as
+		// with single quotes, while [ alone is the shell test command
+		if !attributes["json"] && len(args) > 0 && (strings.HasPrefix(args[0], `["`) || strings.HasPrefix(args[0], `['`)) {
+			return errors.Errorf("%s is not a valid JSON array of strings: %s", name, strings.Join(args, " "))
+		}
+		if instruction == "RUN" && len(args) == 0 {
+			return errAtLeastOneArgument(name)
+		}
+		if instruction != "RUN" && len(args) < 2 {
+			return errAtLeastTwoArguments(name)
+		}
+	case "ENV":
+		if len(args) == 0 {
+			return errAtLeastOneArgument(name)
+		}
+		if len(args)%2 != 0 {
+			return errTooManyArguments(name)
+		}
+		for j := 0; j < len(args); j += 2 {
+			if len(args[j]) == 0 {
+				return errBlankCommandNames(name)
+			}
+		}
+	}
+	return nil
+}
+
 func errAtLeastOneArgument(command string) error {
 	return fmt.Errorf("%s requires at least one argument", command)
 }
@@ -832,9 +2198,16 @@ func errTooManyArguments(command string) error {
 }
 
 // getShell is a helper function which gets the right shell for prefixing the
-// shell-form of RUN, ENTRYPOINT and CMD instructions
-func getShell(c *container.Config) []string {
+// shell-form of RUN, ENTRYPOINT and CMD instructions. Without a SHELL
+// instruction, this is the shell of the DefaultShells option for the OS, if
+// any, or the default shell of the platform.
+func (b *Builder) getShell(c *container.Config) []string {
 	if 0 == len(c.Shell) {
+		if b.options != nil {
+			if shell := b.options.DefaultShells[runtime.GOOS]; len(shell) > 0 {
+				return append([]string{}, shell...)
+			}
+		}
 		return append([]string{}, defaultShell[:]...)
 	}
 	return append([]string{}, c.Shell[:]...)
@@ -846,11 +2219,41 @@ func mountByRef(b *Builder, name string) (*imageMount, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := verifyImageDigest(name, image); err != nil {
+		return nil, err
+	}
 	im := b.imageContexts.newImageMount(image.ImageID())
 	return im, nil
 }
 
+// verifyImageDigest returns an error if name references an image by digest,
+// and image is not known by this digest.
+func verifyImageDigest(name string, image builder.Image) error {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return err
+	}
+	digested, ok := ref.(reference.Digested)
+	if !ok {
+		return nil
+	}
+	if di, ok := image.(builder.DigestedImage); ok {
+		for _, dgst := range di.RepoDigests() {
+			if dgst == digested.Digest() {
+				return nil
+			}
+		}
+	}
+	return errors.Errorf("image %s resolved to %s, which does not match its digest", name, image.ImageID())
+}
+
 func pullOrGetImage(b *Builder, name string) (builder.Image, error) {
+	// base images and COPY --from images are both looked up here, so both
+	// are rewritten by the resolver
+	if b.options.ImageResolver != nil {
+		name = b.options.ImageResolver(name)
+	}
+
 	var image builder.Image
 	if !b.options.PullParent {
 		image, _ = b.docker.GetImageOnBuild(name)
@@ -858,10 +2261,49 @@ func pullOrGetImage(b *Builder, name string) (builder.Image, error) {
 	}
 	if image == nil {
 		var err error
-		image, err = b.docker.PullOnBuild(b.clientCtx, name, b.options.AuthConfigs, b.Output)
+		image, err = b.pullWithRetries(name)
 		if err != nil {
 			return nil, err
 		}
 	}
 	return image, nil
 }
+
+// pullWithRetries pulls the image name, retrying with an exponential backoff
+// as long as the pull fails with a network error and attempts are left.
+func (b *Builder) pullWithRetries(name string) (builder.Image, error) {
+	delay := b.options.PullRetryDelay
+	for attempt := 1; ; attempt++ {
+		image, err := b.docker.PullOnBuild(b.clientCtx, name, b.options.AuthConfigs, b.Output)
+		if err == nil || attempt >= b.options.PullAttempts || !isRetryablePullError(err) {
+			return image, err
+		}
+		fmt.Fprintf(b.Output, "Pulling %s failed, retrying in %s (attempt %d of %d): %v\n", name, delay, attempt+1, b.options.PullAttempts, err)
+		select {
+		case <-time.After(delay):
+		case <-b.clientCtx.Done():
+			return nil, errCancelled
+		}
+		delay *= 2
+	}
+}
+
+// isRetryablePullError returns whether err is a network error, which may
+// not happen again, rather than an error from the registry such as a missing
+// image or denied access.
+func isRetryablePullError(err error) bool {
+	err = errors.Cause(err)
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	switch e := err.(type) {
+	case *url.Error:
+		// url.Error is a net.Error, but may wrap an authentication error
+		return isRetryablePullError(e.Err)
+	case *net.OpError:
+		return true
+	case net.Error:
+		return e.Timeout() || e.Temporary()
+	}
+	return false
+}
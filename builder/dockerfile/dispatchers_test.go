@@ -1,17 +1,30 @@
 package dockerfile
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"runtime"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/docker/docker/pkg/signal"
 	"github.com/docker/go-connections/nat"
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 type commandWithFunction struct {
@@ -24,7 +37,8 @@ func TestCommandsExactlyOneArgument(t *testing.T) {
 		{"MAINTAINER", func(args []string) error { return maintainer(nil, args, nil, "") }},
 		{"WORKDIR", func(args []string) error { return workdir(nil, args, nil, "") }},
 		{"USER", func(args []string) error { return user(nil, args, nil, "") }},
-		{"STOPSIGNAL", func(args []string) error { return stopSignal(nil, args, nil, "") }}}
+		{"STOPSIGNAL", func(args []string) error { return stopSignal(nil, args, nil, "") }},
+		{"SECRET", func(args []string) error { return secret(nil, args, nil, "") }}}
 
 	for _, command := range commands {
 		err := command.function([]string{})
@@ -46,7 +60,7 @@ func TestCommandsAtLeastOneArgument(t *testing.T) {
 		{"ENV", func(args []string) error { return env(nil, args, nil, "") }},
 		{"LABEL", func(args []string) error { return label(nil, args, nil, "") }},
 		{"ONBUILD", func(args []string) error { return onbuild(nil, args, nil, "") }},
-		{"HEALTHCHECK", func(args []string) error { return healthcheck(nil, args, nil, "") }},
+		{"HEALTHCHECK", func(args []string) error { return healthcheck(&Builder{flags: &BFlags{}}, args, nil, "") }},
 		{"EXPOSE", func(args []string) error { return expose(nil, args, nil, "") }},
 		{"VOLUME", func(args []string) error { return volume(nil, args, nil, "") }}}
 
@@ -117,6 +131,7 @@ func TestCommandseBlankNames(t *testing.T) {
 	}
 
 	for _, command := range commands {
+		b.flags = &BFlags{}
 		err := command.function([]string{"", ""})
 
 		if err == nil {
@@ -162,6 +177,42 @@ func TestEnvValueWithExistingRunConfigEnv(t *testing.T) {
 	assert.Equal(t, expected, b.runConfig.Env)
 }
 
+func TestEnvAppend(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.runConfig.Env = []string{"PATH=/usr/bin", "var2=fromenv"}
+
+	args := []string{"PATH+", ":/opt/bin", "var3+", "new"}
+	require.NoError(t, env(b, args, nil, ""))
+
+	expected := []string{"PATH=/usr/bin:/opt/bin", "var2=fromenv", "var3=new"}
+	assert.Equal(t, expected, b.runConfig.Env)
+
+	b.flags = NewBFlags()
+	err := env(b, []string{"+", "value"}, nil, "")
+	assert.EqualError(t, err, "ENV names can not be blank")
+}
+
+func TestEnvUnset(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.runConfig.Env = []string{"PATH=/usr/bin", "HTTP_PROXY=http://proxy:3128", "var2=fromenv"}
+
+	b.flags.Args = []string{"--unset"}
+	require.NoError(t, env(b, []string{"HTTP_PROXY", "", "NO_PROXY", ""}, nil, ""))
+	assert.Equal(t, []string{"PATH=/usr/bin", "var2=fromenv"}, b.runConfig.Env)
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--unset"}
+	err := env(b, []string{"var2=value", ""}, nil, "")
+	assert.EqualError(t, err, "ENV --unset takes the names of the variables to remove, not a value: var2=value")
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--unset", "--file"}
+	err = env(b, []string{"var2", ""}, nil, "")
+	assert.EqualError(t, err, "ENV --unset can't be used with --file")
+}
+
 func TestMaintainer(t *testing.T) {
 	maintainerEntry := "Some Maintainer <maintainer@example.com>"
 
@@ -176,13 +227,24 @@ func TestMaintainer(t *testing.T) {
 	}
 }
 
+func TestMaintainerDeprecation(t *testing.T) {
+	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
+
+	assert.NoError(t, maintainer(b, []string{"Some Maintainer"}, nil, ""))
+
+	report := b.DeprecationReport()
+	assert.Len(t, report, 1)
+	assert.Equal(t, "MAINTAINER", report[0].Instruction)
+	assert.Contains(t, report[0].Message, "LABEL")
+}
+
 func TestLabel(t *testing.T) {
 	labelName := "label"
 	labelValue := "value"
 
 	labelEntry := []string{labelName, labelValue}
 
-	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
+	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true, options: &types.ImageBuildOptions{}, buildArgs: newBuildArgs(nil)}
 
 	if err := label(b, labelEntry, nil, ""); err != nil {
 		t.Fatalf("Error when executing label: %s", err.Error())
@@ -197,13 +259,92 @@ func TestLabel(t *testing.T) {
 	}
 }
 
+func TestLabelCaseInsensitiveDuplicate(t *testing.T) {
+	stdout := new(bytes.Buffer)
+	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true, Stdout: stdout, options: &types.ImageBuildOptions{}, buildArgs: newBuildArgs(nil)}
+
+	assert.NoError(t, label(b, []string{"Foo", "1"}, nil, ""))
+	b.flags = &BFlags{}
+	assert.NoError(t, label(b, []string{"foo", "2", "bar", "3"}, nil, ""))
+
+	assert.Equal(t, map[string]string{"Foo": "1", "foo": "2", "bar": "3"}, b.runConfig.Labels)
+	assert.Equal(t, "[Warning] LABEL foo differs only by case from existing label Foo\n", stdout.String())
+}
+
+func TestLabelValidator(t *testing.T) {
+	var validated []string
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	b.options.LabelValidator = func(key, value string) error {
+		validated = append(validated, key+"="+value)
+		if strings.HasPrefix(key, "com.docker.") {
+			return fmt.Errorf("the com.docker. namespace is reserved")
+		}
+		return nil
+	}
+
+	require.NoError(t, label(b, []string{"org.opencontainers.image.title", "app"}, nil, ""))
+	b.flags = NewBFlags()
+	err := label(b, []string{"version", "1.0", "com.docker.internal", "true"}, nil, "")
+	assert.EqualError(t, err, "invalid LABEL com.docker.internal: the com.docker. namespace is reserved")
+	assert.Equal(t, []string{"org.opencontainers.image.title=app", "version=1.0", "com.docker.internal=true"}, validated)
+	assert.NotContains(t, b.runConfig.Labels, "com.docker.internal")
+}
+
+func TestStrictLabelKeys(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	b.options.StrictLabelKeys = true
+
+	for _, key := range []string{"maintainer", "com.example.version", "org.opencontainers.image.created", "io.k8s.display-name"} {
+		b.flags = NewBFlags()
+		assert.NoError(t, label(b, []string{key, "value"}, nil, ""), key)
+	}
+
+	testCases := []struct {
+		key         string
+		expectedErr string
+	}{
+		{key: "buildDate", expectedErr: "LABEL key buildDate is not namespaced, use a reverse-DNS key such as com.example.builddate"},
+		{key: "com.example.buildDate", expectedErr: "LABEL key com.example.buildDate is not a valid reverse-DNS key, use dot-separated lowercase letters, digits and hyphens"},
+		{key: "com..example", expectedErr: "LABEL key com..example is not a valid reverse-DNS key, use dot-separated lowercase letters, digits and hyphens"},
+		{key: "com.example-", expectedErr: "LABEL key com.example- is not a valid reverse-DNS key, use dot-separated lowercase letters, digits and hyphens"},
+	}
+	for _, tc := range testCases {
+		b.flags = NewBFlags()
+		assert.EqualError(t, label(b, []string{tc.key, "value"}, nil, ""), tc.expectedErr)
+	}
+
+	b.options.StrictLabelKeys = false
+	b.flags = NewBFlags()
+	assert.NoError(t, label(b, []string{"buildDate", "today"}, nil, ""))
+}
+
+func TestLabelUnset(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.runConfig.Labels = map[string]string{"maintainer": "base", "version": "1.0"}
+
+	b.flags.Args = []string{"--unset"}
+	require.NoError(t, label(b, []string{"maintainer", "", "vendor", ""}, nil, ""))
+	assert.Equal(t, map[string]string{"version": "1.0"}, b.runConfig.Labels)
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--unset"}
+	err := label(b, []string{"version=2.0", ""}, nil, "")
+	assert.EqualError(t, err, "LABEL --unset takes the names of the labels to remove, not a value: version=2.0")
+}
+
 func newBuilderWithMockBackend() *Builder {
 	b := &Builder{
-		flags:     &BFlags{},
-		runConfig: &container.Config{},
-		options:   &types.ImageBuildOptions{},
-		docker:    &MockBackend{},
-		buildArgs: newBuildArgs(make(map[string]*string)),
+		flags:         NewBFlags(),
+		runConfig:     &container.Config{},
+		options:       &types.ImageBuildOptions{},
+		docker:        &MockBackend{},
+		buildArgs:     newBuildArgs(make(map[string]*string)),
+		tmpContainers: map[string]struct{}{},
 	}
 	b.imageContexts = &imageContexts{b: b}
 	return b
@@ -260,6 +401,80 @@ func TestFromWithUndefinedArg(t *testing.T) {
 	assert.Equal(t, expected, b.image)
 }
 
+func TestImageResolver(t *testing.T) {
+	var lookedUp []string
+	b := newBuilderWithMockBackend()
+	b.docker.(*MockBackend).getImageOnBuildFunc = func(name string) (builder.Image, error) {
+		lookedUp = append(lookedUp, name)
+		return &mockImage{id: "theid"}, nil
+	}
+	b.options.ImageResolver = func(ref string) string {
+		return "registry.internal/" + ref
+	}
+
+	require.NoError(t, from(b, []string{"alpine", "AS", "build"}, nil, ""))
+
+	// stage names are not references, they are never resolved
+	b.flags = NewBFlags()
+	require.NoError(t, from(b, []string{"build"}, nil, ""))
+
+	_, err := b.imageContexts.get("busybox")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"registry.internal/alpine", "registry.internal/busybox"}, lookedUp)
+}
+
+func TestCopyFromVerifiesDigest(t *testing.T) {
+	const (
+		pinned = "sha256:1072e499f3f655a032e88542330cf75b02e7bdf673278f701d7ba61629ee3ebe"
+		other  = "sha256:6d3f1e6ef5a8b39d7e5cd3d7ff34cf6c4a5e5ec5e4cd1f9b8d77d6d4e1b0d4a2"
+	)
+	var repoDigests []digest.Digest
+	b := newBuilderWithMockBackend()
+	b.docker.(*MockBackend).getImageOnBuildFunc = func(name string) (builder.Image, error) {
+		return &mockImage{id: "theid", repoDigests: repoDigests}, nil
+	}
+
+	repoDigests = []digest.Digest{other, pinned}
+	_, err := b.imageContexts.get("alpine@" + pinned)
+	assert.NoError(t, err)
+
+	repoDigests = []digest.Digest{other}
+	_, err = b.imageContexts.get("alpine@" + pinned)
+	assert.EqualError(t, err, "invalid from flag value alpine@"+pinned+": image alpine@"+pinned+" resolved to theid, which does not match its digest")
+
+	// references by tag are not verified
+	_, err = b.imageContexts.get("alpine:3.6")
+	assert.NoError(t, err)
+}
+
+func TestFromRequireDigestBase(t *testing.T) {
+	const digested = "alpine@sha256:1072e499f3f655a032e88542330cf75b02e7bdf673278f701d7ba61629ee3ebe"
+
+	b := newBuilderWithMockBackend()
+	b.options.RequireDigestBase = true
+
+	assert.NoError(t, from(b, []string{digested, "AS", "base"}, nil, ""))
+
+	b.flags = NewBFlags()
+	assert.NoError(t, from(b, []string{"base"}, nil, ""))
+
+	for _, name := range []string{"alpine", "alpine:3.6", "alpine:3.6@sha256:1072e499f3f655a032e88542330cf75b02e7bdf673278f701d7ba61629ee3ebe"} {
+		b.flags = NewBFlags()
+		err := from(b, []string{name}, nil, "")
+		assert.EqualError(t, err, "base image "+name+" must be referenced by digest only, as in name@sha256:<digest>")
+	}
+}
+
+func TestFromDuplicateStageName(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	assert.NoError(t, from(b, []string{"busybox", "AS", "build"}, nil, ""))
+
+	b.flags = NewBFlags()
+	err := from(b, []string{"alpine", "AS", "build"}, nil, "")
+	assert.EqualError(t, err, "duplicate build stage name: build")
+}
+
 func TestOnbuildIllegalTriggers(t *testing.T) {
 	triggers := []struct{ command, expectedError string }{
 		{"ONBUILD", "Chaining ONBUILD via `ONBUILD ONBUILD` isn't allowed"},
@@ -282,7 +497,7 @@ func TestOnbuildIllegalTriggers(t *testing.T) {
 }
 
 func TestOnbuild(t *testing.T) {
-	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
+	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, options: &types.ImageBuildOptions{}, disableCommit: true}
 
 	err := onbuild(b, []string{"ADD", ".", "/app/src"}, nil, "ONBUILD ADD . /app/src")
 
@@ -297,6 +512,29 @@ func TestOnbuild(t *testing.T) {
 	}
 }
 
+func TestOnbuildMaxTriggers(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.options.MaxOnBuildTriggers = 2
+
+	for i := 0; i < 2; i++ {
+		b.flags = NewBFlags()
+		require.NoError(t, onbuild(b, []string{"RUN", "make"}, nil, "ONBUILD RUN make"))
+	}
+	b.flags = NewBFlags()
+	err := onbuild(b, []string{"RUN", "make"}, nil, "ONBUILD RUN make")
+	assert.EqualError(t, err, "image already has 2 ONBUILD triggers, the maximum is 2")
+
+	b.docker.(*MockBackend).getImageOnBuildFunc = func(name string) (builder.Image, error) {
+		config := &container.Config{OnBuild: []string{"RUN a", "RUN b", "RUN c"}}
+		return &mockImage{id: "theid", config: config}, nil
+	}
+	b.Stderr = ioutil.Discard
+	b.flags = NewBFlags()
+	err = from(b, []string{"base"}, nil, "")
+	assert.EqualError(t, err, "base image has 3 ONBUILD triggers, the maximum is 2")
+}
+
 func TestWorkdir(t *testing.T) {
 	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
 
@@ -318,6 +556,23 @@ func TestWorkdir(t *testing.T) {
 
 }
 
+func TestWorkdirRelativeOnScratch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows does not support FROM scratch")
+	}
+	stderr := new(bytes.Buffer)
+	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true, noBaseImage: true, Stderr: stderr}
+
+	assert.NoError(t, workdir(b, []string{"app"}, nil, ""))
+	assert.Equal(t, "/app", b.runConfig.WorkingDir)
+	assert.Contains(t, stderr.String(), "WORKDIR app is relative")
+
+	stderr.Reset()
+	assert.NoError(t, workdir(b, []string{"src"}, nil, ""))
+	assert.Equal(t, "/app/src", b.runConfig.WorkingDir)
+	assert.Empty(t, stderr.String())
+}
+
 func TestCmd(t *testing.T) {
 	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
 
@@ -346,6 +601,23 @@ func TestCmd(t *testing.T) {
 	}
 }
 
+func TestCmdDefaultShells(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.options.DefaultShells = map[string][]string{
+		runtime.GOOS: {"bash", "-euo", "pipefail", "-c"},
+		"plan9":      {"rc", "-c"},
+	}
+
+	require.NoError(t, cmd(b, []string{"./executable"}, nil, ""))
+	assert.Equal(t, strslice.StrSlice{"bash", "-euo", "pipefail", "-c", "./executable"}, b.runConfig.Cmd)
+
+	b.flags = NewBFlags()
+	b.runConfig.Shell = strslice.StrSlice{"/bin/ash", "-c"}
+	require.NoError(t, cmd(b, []string{"./executable"}, nil, ""))
+	assert.Equal(t, strslice.StrSlice{"/bin/ash", "-c", "./executable"}, b.runConfig.Cmd)
+}
+
 func compareStrSlice(slice1, slice2 strslice.StrSlice) bool {
 	if len(slice1) != len(slice2) {
 		return false
@@ -360,6 +632,28 @@ func compareStrSlice(slice1, slice2 strslice.StrSlice) bool {
 	return true
 }
 
+func TestCmdInheritedEntrypoint(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.Stdout = stdout
+	b.runConfig.Entrypoint = strslice.StrSlice{"/docker-entrypoint.sh"}
+	attrs := map[string]bool{"json": true}
+
+	require.NoError(t, cmd(b, []string{"nginx"}, attrs, ""))
+	assert.Empty(t, stdout.String())
+
+	b.options.WarnInheritedEntrypoint = true
+	require.NoError(t, cmd(b, []string{"nginx", "-g", "daemon off;"}, attrs, ""))
+	assert.Equal(t, "[Warning] CMD [\"nginx\" \"-g\" \"daemon off;\"] is passed as arguments to the ENTRYPOINT [\"/docker-entrypoint.sh\"] inherited from the base image, the container runs [\"/docker-entrypoint.sh\" \"nginx\" \"-g\" \"daemon off;\"]\n", stdout.String())
+	assert.Equal(t, strslice.StrSlice{"/docker-entrypoint.sh"}, b.runConfig.Entrypoint)
+
+	stdout.Reset()
+	require.NoError(t, entrypoint(b, []string{"/app"}, attrs, ""))
+	require.NoError(t, cmd(b, []string{"--serve"}, attrs, ""))
+	assert.Empty(t, stdout.String())
+}
+
 func TestHealthcheckNone(t *testing.T) {
 	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
 
@@ -396,6 +690,86 @@ func TestHealthcheckCmd(t *testing.T) {
 	}
 }
 
+func TestHealthcheckBlankCmd(t *testing.T) {
+	testCases := []struct {
+		dockerfile  string
+		expectedErr string
+	}{
+		{dockerfile: `HEALTHCHECK CMD [" "]`, expectedErr: "Missing command after HEALTHCHECK CMD, the executable of the exec form is blank"},
+		{dockerfile: `HEALTHCHECK CMD ["\t", "--check"]`, expectedErr: "Missing command after HEALTHCHECK CMD, the executable of the exec form is blank"},
+		{dockerfile: `HEALTHCHECK CMD []`, expectedErr: "Missing command after HEALTHCHECK CMD"},
+		{dockerfile: `HEALTHCHECK CMD ["check-health", ""]`},
+		{dockerfile: `HEALTHCHECK CMD check-health`},
+	}
+	for _, tc := range testCases {
+		result, err := parser.Parse(strings.NewReader(tc.dockerfile))
+		require.NoError(t, err)
+
+		b := &Builder{flags: NewBFlags(), runConfig: &container.Config{}, Stdout: ioutil.Discard, disableCommit: true, options: &types.ImageBuildOptions{}, buildArgs: newBuildArgs(nil)}
+		err = b.dispatch(0, 1, result.AST.Children[0])
+		if tc.expectedErr == "" {
+			assert.NoError(t, err, tc.dockerfile)
+		} else {
+			assert.EqualError(t, err, tc.expectedErr, tc.dockerfile)
+		}
+	}
+
+	// the shell form as the dispatcher receives it from the parser
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{}, disableCommit: true}
+	err := healthcheck(b, []string{"CMD", " ", "\t"}, nil, "")
+	assert.EqualError(t, err, "Missing command after HEALTHCHECK CMD, the command is blank")
+	assert.Nil(t, b.runConfig.Healthcheck)
+}
+
+func TestHealthcheckExitSuccess(t *testing.T) {
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{}, Stdout: ioutil.Discard, disableCommit: true}
+	b.flags.Args = []string{"--exit-success=0, 2"}
+
+	require.NoError(t, healthcheck(b, []string{"CMD", "check-health"}, nil, ""))
+	assert.Equal(t, []int{0, 2}, b.runConfig.Healthcheck.SuccessExitCodes)
+
+	b.flags = NewBFlags()
+	require.NoError(t, healthcheck(b, []string{"CMD", "check-health"}, nil, ""))
+	assert.Empty(t, b.runConfig.Healthcheck.SuccessExitCodes)
+
+	for _, value := range []string{"", "0,ok", "256", "-1"} {
+		b.flags = NewBFlags()
+		b.flags.Args = []string{"--exit-success=" + value}
+		err := healthcheck(b, []string{"CMD", "check-health"}, nil, "")
+		assert.EqualError(t, err, fmt.Sprintf("--exit-success must be a comma separated list of exit codes between 0 and 255 (not %q)", value))
+	}
+}
+
+func TestHealthcheckUpdateInherited(t *testing.T) {
+	inherited := &container.HealthConfig{
+		Test:     strslice.StrSlice{"CMD-SHELL", "curl -f http://localhost/"},
+		Interval: 30 * time.Second,
+		Timeout:  5 * time.Second,
+		Retries:  3,
+	}
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{Healthcheck: inherited}, disableCommit: true}
+	b.flags.Args = []string{"--interval=10s", "--retries=5"}
+
+	assert.NoError(t, healthcheck(b, []string{}, nil, ""))
+
+	expected := &container.HealthConfig{
+		Test:     inherited.Test,
+		Interval: 10 * time.Second,
+		Timeout:  5 * time.Second,
+		Retries:  5,
+	}
+	assert.Equal(t, expected, b.runConfig.Healthcheck)
+	assert.Equal(t, 30*time.Second, inherited.Interval)
+}
+
+func TestHealthcheckUpdateWithoutInherited(t *testing.T) {
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{}, disableCommit: true}
+	b.flags.Args = []string{"--interval=10s"}
+
+	err := healthcheck(b, []string{}, nil, "")
+	assert.EqualError(t, err, "HEALTHCHECK without a command requires a healthcheck inherited from the base image")
+}
+
 func TestEntrypoint(t *testing.T) {
 	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
 
@@ -423,7 +797,7 @@ func TestEntrypoint(t *testing.T) {
 }
 
 func TestExpose(t *testing.T) {
-	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
+	b := &Builder{flags: &BFlags{flags: make(map[string]*Flag)}, runConfig: &container.Config{}, disableCommit: true}
 
 	exposedPort := "80"
 
@@ -450,8 +824,74 @@ func TestExpose(t *testing.T) {
 	}
 }
 
+func TestExposeDefaultProtocol(t *testing.T) {
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{}, disableCommit: true}
+	b.flags.Args = []string{"--protocol=udp"}
+
+	err := expose(b, []string{"53", "80/tcp", "5000-5001"}, nil, "")
+	assert.NoError(t, err)
+
+	expected := nat.PortSet{
+		"53/udp":   {},
+		"80/tcp":   {},
+		"5000/udp": {},
+		"5001/udp": {},
+	}
+	assert.Equal(t, expected, b.runConfig.ExposedPorts)
+}
+
+func TestExposeInvalidProtocol(t *testing.T) {
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{}, disableCommit: true}
+	b.flags.Args = []string{"--protocol=icmp"}
+
+	err := expose(b, []string{"80"}, nil, "")
+	assert.EqualError(t, err, `Invalid protocol "icmp" for EXPOSE, must be one of tcp, udp or sctp`)
+}
+
+func TestExposeMixedProtocols(t *testing.T) {
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{}, disableCommit: true}
+
+	err := expose(b, []string{"80", "53/udp", "9000/sctp", "9001-9002/SCTP"}, nil, "")
+	assert.NoError(t, err)
+
+	expected := nat.PortSet{
+		"80/tcp":    {},
+		"53/udp":    {},
+		"9000/sctp": {},
+		"9001/sctp": {},
+		"9002/sctp": {},
+	}
+	assert.Equal(t, expected, b.runConfig.ExposedPorts)
+}
+
+func TestExposeUnknownPortProtocol(t *testing.T) {
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{}, disableCommit: true}
+
+	err := expose(b, []string{"80/tcp", "9000/dccp"}, nil, "")
+	assert.EqualError(t, err, `Invalid protocol "dccp" for EXPOSE 9000, must be one of tcp, udp or sctp`)
+}
+
+func TestExposeDuplicates(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{}, disableCommit: true, Stdout: stdout}
+
+	require.NoError(t, expose(b, []string{"80", "443"}, nil, ""))
+	assert.Empty(t, stdout.String())
+
+	b.flags = NewBFlags()
+	require.NoError(t, expose(b, []string{"443", "53/udp", "80"}, nil, ""))
+	assert.Equal(t, "[Warning] EXPOSE 443/tcp, 80/tcp: already exposed by the image, the duplicates can be removed\n", stdout.String())
+
+	expected := nat.PortSet{
+		"80/tcp":  {},
+		"443/tcp": {},
+		"53/udp":  {},
+	}
+	assert.Equal(t, expected, b.runConfig.ExposedPorts)
+}
+
 func TestUser(t *testing.T) {
-	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
+	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true, options: &types.ImageBuildOptions{}}
 
 	userCommand := "foo"
 
@@ -500,6 +940,23 @@ func TestStopSignal(t *testing.T) {
 	}
 }
 
+func TestStopSignalList(t *testing.T) {
+	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
+
+	require.NoError(t, stopSignal(b, []string{"SIGTERM, SIGINT,9"}, nil, ""))
+	assert.Equal(t, "SIGTERM", b.runConfig.StopSignal)
+	assert.Equal(t, map[string]string{signal.StopSignalsLabel: "SIGINT,9"}, b.runConfig.Labels)
+	assert.Equal(t, uint64(syscall.SIGTERM), b.stopSignal())
+
+	assert.EqualError(t, stopSignal(b, []string{"SIGTERM,SIGFOO"}, nil, ""), "Invalid signal: SIGFOO")
+	assert.EqualError(t, stopSignal(b, []string{"SIGTERM,"}, nil, ""), "Invalid signal: ")
+	assert.Equal(t, "SIGTERM", b.runConfig.StopSignal)
+
+	require.NoError(t, stopSignal(b, []string{"SIGQUIT"}, nil, ""))
+	assert.Equal(t, "SIGQUIT", b.runConfig.StopSignal)
+	assert.Empty(t, b.runConfig.Labels)
+}
+
 func TestArg(t *testing.T) {
 	b := newBuilderWithMockBackend()
 
@@ -515,6 +972,195 @@ func TestArg(t *testing.T) {
 	assert.Equal(t, expected, allowed)
 }
 
+func TestArgDefaultExpansion(t *testing.T) {
+	b := newBuilderWithMockBackend()
+
+	assert.NoError(t, arg(b, []string{"VERSION=1.0"}, nil, ""))
+	b.flags = NewBFlags()
+	assert.NoError(t, arg(b, []string{"TAG=app-${VERSION}"}, nil, ""))
+	b.flags = NewBFlags()
+	assert.NoError(t, arg(b, []string{"${VERSION}=unexpanded"}, nil, ""))
+
+	expected := map[string]string{"VERSION": "1.0", "TAG": "app-1.0", "${VERSION}": "unexpanded"}
+	assert.Equal(t, expected, b.buildArgs.GetAllMeta())
+
+	b.buildArgs.argsFromOptions["VERSION"] = strPtr("2.0")
+	b.flags = NewBFlags()
+	assert.NoError(t, arg(b, []string{"OTHER=app-$VERSION"}, nil, ""))
+	assert.Equal(t, "app-2.0", b.buildArgs.GetAllMeta()["OTHER"])
+}
+
+func TestSecret(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.options.Secrets = map[string][]byte{"npmrc": []byte("token")}
+
+	assert.NoError(t, secret(b, []string{"id=npmrc"}, nil, ""))
+	assert.Equal(t, map[string]struct{}{"npmrc": {}}, b.secrets)
+
+	b.flags = NewBFlags()
+	err := secret(b, []string{"id=aws"}, nil, "")
+	assert.EqualError(t, err, "secret aws is required but was not provided")
+
+	b.flags = NewBFlags()
+	err = secret(b, []string{"npmrc"}, nil, "")
+	assert.EqualError(t, err, "SECRET requires an argument of the form id=<id>, got npmrc")
+}
+
+func TestArgAllowAll(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	stdout := &bytes.Buffer{}
+	b.Stdout = stdout
+	b.options.BuildArgs = map[string]*string{"CI_COMMIT": strPtr("abc123")}
+	b.buildArgs = newBuildArgs(b.options.BuildArgs)
+
+	err := arg(b, []string{"*"}, nil, "")
+	assert.EqualError(t, err, "ARG * is only allowed after FROM")
+
+	b.disableCommit = true
+	b.image = "baseimage"
+	b.flags = NewBFlags()
+	assert.NoError(t, arg(b, []string{"*"}, nil, ""))
+	assert.Equal(t, map[string]string{"CI_COMMIT": "abc123"}, b.buildArgs.GetAllAllowed())
+	assert.Contains(t, stdout.String(), "[Warning] ARG * passes every build arg")
+}
+
+func TestArgAllowPrefix(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.Stdout = ioutil.Discard
+	b.options.BuildArgs = map[string]*string{
+		"BUILD_NUMBER": strPtr("42"),
+		"CI_COMMIT":    strPtr("abc123"),
+	}
+	b.buildArgs = newBuildArgs(b.options.BuildArgs)
+
+	err := arg(b, []string{"BUILD_*"}, nil, "")
+	assert.EqualError(t, err, "ARG BUILD_* is only allowed after FROM")
+
+	b.disableCommit = true
+	b.image = "baseimage"
+	b.flags = NewBFlags()
+	err = arg(b, []string{"BUILD_*_ID*"}, nil, "")
+	assert.EqualError(t, err, "ARG BUILD_*_ID* is not a valid prefix, only a trailing * is allowed")
+
+	b.flags = NewBFlags()
+	require.NoError(t, arg(b, []string{"BUILD_*"}, nil, ""))
+	assert.Equal(t, map[string]string{"BUILD_NUMBER": "42"}, b.buildArgs.GetAllAllowed())
+}
+
+func TestArgRequired(t *testing.T) {
+	testCases := []struct {
+		name      string
+		arg       string
+		buildArgs map[string]*string
+		global    bool
+		err       string
+	}{
+		{name: "provided", arg: "VERSION", buildArgs: map[string]*string{"VERSION": strPtr("1.0")}},
+		{name: "provided empty", arg: "VERSION", buildArgs: map[string]*string{"VERSION": strPtr("")}},
+		{name: "default", arg: "VERSION=1.0"},
+		{name: "global", arg: "VERSION", global: true, err: "ARG VERSION is required, set it with --build-arg VERSION=<value>"},
+		{name: "missing", arg: "VERSION", err: "ARG VERSION is required, set it with --build-arg VERSION=<value>"},
+		{name: "without value", arg: "VERSION", buildArgs: map[string]*string{"VERSION": nil}, err: "ARG VERSION is required, set it with --build-arg VERSION=<value>"},
+		{name: "all", arg: "*", err: "ARG --required can't be used with *, declare the required args by name"},
+	}
+	for _, testCase := range testCases {
+		b := newBuilderWithMockBackend()
+		b.disableCommit = true
+		b.Stdout = ioutil.Discard
+		b.buildArgs = newBuildArgs(testCase.buildArgs)
+		if !testCase.global {
+			b.image = "baseimage"
+		}
+		b.flags.Args = []string{"--required"}
+
+		err := arg(b, []string{testCase.arg}, nil, "")
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err, testCase.name)
+			continue
+		}
+		assert.NoError(t, err, testCase.name)
+		assert.True(t, b.DeclaredArgs()[0].Required, testCase.name)
+	}
+}
+
+func TestArgRequiredFromGlobal(t *testing.T) {
+	result, err := parser.Parse(strings.NewReader("ARG VERSION=1.0\nFROM busybox\nARG --required VERSION\nARG --required TARGET\n"))
+	require.NoError(t, err)
+
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	n := result.AST
+	for i, child := range n.Children[:3] {
+		require.NoError(t, b.dispatch(i, len(n.Children), child))
+	}
+	err = b.dispatch(3, len(n.Children), n.Children[3])
+	assert.EqualError(t, err, "ARG TARGET is required, set it with --build-arg TARGET=<value>")
+
+	b.options.ValidateOnly = true
+	assert.NoError(t, b.dispatch(3, len(n.Children), n.Children[3]))
+}
+
+func TestFromBuildArgPrefixes(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.Stdout = ioutil.Discard
+	b.options.BuildArgs = map[string]*string{
+		"BUILD_NUMBER": strPtr("42"),
+		"CI_COMMIT":    strPtr("abc123"),
+	}
+	b.options.BuildArgPrefixes = []string{"CI_"}
+	b.buildArgs = newBuildArgs(b.options.BuildArgs)
+
+	require.NoError(t, from(b, []string{"scratch"}, nil, ""))
+	assert.Equal(t, map[string]string{"CI_COMMIT": "abc123"}, b.buildArgs.GetAllAllowed())
+}
+
+func TestPullRetries(t *testing.T) {
+	output := &bytes.Buffer{}
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.Output = output
+	b.options.PullParent = true
+	b.options.PullAttempts = 3
+	b.options.PullRetryDelay = time.Millisecond
+
+	var pulls int
+	networkErr := &url.Error{Op: "Get", URL: "https://registry.example.com/v2/", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNRESET}}
+	b.docker.(*MockBackend).pullOnBuildFunc = func(name string) (builder.Image, error) {
+		pulls++
+		if pulls < 3 {
+			return nil, networkErr
+		}
+		return &mockImage{id: "theid"}, nil
+	}
+
+	image, err := pullOrGetImage(b, "busybox")
+	require.NoError(t, err)
+	assert.Equal(t, "theid", image.ImageID())
+	assert.Equal(t, 3, pulls)
+	assert.Equal(t, "Pulling busybox failed, retrying in 1ms (attempt 2 of 3): "+networkErr.Error()+"\n"+
+		"Pulling busybox failed, retrying in 2ms (attempt 3 of 3): "+networkErr.Error()+"\n", output.String())
+
+	pulls = 0
+	b.docker.(*MockBackend).pullOnBuildFunc = func(name string) (builder.Image, error) {
+		pulls++
+		return nil, networkErr
+	}
+	_, err = pullOrGetImage(b, "busybox")
+	assert.Equal(t, networkErr, err)
+	assert.Equal(t, 3, pulls)
+
+	pulls = 0
+	b.docker.(*MockBackend).pullOnBuildFunc = func(name string) (builder.Image, error) {
+		pulls++
+		return nil, fmt.Errorf("repository busybox not found")
+	}
+	_, err = pullOrGetImage(b, "busybox")
+	assert.EqualError(t, err, "repository busybox not found")
+	assert.Equal(t, 1, pulls)
+}
+
 func TestShell(t *testing.T) {
 	b := &Builder{flags: &BFlags{}, runConfig: &container.Config{}, disableCommit: true}
 
@@ -537,3 +1183,311 @@ func TestShell(t *testing.T) {
 		t.Fatalf("Shell should be set to %s, got %s", expectedShell, b.runConfig.Shell)
 	}
 }
+
+func TestShellPlatformMismatch(t *testing.T) {
+	for _, executable := range []string{"/bin/bash", "powershell", "pwsh", "sh"} {
+		assert.Equal(t, "", shellPlatformMismatch(executable, "linux"), executable)
+	}
+	for _, executable := range []string{"cmd", "cmd.exe", "powershell.EXE", `C:\tools\bash`, "c:/tools/bash", `tools\bash`} {
+		assert.Equal(t, "SHELL executable "+executable+" is a Windows executable, but the image is built for linux", shellPlatformMismatch(executable, "linux"))
+	}
+
+	for _, executable := range []string{"cmd", "powershell", `C:\tools\bash.exe`} {
+		assert.Equal(t, "", shellPlatformMismatch(executable, "windows"), executable)
+	}
+	assert.Equal(t, "SHELL executable /bin/bash is a Unix path, but the image is built for windows", shellPlatformMismatch("/bin/bash", "windows"))
+}
+
+func TestShellStrict(t *testing.T) {
+	executable := "cmd"
+	if runtime.GOOS == "windows" {
+		executable = "/bin/sh"
+	}
+	attrs := map[string]bool{"json": true}
+
+	stdout := new(bytes.Buffer)
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.Stdout = stdout
+	require.NoError(t, shell(b, []string{executable, "-c"}, attrs, ""))
+	assert.Equal(t, strslice.StrSlice{executable, "-c"}, b.runConfig.Shell)
+	assert.Equal(t, "[Warning] "+shellPlatformMismatch(executable, runtime.GOOS)+"\n", stdout.String())
+
+	b.options.StrictShell = true
+	b.flags = NewBFlags()
+	err := shell(b, []string{executable, "-c"}, attrs, "")
+	assert.EqualError(t, err, shellPlatformMismatch(executable, runtime.GOOS))
+}
+
+func TestRunNetwork(t *testing.T) {
+	var hostConfig *container.HostConfig
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.image = "baseimage"
+	b.Stdout = ioutil.Discard
+	b.options.NetworkMode = "bridge"
+	b.docker.(*MockBackend).containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		hostConfig = config.HostConfig
+		return container.ContainerCreateCreatedBody{ID: "container"}, nil
+	}
+
+	b.flags = NewBFlags()
+	assert.NoError(t, run(b, []string{"echo hi"}, nil, ""))
+	assert.Equal(t, container.NetworkMode("bridge"), hostConfig.NetworkMode)
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--network=none"}
+	assert.NoError(t, run(b, []string{"echo hi"}, nil, ""))
+	assert.Equal(t, container.NetworkMode("none"), hostConfig.NetworkMode)
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--network=bridge"}
+	err := run(b, []string{"echo hi"}, nil, "")
+	assert.EqualError(t, err, `Invalid network "bridge" for RUN, must be one of none, default or host`)
+}
+
+func TestRunSecurity(t *testing.T) {
+	var hostConfig *container.HostConfig
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.image = "baseimage"
+	b.Stdout = ioutil.Discard
+	b.imageCache = cache
+	b.docker.(*MockBackend).containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		hostConfig = config.HostConfig
+		return container.ContainerCreateCreatedBody{ID: "container"}, nil
+	}
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--security=insecure"}
+	err := run(b, []string{"echo hi"}, nil, "")
+	assert.EqualError(t, err, "RUN --security=insecure is not allowed, the builder must be started with insecure RUN instructions allowed")
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--security=unconfined"}
+	err = run(b, []string{"echo hi"}, nil, "")
+	assert.EqualError(t, err, `Invalid security mode "unconfined" for RUN, must be one of sandbox or insecure`)
+
+	b.options.AllowInsecureRun = true
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--security=sandbox"}
+	require.NoError(t, run(b, []string{"echo hi"}, nil, ""))
+	assert.False(t, hostConfig.Privileged)
+
+	b.cacheBusted = false
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--security=insecure"}
+	require.NoError(t, run(b, []string{"echo hi"}, nil, ""))
+	assert.True(t, hostConfig.Privileged)
+
+	assert.Contains(t, cache.keys, "baseimage /bin/sh -c echo hi")
+	assert.Contains(t, cache.keys, "baseimage |security=insecure /bin/sh -c echo hi")
+}
+
+func TestRunCacheFromFiles(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "package.json", `{"name": "app"}`, 0644)
+	createTestTempFile(t, contextDir, "package-lock.json", `{"lockfileVersion": 1}`, 0644)
+	createTestTempFile(t, contextDir, "README.md", "app", 0644)
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	b.context = buildContext
+	b.imageCache = cache
+	b.imageContexts.add("")
+
+	runCached := func(files string) (bool, error) {
+		// every run is a new build on the same base image
+		b.image = "baseimage"
+		b.cacheBusted = false
+		b.cacheHit = false
+		b.flags = NewBFlags()
+		b.flags.Args = []string{"--cache-from-files=" + files}
+		err := run(b, []string{"npm install"}, nil, "")
+		return b.cacheHit, err
+	}
+
+	hit, err := runCached("package.json,package-lock.json")
+	require.NoError(t, err)
+	assert.False(t, hit)
+
+	createTestTempFile(t, contextDir, "README.md", "updated app", 0644)
+	hit, err = runCached("package.json,package-lock.json")
+	require.NoError(t, err)
+	assert.True(t, hit)
+
+	createTestTempFile(t, contextDir, "package-lock.json", `{"lockfileVersion": 2}`, 0644)
+	hit, err = runCached("package.json,package-lock.json")
+	require.NoError(t, err)
+	assert.False(t, hit)
+
+	_, err = runCached("package.json,yarn.lock")
+	assert.EqualError(t, err, "failed to read --cache-from-files: yarn.lock not found in build context")
+}
+
+func TestRunTTY(t *testing.T) {
+	var config *container.Config
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.image = "baseimage"
+	b.Stdout = ioutil.Discard
+	b.docker.(*MockBackend).containerCreateFunc = func(createConfig types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		c := *createConfig.Config
+		config = &c
+		return container.ContainerCreateCreatedBody{ID: "container"}, nil
+	}
+
+	b.flags.Args = []string{"--tty"}
+	assert.NoError(t, run(b, []string{"./install.sh"}, nil, ""))
+	assert.True(t, config.Tty)
+	assert.False(t, b.runConfig.Tty)
+
+	b.flags = NewBFlags()
+	assert.NoError(t, run(b, []string{"./install.sh"}, nil, ""))
+	assert.False(t, config.Tty)
+}
+
+func TestRunHeredoc(t *testing.T) {
+	var config *container.Config
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.image = "baseimage"
+	b.Stdout = ioutil.Discard
+	b.docker.(*MockBackend).containerCreateFunc = func(createConfig types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		c := *createConfig.Config
+		config = &c
+		return container.ContainerCreateCreatedBody{ID: "container"}, nil
+	}
+
+	b.heredocs = []parser.Heredoc{{Name: "EOF", Content: "\techo hello\n\techo world\n", Chomp: true}}
+	require.NoError(t, run(b, []string{"<<-EOF"}, nil, ""))
+	assert.Equal(t, strslice.StrSlice{"/bin/sh", "-c", "echo hello\necho world\n"}, config.Cmd)
+
+	b.cacheBusted = false
+	b.flags = NewBFlags()
+	b.heredocs = []parser.Heredoc{{Name: "EOF", Content: "print('hello')\n"}}
+	require.NoError(t, run(b, []string{"python3 <<EOF"}, nil, ""))
+	assert.Equal(t, strslice.StrSlice{"/bin/sh", "-c", "python3 <<EOF\nprint('hello')\nEOF\n"}, config.Cmd)
+}
+
+func TestRunOutput(t *testing.T) {
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.image = "baseimage"
+	b.Stdout = ioutil.Discard
+	b.Stderr = ioutil.Discard
+	b.imageCache = cache
+	b.docker.(*MockBackend).containerAttachRawFunc = func(cID string, stdout, stderr io.Writer) error {
+		fmt.Fprintln(stdout, "PASS")
+		fmt.Fprintln(stderr, "ok")
+		return nil
+	}
+
+	b.flags.Args = []string{"--output=logs/test.log"}
+	err := run(b, []string{"make test"}, nil, "")
+	assert.EqualError(t, err, "RUN --output is not supported by this build, its output cannot be written anywhere")
+
+	outputs := map[string]string{}
+	b.OnRunOutput = func(path string, output []byte) error {
+		outputs[path] = string(output)
+		return nil
+	}
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--output=logs/test.log"}
+	require.NoError(t, run(b, []string{"make test"}, nil, ""))
+	assert.Equal(t, map[string]string{"logs/test.log": "PASS\nok\n"}, outputs)
+	assert.Len(t, cache.keys, 1)
+	assert.Contains(t, cache.keys, "baseimage /bin/sh -c make test")
+
+	for _, path := range []string{"/var/log/test.log", "../test.log"} {
+		b.flags = NewBFlags()
+		b.flags.Args = []string{"--output=" + path}
+		err := run(b, []string{"make test"}, nil, "")
+		assert.EqualError(t, err, fmt.Sprintf("Invalid --output %q for RUN, must be a path relative to the build output", path))
+	}
+}
+
+func TestRunNoCache(t *testing.T) {
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	b.imageCache = cache
+	b.imageContexts.add("")
+
+	runCached := func(flags ...string) bool {
+		b.image = "baseimage"
+		b.cacheBusted = false
+		b.cacheHit = false
+		b.flags = NewBFlags()
+		b.flags.Args = flags
+		require.NoError(t, run(b, []string{"date > /build-time"}, nil, ""))
+		return b.cacheHit
+	}
+
+	assert.False(t, runCached())
+	assert.True(t, runCached())
+	assert.False(t, runCached("--no-cache"))
+	assert.False(t, b.cacheBusted)
+	assert.True(t, runCached())
+}
+
+func TestRunRequireExecForm(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.Stdout = ioutil.Discard
+	b.image = "baseimage"
+	b.options.RequireExecFormRun = true
+
+	err := run(b, []string{"echo hi"}, nil, "RUN echo hi")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "RUN in shell form is not allowed")
+	assert.Contains(t, err.Error(), "RUN echo hi")
+
+	b.flags = NewBFlags()
+	assert.NoError(t, run(b, []string{"echo", "hi"}, map[string]bool{"json": true}, `RUN ["echo", "hi"]`))
+}
+
+func TestPrependRunFlags(t *testing.T) {
+	cmd := strslice.StrSlice{"/bin/sh", "-c", "echo hi"}
+	assert.Equal(t, cmd, prependRunFlags(cmd, nil))
+	assert.Equal(t, strslice.StrSlice{"|network=none", "|tty", "/bin/sh", "-c", "echo hi"}, prependRunFlags(cmd, []string{"network=none", "tty"}))
+}
+
+func TestEnvFromFile(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "version", "1.2.3\n", 0644)
+
+	context, err := remotecontext.NewLazyContext(contextDir)
+	assert.NoError(t, err)
+
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = context
+	b.flags.Args = []string{"--file"}
+
+	assert.NoError(t, env(b, []string{"VERSION", "version"}, nil, ""))
+	assert.Equal(t, []string{"VERSION=1.2.3"}, b.runConfig.Env)
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--file"}
+	err = env(b, []string{"MISSING", "missing"}, nil, "")
+	assert.EqualError(t, err, "failed to read value of MISSING: missing not found in build context")
+}
@@ -3,7 +3,14 @@
 package dockerfile
 
 import (
+	"io/ioutil"
 	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 func TestNormaliseWorkdir(t *testing.T) {
@@ -31,3 +38,52 @@ func TestNormaliseWorkdir(t *testing.T) {
 		}
 	}
 }
+
+func TestRunWorkdir(t *testing.T) {
+	var workingDir string
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.image = "baseimage"
+	b.Stdout = ioutil.Discard
+	b.runConfig.WorkingDir = "/app"
+	b.docker.(*MockBackend).containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		workingDir = config.Config.WorkingDir
+		return container.ContainerCreateCreatedBody{ID: "container"}, nil
+	}
+
+	b.flags.Args = []string{"--workdir=frontend"}
+	assert.NoError(t, run(b, []string{"npm install"}, nil, ""))
+	assert.Equal(t, "/app/frontend", workingDir)
+	assert.Equal(t, "/app", b.runConfig.WorkingDir)
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--workdir=/src"}
+	assert.NoError(t, run(b, []string{"make"}, nil, ""))
+	assert.Equal(t, "/src", workingDir)
+
+	b.flags = NewBFlags()
+	assert.NoError(t, run(b, []string{"make"}, nil, ""))
+	assert.Equal(t, "/app", workingDir)
+}
+
+func TestWorkdirPop(t *testing.T) {
+	b := &Builder{flags: NewBFlags(), runConfig: &container.Config{WorkingDir: "/"}, disableCommit: true}
+	workdirs := func(args ...string) {
+		for _, arg := range args {
+			b.flags = NewBFlags()
+			require.NoError(t, workdir(b, []string{arg}, nil, ""))
+		}
+	}
+
+	workdirs("/src", "app", "-")
+	assert.Equal(t, "/src", b.runConfig.WorkingDir)
+
+	workdirs("/tmp", "-", "-")
+	assert.Equal(t, "/", b.runConfig.WorkingDir)
+
+	b.flags = NewBFlags()
+	err := workdir(b, []string{"-"}, nil, "")
+	assert.EqualError(t, err, "WORKDIR - requires a previous WORKDIR in the build stage to go back from")
+	assert.Equal(t, "/", b.runConfig.WorkingDir)
+}
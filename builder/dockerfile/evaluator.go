@@ -21,6 +21,7 @@ package dockerfile
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/docker/docker/builder/dockerfile/command"
@@ -32,7 +33,6 @@ import (
 // Environment variable interpolation will happen on these statements only.
 var replaceEnvAllowed = map[string]bool{
 	command.Env:        true,
-	command.Label:      true,
 	command.Add:        true,
 	command.Copy:       true,
 	command.Workdir:    true,
@@ -40,7 +40,6 @@ var replaceEnvAllowed = map[string]bool{
 	command.Volume:     true,
 	command.User:       true,
 	command.StopSignal: true,
-	command.Arg:        true,
 }
 
 // Certain commands are allowed to have their args split into more
@@ -56,6 +55,20 @@ var allowWordExpansion = map[string]bool{
 	command.Expose: true,
 }
 
+// The instructions which add a layer to the image, even when it is empty.
+var layerCommands = map[string]bool{
+	command.Add:     true,
+	command.Copy:    true,
+	command.Run:     true,
+	command.Workdir: true,
+}
+
+// flaglessCommands are the instructions which take no flags, and ignore them
+// unless the flags are strict.
+var flaglessCommands = map[string]bool{
+	command.StopSignal: true,
+}
+
 var evaluateTable map[string]func(*Builder, []string, map[string]bool, string) error
 
 func init() {
@@ -73,6 +86,7 @@ func init() {
 		command.Maintainer:  maintainer,
 		command.Onbuild:     onbuild,
 		command.Run:         run,
+		command.Secret:      secret,
 		command.Shell:       shell,
 		command.StopSignal:  stopSignal,
 		command.User:        user,
@@ -108,6 +122,7 @@ func (b *Builder) dispatch(stepN int, stepTotal int, ast *parser.Node) error {
 	attrs := ast.Attributes
 	original := ast.Original
 	flags := ast.Flags
+	heredocs := ast.Heredocs
 	strList := []string{}
 	msg := fmt.Sprintf("Step %d/%d : %s", stepN+1, stepTotal, upperCasedCmd)
 
@@ -120,6 +135,8 @@ func (b *Builder) dispatch(stepN int, stepTotal int, ast *parser.Node) error {
 			return errors.New("ONBUILD requires at least one argument")
 		}
 		ast = ast.Next.Children[0]
+		// the attributes of the trigger, such as whether it is in JSON form
+		attrs = ast.Attributes
 		strList = append(strList, ast.Value)
 		msg += " " + ast.Value
 
@@ -146,17 +163,50 @@ func (b *Builder) dispatch(stepN int, stepTotal int, ast *parser.Node) error {
 	msg += " " + strings.Join(msgList, " ")
 	fmt.Fprintln(b.Stdout, msg)
 
+	if cmd != command.Arg && cmd != command.From {
+		b.warnOnUndeclaredArgs(upperCasedCmd, msgList)
+	}
+	b.markUsedArgs(flags, msgList, heredocs)
+
 	// XXX yes, we skip any cmds that are not valid; the parser should have
 	// picked these out already.
 	if f, ok := evaluateTable[cmd]; ok {
 		b.flags = NewBFlags()
 		b.flags.Args = flags
-		return f(b, strList, attrs, original)
+		b.flags.Strict = b.options.StrictFlags
+		// the instructions without flags never parse them, so their flags
+		// are rejected before the instruction changes anything
+		if b.flags.Strict && flaglessCommands[cmd] {
+			if err := b.flags.Parse(); err != nil {
+				return err
+			}
+		}
+		b.heredocs = heredocs
+		b.instruction = upperCasedCmd
+		b.cacheHit = false
+		b.skipCacheOnce = false
+		b.skipped = false
+		if err := f(b, strList, attrs, original); err != nil {
+			return err
+		}
+		if layerCommands[cmd] && !b.skipped {
+			b.layerCreated = true
+		}
+		if b.OnInstruction != nil {
+			b.OnInstruction(upperCasedCmd, strList, b.cacheHit)
+		}
+		return nil
 	}
 
 	return fmt.Errorf("Unknown instruction: %s", upperCasedCmd)
 }
 
+// withDockerfileLine prefixes err with the Dockerfile line of the
+// instruction which failed.
+func withDockerfileLine(err error, node *parser.Node) error {
+	return errors.Wrapf(err, "Dockerfile:%d", node.StartLine)
+}
+
 // count the number of nodes that we are going to traverse first
 // allocation of those list a lot when they have a lot of arguments
 func initMsgList(cursor *parser.Node) []string {
@@ -183,6 +233,62 @@ func (b *Builder) evaluateEnv(cmd string, str string, envs []string) ([]string,
 	return processFunc(str, envs, b.escapeToken)
 }
 
+var argReferenceRegexp = regexp.MustCompile(`\$\{?([a-zA-Z_][a-zA-Z0-9_]*)`)
+
+// warnOnUndeclaredArgs warns when words reference an arg which was declared
+// before FROM or in another build stage, but not in the current one: args are
+// scoped to the stage declaring them, so the reference is empty. Each arg is
+// only warned about once.
+func (b *Builder) warnOnUndeclaredArgs(cmd string, words []string) {
+	for _, word := range words {
+		for _, m := range argReferenceRegexp.FindAllStringSubmatchIndex(word, -1) {
+			if m[0] > 0 && rune(word[m[0]-1]) == b.escapeToken {
+				continue
+			}
+			name := word[m[2]:m[3]]
+			if _, ok := b.undeclaredArgWarnings[name]; ok {
+				continue
+			}
+			if !b.buildArgs.IsDeclaredInOtherStage(name) {
+				continue
+			}
+			if _, ok := b.runConfigEnvMapping()[name]; ok {
+				continue
+			}
+			if b.undeclaredArgWarnings == nil {
+				b.undeclaredArgWarnings = make(map[string]struct{})
+			}
+			b.undeclaredArgWarnings[name] = struct{}{}
+			fmt.Fprintf(b.Stdout, "[Warning] %s references %s, which was declared with ARG outside of the current build stage and is not set in it, add \"ARG %s\" after FROM to use it\n", cmd, name, name)
+		}
+	}
+}
+
+// markUsedArgs records the variables which the flags, words and
+// here-documents of an instruction refer to as used, see warnOnUnusedArgs().
+// Instructions such as RUN are not expanded by the builder, their references
+// are looked for all the same.
+func (b *Builder) markUsedArgs(flags, words []string, heredocs []parser.Heredoc) {
+	texts := append(append([]string{}, flags...), words...)
+	for _, heredoc := range heredocs {
+		texts = append(texts, heredoc.Content)
+	}
+	for _, text := range texts {
+		names, err := ProcessWordReferences(text, b.escapeToken)
+		if err != nil {
+			// shell syntax the builder does not expand, such as
+			// ${FOO%.*} in a RUN command
+			names = nil
+			for _, m := range argReferenceRegexp.FindAllStringSubmatch(text, -1) {
+				names = append(names, m[1])
+			}
+		}
+		for _, name := range names {
+			b.buildArgs.MarkUsed(name)
+		}
+	}
+}
+
 // buildArgsWithoutConfigEnv returns a list of key=value pairs for all the build
 // args that are not overriden by runConfig environment variables.
 func (b *Builder) buildArgsWithoutConfigEnv() []string {
@@ -1,16 +1,29 @@
 package dockerfile
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/remotecontext"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/reexec"
+	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 type dispatchTestCase struct {
@@ -202,3 +215,670 @@ func executeTestCase(t *testing.T, testCase dispatchTestCase) {
 	}
 
 }
+
+// dispatchTestDockerfile parses dockerfile and dispatches its instructions
+// with b until one of them fails. b doesn't commit, and records the configs of
+// the containers it creates and the keys it looks up in the image cache.
+func dispatchTestDockerfile(t *testing.T, b *Builder, dockerfile string) ([]types.ContainerCreateConfig, map[string]string, error) {
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	require.NoError(t, err)
+
+	var created []types.ContainerCreateConfig
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	b.clientCtx = context.Background()
+	b.disableCommit = true
+	b.escapeToken = result.EscapeToken
+	b.imageCache = cache
+	if b.Stdout == nil {
+		b.Stdout = ioutil.Discard
+	}
+	mockBackend := b.docker.(*MockBackend)
+	containerCreate := mockBackend.containerCreateFunc
+	mockBackend.containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		// the builder goes on changing its config once the container is created
+		c := *config.Config
+		config.Config = &c
+		created = append(created, config)
+		if containerCreate != nil {
+			return containerCreate(config)
+		}
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+
+	n := result.AST
+	for i, child := range n.Children {
+		if err = b.dispatch(i, len(n.Children), child); err != nil {
+			break
+		}
+	}
+	return created, cache.keys, err
+}
+
+// constantImageCache is an image cache which always returns the same image.
+type constantImageCache string
+
+func (c constantImageCache) GetCache(parentID string, cfg *container.Config) (string, error) {
+	return string(c), nil
+}
+
+func TestOnInstruction(t *testing.T) {
+	type event struct {
+		cmd      string
+		args     []string
+		cacheHit bool
+	}
+	var events []event
+
+	b := newBuilderWithMockBackend()
+	b.Stdout = ioutil.Discard
+	b.imageCache = constantImageCache("sha256:cached")
+	b.OnInstruction = func(cmd string, args []string, cacheHit bool) {
+		events = append(events, event{cmd: cmd, args: args, cacheHit: cacheHit})
+	}
+
+	result, err := parser.Parse(strings.NewReader("FROM busybox\nWORKDIR /app\nFOO bar\n"))
+	require.NoError(t, err)
+
+	n := result.AST
+	require.NoError(t, b.dispatch(0, len(n.Children), n.Children[0]))
+	require.NoError(t, b.dispatch(1, len(n.Children), n.Children[1]))
+	assert.Error(t, b.dispatch(2, len(n.Children), n.Children[2]))
+
+	expected := []event{
+		{cmd: "FROM", args: []string{"busybox"}},
+		{cmd: "WORKDIR", args: []string{"/app"}, cacheHit: true},
+	}
+	assert.Equal(t, expected, events)
+}
+
+func TestCheckModification(t *testing.T) {
+	testCases := []struct {
+		dockerfile  string
+		expectedErr string
+	}{
+		{
+			dockerfile:  "FROM busybox\nENV APP_ENV=production\nCMD [\"./app\"]\n",
+			expectedErr: "the build did not add any layer to the base image, the Dockerfile needs at least one RUN, COPY, ADD or WORKDIR instruction",
+		},
+		{
+			dockerfile: "FROM busybox\nRUN make\n",
+		},
+		{
+			dockerfile:  "FROM busybox AS build\nRUN make\nFROM build\n",
+			expectedErr: "the build did not add any layer to the base image, the Dockerfile needs at least one RUN, COPY, ADD or WORKDIR instruction",
+		},
+		{
+			dockerfile:  "FROM busybox\nRUN --if=false make\n",
+			expectedErr: "the build did not add any layer to the base image, the Dockerfile needs at least one RUN, COPY, ADD or WORKDIR instruction",
+		},
+	}
+
+	for _, tc := range testCases {
+		b := newBuilderWithMockBackend()
+		_, _, err := dispatchTestDockerfile(t, b, tc.dockerfile)
+		require.NoError(t, err)
+
+		err = b.checkModification()
+		if tc.expectedErr == "" {
+			assert.NoError(t, err, tc.dockerfile)
+		} else {
+			assert.EqualError(t, err, tc.expectedErr)
+		}
+	}
+}
+
+func TestWithDockerfileLine(t *testing.T) {
+	dockerfile := "FROM busybox\n\n# comment\nWORKDIR\n"
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	require.NoError(t, err)
+
+	b := newBuilderWithMockBackend()
+	b.Stdout = ioutil.Discard
+	n := result.AST.Children[1]
+	err = b.dispatch(1, len(result.AST.Children), n)
+	require.Error(t, err)
+
+	err = withDockerfileLine(err, n)
+	assert.EqualError(t, err, "Dockerfile:4: WORKDIR requires exactly one argument")
+	assert.Equal(t, errExactlyOneArgument("WORKDIR").Error(), errors.Cause(err).Error())
+}
+
+func TestWarnOnUndeclaredArgs(t *testing.T) {
+	dockerfile := `ARG VERSION=1.0
+FROM busybox AS build
+ARG TARGET
+RUN make $TARGET
+FROM busybox
+ENV TAG=latest
+RUN echo ${VERSION} $TARGET \$TARGET
+RUN echo $VERSION $TAG
+ARG VERSION
+RUN echo $VERSION
+`
+	stdout := new(bytes.Buffer)
+	b := newBuilderWithMockBackend()
+	b.Stdout = stdout
+	_, _, err := dispatchTestDockerfile(t, b, dockerfile)
+	require.NoError(t, err)
+
+	var warnings []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if strings.HasPrefix(line, "[Warning]") {
+			warnings = append(warnings, line)
+		}
+	}
+	expected := []string{
+		`[Warning] RUN references VERSION, which was declared with ARG outside of the current build stage and is not set in it, add "ARG VERSION" after FROM to use it`,
+		`[Warning] RUN references TARGET, which was declared with ARG outside of the current build stage and is not set in it, add "ARG TARGET" after FROM to use it`,
+	}
+	assert.Equal(t, expected, warnings)
+}
+
+func TestStrictFlags(t *testing.T) {
+	testCases := []struct {
+		dockerfile string
+		strictErr  string
+		lenientErr string
+	}{
+		{
+			dockerfile: "FROM busybox\nCOPY --form=build /app /app\n",
+			strictErr:  "Unknown flag: form, valid flags are ",
+			lenientErr: "Unknown flag: form",
+		},
+		{
+			dockerfile: "FROM busybox\nSTOPSIGNAL --graceful SIGTERM\n",
+			strictErr:  "Unknown flag: graceful, the instruction has no flags",
+		},
+		{
+			dockerfile: "FROM busybox\nHEALTHCHECK --interval=5s NONE\n",
+			strictErr:  "HEALTHCHECK NONE takes no flags",
+		},
+	}
+
+	for _, tc := range testCases {
+		for _, strict := range []bool{true, false} {
+			b := newBuilderWithMockBackend()
+			b.options.StrictFlags = strict
+			_, _, err := dispatchTestDockerfile(t, b, tc.dockerfile)
+			if !strict {
+				if tc.lenientErr == "" {
+					assert.NoError(t, err, tc.dockerfile)
+				} else {
+					assert.EqualError(t, err, tc.lenientErr)
+				}
+				continue
+			}
+			require.Error(t, err, tc.dockerfile)
+			assert.Contains(t, err.Error(), tc.strictErr)
+			// the flags are rejected before the instruction changes anything
+			assert.Equal(t, "", b.runConfig.StopSignal, tc.dockerfile)
+			assert.Nil(t, b.runConfig.Healthcheck, tc.dockerfile)
+		}
+	}
+}
+
+func TestExposeExpandsArgs(t *testing.T) {
+	dockerfile := `FROM busybox
+ARG PORT=8080
+ARG METRICS_PORT=9090
+ARG PROTO=udp
+EXPOSE ${PORT} $METRICS_PORT/tcp 53/${PROTO}
+`
+	b := newBuilderWithMockBackend()
+	b.options.BuildArgs = map[string]*string{"PORT": strPtr("3000")}
+	b.buildArgs = newBuildArgs(b.options.BuildArgs)
+	_, _, err := dispatchTestDockerfile(t, b, dockerfile)
+	require.NoError(t, err)
+
+	expected := nat.PortSet{
+		"3000/tcp": {},
+		"9090/tcp": {},
+		"53/udp":   {},
+	}
+	assert.Equal(t, expected, b.runConfig.ExposedPorts)
+}
+
+func TestStopSignalExpandsArgs(t *testing.T) {
+	testCases := []struct {
+		name      string
+		buildArgs map[string]*string
+		expected  string
+		err       string
+	}{
+		{name: "default", expected: "SIGTERM"},
+		{name: "overridden", buildArgs: map[string]*string{"SIG": strPtr("SIGKILL")}, expected: "SIGKILL"},
+		{name: "numeric", buildArgs: map[string]*string{"SIG": strPtr("9")}, expected: "9"},
+		{name: "unknown", buildArgs: map[string]*string{"SIG": strPtr("SIGNOPE")}, err: "Invalid signal: SIGNOPE"},
+		{name: "empty", buildArgs: map[string]*string{"SIG": strPtr("")}, err: "expanded to an empty value"},
+	}
+
+	for _, testCase := range testCases {
+		b := newBuilderWithMockBackend()
+		b.options.BuildArgs = testCase.buildArgs
+		b.buildArgs = newBuildArgs(b.options.BuildArgs)
+		_, _, err := dispatchTestDockerfile(t, b, "FROM busybox\nARG SIG=SIGTERM\nSTOPSIGNAL ${SIG}\n")
+
+		if testCase.err != "" {
+			require.Error(t, err, testCase.name)
+			assert.Contains(t, err.Error(), testCase.err, testCase.name)
+			continue
+		}
+		require.NoError(t, err, testCase.name)
+		assert.Equal(t, testCase.expected, b.runConfig.StopSignal, testCase.name)
+	}
+}
+
+func TestEnvUnsetDispatch(t *testing.T) {
+	b := newBuilderWithMockBackend()
+	_, _, err := dispatchTestDockerfile(t, b, "FROM busybox\nENV HTTP_PROXY=http://proxy:3128 MODE=release\nENV --unset HTTP_PROXY\n")
+	require.NoError(t, err)
+	assert.Contains(t, b.runConfig.Env, "MODE=release")
+	assert.NotContains(t, b.runConfig.Env, "HTTP_PROXY=http://proxy:3128")
+}
+
+func TestEnvInterpretEscapes(t *testing.T) {
+	testCases := []struct {
+		dockerfile string
+		expected   string
+		err        string
+	}{
+		{dockerfile: `ENV --interpret-escapes CONFIG="a=1\nb=2"`, expected: "CONFIG=a=1\nb=2"},
+		{dockerfile: `ENV --interpret-escapes CONFIG='a\tb\\c\x41\u00e9'`, expected: "CONFIG=a\tb\\cAé"},
+		{dockerfile: `ENV --interpret-escapes CONFIG=a\\nb`, expected: "CONFIG=a\nb"},
+		{dockerfile: `ENV CONFIG="a=1\nb=2"`, expected: `CONFIG=a=1\nb=2`},
+		{dockerfile: `ENV --interpret-escapes CONFIG="a\qb"`, err: `ENV --interpret-escapes: invalid value of CONFIG: unknown escape sequence at "\\qb"`},
+		{dockerfile: `ENV --interpret-escapes --file CONFIG=config`, err: "ENV --interpret-escapes can't be used with --file"},
+		{dockerfile: `ENV --interpret-escapes --unset CONFIG`, err: "ENV --interpret-escapes can't be used with --unset"},
+	}
+	for _, testCase := range testCases {
+		b := newBuilderWithMockBackend()
+		_, _, err := dispatchTestDockerfile(t, b, testCase.dockerfile)
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err, testCase.dockerfile)
+			continue
+		}
+		require.NoError(t, err, testCase.dockerfile)
+		assert.Equal(t, []string{testCase.expected}, b.runConfig.Env, testCase.dockerfile)
+	}
+}
+
+func TestRunIf(t *testing.T) {
+	dockerfile := `FROM busybox
+ARG WITH_TESTS
+RUN --if=${WITH_TESTS} make test
+`
+	testCases := []struct {
+		value *string
+		run   bool
+		err   string
+	}{
+		{value: strPtr("true"), run: true},
+		{value: strPtr("1"), run: true},
+		{value: strPtr("Yes"), run: true},
+		{value: strPtr("false")},
+		{value: strPtr("")},
+		{},
+		{value: strPtr("maybe"), err: `Invalid --if "${WITH_TESTS}" for RUN, "maybe" must be one of true, false, yes, no, on, off, 1, 0 or empty`},
+	}
+
+	for _, testCase := range testCases {
+		b := newBuilderWithMockBackend()
+		if testCase.value != nil {
+			b.options.BuildArgs = map[string]*string{"WITH_TESTS": testCase.value}
+			b.buildArgs = newBuildArgs(b.options.BuildArgs)
+		}
+		created, _, err := dispatchTestDockerfile(t, b, dockerfile)
+
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err)
+			continue
+		}
+		require.NoError(t, err)
+		if testCase.run {
+			require.Len(t, created, 1)
+			assert.Equal(t, strslice.StrSlice{"/bin/sh", "-c", "make test"}, created[0].Config.Cmd)
+		} else {
+			assert.Empty(t, created)
+		}
+	}
+}
+
+func TestRunUlimits(t *testing.T) {
+	testCases := []struct {
+		flags   string
+		ulimits []*units.Ulimit
+		cmd     string
+		err     string
+	}{
+		{
+			flags:   "--ulimit=nproc=64 --ulimit=nofile=1024:2048",
+			ulimits: []*units.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}, {Name: "nproc", Soft: 64, Hard: 64}, {Name: "core", Soft: 0, Hard: 0}},
+			cmd:     "|ulimit=nofile=1024:2048 |ulimit=nproc=64:64 /bin/sh -c make",
+		},
+		{
+			flags:   "--ulimit=core=1:1",
+			ulimits: []*units.Ulimit{{Name: "core", Soft: 1, Hard: 1}, {Name: "nofile", Soft: 512, Hard: 512}},
+			cmd:     "|ulimit=core=1:1 /bin/sh -c make",
+		},
+		{
+			ulimits: []*units.Ulimit{{Name: "core", Soft: 0, Hard: 0}, {Name: "nofile", Soft: 512, Hard: 512}},
+			cmd:     "/bin/sh -c make",
+		},
+		{flags: "--ulimit=files=10", err: `Invalid --ulimit "files=10" for RUN: invalid ulimit type: files`},
+		{flags: "--ulimit=nofile=2048:1024", err: `Invalid --ulimit "nofile=2048:1024" for RUN: ulimit soft limit must be less than or equal to hard limit: 2048 > 1024`},
+		{flags: "--ulimit=nofile=10 --ulimit=nofile=20", err: `Invalid --ulimit "nofile=20" for RUN, nofile is already limited`},
+	}
+
+	for _, testCase := range testCases {
+		b := newBuilderWithMockBackend()
+		b.options.Ulimits = []*units.Ulimit{{Name: "core", Soft: 0, Hard: 0}, {Name: "nofile", Soft: 512, Hard: 512}}
+		created, cacheKeys, err := dispatchTestDockerfile(t, b, "FROM busybox\nRUN "+testCase.flags+" make\n")
+
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Len(t, created, 1)
+		assert.Equal(t, testCase.ulimits, created[0].HostConfig.Ulimits)
+		assert.Contains(t, cacheKeys, "theid "+testCase.cmd)
+		assert.Len(t, b.options.Ulimits, 2)
+	}
+}
+
+func TestRunMounts(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	contextDir, err := filepath.EvalSymlinks(contextDir)
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(filepath.Join(contextDir, "src"), 0755))
+	createTestTempFile(t, filepath.Join(contextDir, "src"), "main.go", "package main", 0644)
+
+	testCases := []struct {
+		flags string
+		binds []string
+		cmd   string
+		err   string
+	}{
+		{
+			flags: "--mount=type=bind,target=/ctx,ro",
+			binds: []string{contextDir + ":/ctx:ro"},
+			cmd:   "|mount=type=bind,source=.,target=/ctx,ro /bin/sh -c make",
+		},
+		{
+			flags: "--mount=type=bind,source=./src/,target=/go/src/app/ --mount=type=bind,src=src/main.go,dst=/main.go,readonly=true",
+			binds: []string{filepath.Join(contextDir, "src") + ":/go/src/app:ro", filepath.Join(contextDir, "src", "main.go") + ":/main.go:ro"},
+			cmd:   "|mount=type=bind,source=src,target=/go/src/app,ro |mount=type=bind,source=src/main.go,target=/main.go,ro /bin/sh -c make",
+		},
+		{flags: "--mount=type=cache,target=/ctx", err: `Invalid --mount "type=cache,target=/ctx" for RUN, type must be bind or secret`},
+		{flags: "--mount=type=secret,id=npmrc", err: "RUN --mount secret npmrc must be declared with SECRET first"},
+		{flags: "--mount=type=secret,target=/npmrc", err: `Invalid --mount "type=secret,target=/npmrc" for RUN, a secret id is required`},
+		{flags: "--mount=type=secret,id=npmrc,source=.npmrc", err: `Invalid --mount "type=secret,id=npmrc,source=.npmrc" for RUN, source only applies to bind mounts`},
+		{flags: "--mount=type=bind,source=../etc,target=/etc/host", err: `Invalid --mount "type=bind,source=../etc,target=/etc/host" for RUN, the source must be a path within the build context`},
+		{flags: "--mount=type=bind,source=/etc,target=/etc/host", err: `Invalid --mount "type=bind,source=/etc,target=/etc/host" for RUN, the source must be a path within the build context`},
+		{flags: "--mount=type=bind,target=src", err: `Invalid --mount "type=bind,target=src" for RUN, the target must be an absolute path other than /`},
+		{flags: "--mount=type=bind,source=src", err: `Invalid --mount "type=bind,source=src" for RUN, a target is required`},
+		{flags: "--mount=type=bind,target=/src,ro=false", err: `Invalid --mount "type=bind,target=/src,ro=false" for RUN, the build context can only be mounted read-only`},
+		{flags: "--mount=type=bind,target=/src,uid=0", err: `Invalid --mount "type=bind,target=/src,uid=0" for RUN, unknown option uid`},
+		{flags: "--mount=type=bind,target=/src --mount=type=bind,source=src,target=/src/", err: `Invalid --mount "type=bind,source=src,target=/src/" for RUN, /src is already mounted`},
+		{flags: "--mount=type=bind,source=docs,target=/docs", err: "failed to mount docs for RUN: docs not found in build context"},
+	}
+
+	for _, testCase := range testCases {
+		buildContext, err := remotecontext.NewLazyContext(contextDir)
+		require.NoError(t, err)
+
+		b := newBuilderWithMockBackend()
+		b.context = buildContext
+		created, cacheKeys, err := dispatchTestDockerfile(t, b, "FROM busybox\nRUN "+testCase.flags+" make\n")
+
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Len(t, created, 1)
+		assert.Equal(t, testCase.binds, created[0].HostConfig.Binds)
+		assert.Contains(t, cacheKeys, "theid "+testCase.cmd)
+	}
+}
+
+func TestRunMountSecret(t *testing.T) {
+	var content string
+	b := newBuilderWithMockBackend()
+	b.options.Secrets = map[string][]byte{"npmrc": []byte("token")}
+	b.docker.(*MockBackend).containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		data, err := ioutil.ReadFile(strings.SplitN(config.HostConfig.Binds[0], ":", 2)[0])
+		require.NoError(t, err)
+		content = string(data)
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	created, cacheKeys, err := dispatchTestDockerfile(t, b, "FROM busybox\nSECRET id=npmrc\nRUN --mount=type=secret,id=npmrc npm install\n")
+	require.NoError(t, err)
+
+	require.Len(t, created, 1)
+	binds := created[0].HostConfig.Binds
+	require.Len(t, binds, 1)
+	assert.True(t, strings.HasSuffix(binds[0], ":/run/secrets/npmrc:ro"))
+	assert.Equal(t, "token", content)
+	// the secret is only available for the duration of the command
+	_, err = os.Stat(strings.SplitN(binds[0], ":", 2)[0])
+	assert.True(t, os.IsNotExist(err))
+	// its value is not part of the cache key
+	assert.Contains(t, cacheKeys, "theid |mount=type=secret,id=npmrc,target=/run/secrets/npmrc /bin/sh -c npm install")
+}
+
+func TestRunShellFlag(t *testing.T) {
+	testCases := []struct {
+		dockerfile string
+		cmd        []string
+		cacheCmd   string
+		err        string
+	}{
+		{
+			dockerfile: "RUN --shell-flag=-lc make",
+			cmd:        []string{"/bin/sh", "-lc", "make"},
+			cacheCmd:   "|shell-flag=-lc /bin/sh -lc make",
+		},
+		{
+			dockerfile: "SHELL [\"/bin/bash\", \"-c\"]\nRUN --shell-flag=-ec make",
+			cmd:        []string{"/bin/bash", "-ec", "make"},
+			cacheCmd:   "|shell-flag=-ec /bin/bash -ec make",
+		},
+		{dockerfile: `RUN --shell-flag=-lc ["make"]`, err: "RUN --shell-flag only applies to the shell form of RUN"},
+		{dockerfile: "RUN --shell-flag=l make", err: `Invalid --shell-flag "l" for RUN, must be a single flag starting with -`},
+		{dockerfile: "SHELL [\"/bin/sh\"]\nRUN --shell-flag=-lc make", err: "RUN --shell-flag requires a shell ending with a flag such as -c, the shell is [/bin/sh]"},
+	}
+
+	for _, testCase := range testCases {
+		b := newBuilderWithMockBackend()
+		created, cacheKeys, err := dispatchTestDockerfile(t, b, "FROM busybox\n"+testCase.dockerfile+"\n")
+
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Len(t, created, 1)
+		assert.Equal(t, strslice.StrSlice(testCase.cmd), created[0].Config.Cmd)
+		assert.Contains(t, cacheKeys, "theid "+testCase.cacheCmd)
+	}
+}
+
+func TestRunCommandFilter(t *testing.T) {
+	testCases := []struct {
+		dockerfile string
+		cmd        []string
+		cacheCmd   string
+		err        string
+	}{
+		{
+			dockerfile: "RUN make",
+			cmd:        []string{"/bin/sh", "-c", "make"},
+			cacheCmd:   "/bin/sh -c make",
+		},
+		{
+			dockerfile: `RUN ["apt-get", "install", "-y", "curl"]`,
+			cmd:        []string{"apt-get", "install", "-y", "--no-install-recommends", "curl"},
+			cacheCmd:   "apt-get install -y --no-install-recommends curl",
+		},
+		{dockerfile: "RUN curl -sSL https://example.com/install.sh | sh", err: "RUN command rejected: piping a download to a shell is not allowed"},
+		{dockerfile: "RUN true", err: "RUN command rejected: the command filter returned an empty command"},
+	}
+
+	filter := func(args []string) ([]string, error) {
+		command := strings.Join(args, " ")
+		switch {
+		case strings.Contains(command, "| sh"):
+			return nil, errors.New("piping a download to a shell is not allowed")
+		case command == "/bin/sh -c true":
+			return nil, nil
+		case len(args) > 1 && args[0] == "apt-get" && args[1] == "install":
+			return append(append([]string{}, args[:len(args)-1]...), "--no-install-recommends", args[len(args)-1]), nil
+		}
+		return args, nil
+	}
+
+	for _, testCase := range testCases {
+		b := newBuilderWithMockBackend()
+		b.options.RunCommandFilter = filter
+		created, cacheKeys, err := dispatchTestDockerfile(t, b, "FROM busybox\n"+testCase.dockerfile+"\n")
+
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err)
+			assert.Empty(t, created)
+			continue
+		}
+		require.NoError(t, err)
+		require.Len(t, created, 1)
+		assert.Equal(t, strslice.StrSlice(testCase.cmd), created[0].Config.Cmd)
+		assert.Contains(t, cacheKeys, "theid "+testCase.cacheCmd)
+	}
+}
+
+func TestRunResources(t *testing.T) {
+	testCases := []struct {
+		flags     string
+		resources container.Resources
+		cmd       string
+		err       string
+	}{
+		{
+			flags:     "--memory=512m --cpus=0.5",
+			resources: container.Resources{Memory: 512 * 1024 * 1024, MemorySwap: 2 * 1024 * 1024 * 1024, NanoCPUs: 500000000},
+			cmd:       "|memory=536870912 |cpus=0.5 /bin/sh -c make",
+		},
+		{
+			flags:     "--memory=1g",
+			resources: container.Resources{Memory: 1024 * 1024 * 1024, MemorySwap: 2 * 1024 * 1024 * 1024, CPUQuota: 50000, CPUPeriod: 100000},
+			cmd:       "|memory=1073741824 /bin/sh -c make",
+		},
+		{
+			resources: container.Resources{Memory: 256 * 1024 * 1024, MemorySwap: 2 * 1024 * 1024 * 1024, CPUQuota: 50000, CPUPeriod: 100000},
+			cmd:       "/bin/sh -c make",
+		},
+		{flags: "--memory=lots", err: `Invalid --memory "lots" for RUN: invalid size: 'lots'`},
+		{flags: "--memory=1k", err: `Invalid --memory "1k" for RUN, the minimum is 4MB`},
+		{flags: "--memory=4g", err: `Invalid --memory "4g" for RUN, it is above the memory-swap limit of the build`},
+		{flags: "--cpus=half", err: `Invalid --cpus "half" for RUN: failed to parse half as a rational number`},
+		{flags: "--cpus=0", err: `Invalid --cpus "0" for RUN, must be above 0`},
+		{flags: "--cpus=100000", err: fmt.Sprintf(`Invalid --cpus "100000" for RUN, must be at most %d, the number of CPUs of the daemon`, runtime.NumCPU())},
+	}
+
+	for _, testCase := range testCases {
+		b := newBuilderWithMockBackend()
+		b.options.Memory = 256 * 1024 * 1024
+		b.options.MemorySwap = 2 * 1024 * 1024 * 1024
+		b.options.CPUQuota = 50000
+		b.options.CPUPeriod = 100000
+		created, cacheKeys, err := dispatchTestDockerfile(t, b, "FROM busybox\nRUN "+testCase.flags+" make\n")
+
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Len(t, created, 1)
+		assert.Equal(t, testCase.resources, created[0].HostConfig.Resources)
+		assert.Contains(t, cacheKeys, "theid "+testCase.cmd)
+	}
+}
+
+func TestUnusedArgsWarning(t *testing.T) {
+	dockerfile := `ARG BASE=busybox
+ARG UNUSED_GLOBAL
+FROM ${BASE}
+ARG VERSION=1.0
+ARG STALE
+ARG FROM_CLI
+ARG HTTP_PROXY
+ARG SUFFIX
+ARG FLAG
+ARG SCRIPT
+RUN --if=${FLAG} echo "$VERSION" ${SUFFIX%.*}
+COPY <<EOF /run.sh
+$SCRIPT
+EOF
+`
+	b := newBuilderWithMockBackend()
+	b.options.ValidateOnly = true
+	b.options.BuildArgs = map[string]*string{"FROM_CLI": strPtr("x")}
+	b.buildArgs = newBuildArgs(b.options.BuildArgs)
+	_, _, err := dispatchTestDockerfile(t, b, dockerfile)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	b.Stdout = buf
+	b.warnOnUnusedArgs()
+	assert.Equal(t, "[Warning] One or more args [UNUSED_GLOBAL STALE] were declared but never used\n", buf.String())
+}
+
+func TestLabelExpandsValuesOnly(t *testing.T) {
+	dockerfile := `FROM busybox
+ARG VERSION=1.2
+ENV KEY=version
+LABEL version=${VERSION} "${KEY}"=x '$literal'=y "quoted key"="v $VERSION"
+`
+	stdout := new(bytes.Buffer)
+	b := newBuilderWithMockBackend()
+	b.Stdout = stdout
+	_, _, err := dispatchTestDockerfile(t, b, dockerfile)
+	require.NoError(t, err)
+
+	assert.Contains(t, stdout.String(), "[Warning] LABEL key ${KEY} contains $, variables are not replaced in label keys")
+	expected := map[string]string{
+		"version":    "1.2",
+		"${KEY}":     "x",
+		"$literal":   "y",
+		"quoted key": "v 1.2",
+	}
+	assert.Equal(t, expected, b.runConfig.Labels)
+}
+
+func TestOnbuildTriggerValidation(t *testing.T) {
+	testCases := []struct {
+		trigger string
+		err     string
+	}{
+		{trigger: `ONBUILD RUN ["make", "install"]`},
+		{trigger: `ONBUILD RUN [ -f Makefile ] && make`},
+		{trigger: `ONBUILD COPY . /app/`},
+		{trigger: `ONBUILD ENV MODE=release`},
+		{trigger: `ONBUILD RUN ['make', 'install']`, err: `ONBUILD RUN is not a valid JSON array of strings: ['make', 'install']`},
+		{trigger: `ONBUILD COPY ["src", "/app/"`, err: `ONBUILD COPY is not a valid JSON array of strings: ["src", "/app/"`},
+		{trigger: `ONBUILD COPY src`, err: "ONBUILD COPY requires at least two arguments"},
+		{trigger: `ONBUILD ADD ["src"]`, err: "ONBUILD ADD requires at least two arguments"},
+		{trigger: `ONBUILD RUN []`, err: "ONBUILD RUN requires at least one argument"},
+	}
+
+	for _, testCase := range testCases {
+		b := newBuilderWithMockBackend()
+		_, _, err := dispatchTestDockerfile(t, b, "FROM busybox\n"+testCase.trigger+"\n")
+
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err, testCase.trigger)
+			continue
+		}
+		assert.NoError(t, err, testCase.trigger)
+	}
+}
@@ -18,6 +18,7 @@ type imageContexts struct {
 	b           *Builder
 	list        []*imageMount
 	byName      map[string]*imageMount
+	additional  map[string]*imageMount
 	cache       *pathCache
 	currentName string
 }
@@ -27,13 +28,13 @@ func (ic *imageContexts) newImageMount(id string) *imageMount {
 }
 
 func (ic *imageContexts) add(name string) (*imageMount, error) {
-	im := &imageMount{ic: ic}
+	im := &imageMount{ic: ic, name: name}
 	if len(name) > 0 {
 		if ic.byName == nil {
 			ic.byName = make(map[string]*imageMount)
 		}
 		if _, ok := ic.byName[name]; ok {
-			return nil, errors.Errorf("duplicate name %s", name)
+			return nil, errors.Errorf("duplicate build stage name: %s", name)
 		}
 		ic.byName[name] = im
 	}
@@ -47,6 +48,14 @@ func (ic *imageContexts) update(imageID string, runConfig *container.Config) {
 	ic.list[len(ic.list)-1].runConfig = runConfig
 }
 
+// setLayers records the number of layers of the image of the current build
+// stage, for the stages built FROM it.
+func (ic *imageContexts) setLayers(layers int) {
+	if len(ic.list) > 0 {
+		ic.list[len(ic.list)-1].layers = layers
+	}
+}
+
 func (ic *imageContexts) validate(i int) error {
 	if i < 0 || i >= len(ic.list)-1 {
 		var extraMsg string
@@ -58,7 +67,17 @@ func (ic *imageContexts) validate(i int) error {
 	return nil
 }
 
+// buildContextName is the reserved name of the build context for COPY --from,
+// no build stage can be named so.
+const buildContextName = "context"
+
+// get returns the build stage, additional context or image called
+// indexOrName. The build context, called buildContextName, is returned as a
+// nil mount, as ADD and COPY use it when they have no --from.
 func (ic *imageContexts) get(indexOrName string) (*imageMount, error) {
+	if strings.EqualFold(indexOrName, buildContextName) {
+		return nil, nil
+	}
 	index, err := strconv.Atoi(indexOrName)
 	if err == nil {
 		if err := ic.validate(index); err != nil {
@@ -69,6 +88,9 @@ func (ic *imageContexts) get(indexOrName string) (*imageMount, error) {
 	if im, ok := ic.byName[strings.ToLower(indexOrName)]; ok {
 		return im, nil
 	}
+	if im, ok, err := ic.getAdditional(indexOrName); ok || err != nil {
+		return im, err
+	}
 	im, err := mountByRef(ic.b, indexOrName)
 	if err != nil {
 		return nil, errors.Wrapf(err, "invalid from flag value %s", indexOrName)
@@ -76,6 +98,32 @@ func (ic *imageContexts) get(indexOrName string) (*imageMount, error) {
 	return im, nil
 }
 
+// getAdditional returns the additional build context called name, resolving
+// it on first use.
+func (ic *imageContexts) getAdditional(name string) (*imageMount, bool, error) {
+	if im, ok := ic.additional[name]; ok {
+		return im, true, nil
+	}
+	resolve, ok := ic.b.options.AdditionalContexts[name]
+	if !ok {
+		return nil, false, nil
+	}
+	p, err := resolve()
+	if err != nil {
+		return nil, true, errors.Wrapf(err, "failed to resolve build context %s", name)
+	}
+	ctx, err := remotecontext.NewLazyContext(p)
+	if err != nil {
+		return nil, true, errors.Wrapf(err, "failed to create lazycontext for %s", p)
+	}
+	if ic.additional == nil {
+		ic.additional = make(map[string]*imageMount)
+	}
+	im := &imageMount{ic: ic, name: name, ctx: ctx}
+	ic.additional[name] = im
+	return im, true, nil
+}
+
 func (ic *imageContexts) unmount() (retErr error) {
 	for _, im := range ic.list {
 		if err := im.unmount(); err != nil {
@@ -92,6 +140,31 @@ func (ic *imageContexts) unmount() (retErr error) {
 	return
 }
 
+// names returns the names of all build stages added so far, in order. Stages
+// without a name are represented by an empty string.
+func (ic *imageContexts) names() []string {
+	names := make([]string, len(ic.list))
+	for i, im := range ic.list {
+		names[i] = im.name
+	}
+	return names
+}
+
+// platform returns the platform of the build stage called indexOrName, or an
+// empty string if there is no such stage.
+func (ic *imageContexts) platform(indexOrName string) string {
+	if index, err := strconv.Atoi(indexOrName); err == nil {
+		if index < 0 || index >= len(ic.list) {
+			return ""
+		}
+		return ic.list[index].platform
+	}
+	if im, ok := ic.byName[strings.ToLower(indexOrName)]; ok {
+		return im.platform
+	}
+	return ""
+}
+
 func (ic *imageContexts) isCurrentTarget(target string) bool {
 	if target == "" {
 		return false
@@ -119,10 +192,15 @@ func (ic *imageContexts) setCache(id, path string, v interface{}) {
 // by an existing image
 type imageMount struct {
 	id        string
+	name      string
 	ctx       builder.Context
 	release   func() error
 	ic        *imageContexts
 	runConfig *container.Config
+	// platform is the platform of the base image of a build stage
+	platform string
+	// layers is the number of layers of the image of a build stage
+	layers int
 }
 
 func (im *imageMount) context() (builder.Context, error) {
@@ -161,6 +239,18 @@ func (im *imageMount) RunConfig() *container.Config {
 	return im.runConfig
 }
 
+// Layers returns the number of layers of the image of the build stage, so that
+// a stage built FROM another one keeps counting them.
+func (im *imageMount) Layers() int {
+	return im.layers
+}
+
+// Platform returns the platform of the base image of the build stage, so that
+// a stage built FROM another one reports the same platform.
+func (im *imageMount) Platform() string {
+	return im.platform
+}
+
 type pathCache struct {
 	mu    sync.Mutex
 	items map[string]interface{}
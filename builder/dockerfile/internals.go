@@ -4,6 +4,7 @@ package dockerfile
 // non-contiguous functionality. Please read the comments.
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -15,26 +16,36 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/backend"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/dockerignore"
+	"github.com/docker/docker/builder/remotecontext"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/fileutils"
 	"github.com/docker/docker/pkg/httputils"
 	"github.com/docker/docker/pkg/ioutils"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/progress"
+	"github.com/docker/docker/pkg/signal"
 	"github.com/docker/docker/pkg/streamformatter"
 	"github.com/docker/docker/pkg/stringid"
+	"github.com/docker/docker/pkg/symlink"
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/docker/pkg/tarsum"
 	"github.com/docker/docker/pkg/urlutil"
+	libcontainerUser "github.com/opencontainers/runc/libcontainer/user"
 	"github.com/pkg/errors"
 )
 
@@ -47,9 +58,12 @@ func (b *Builder) commit(id string, autoCmd strslice.StrSlice, comment string) e
 	}
 	b.runConfig.Image = b.image
 
-	if id == "" {
+	// instructions committed without a container of their own only change
+	// the config, their history entry is always an empty layer
+	emptyLayer := id == ""
+	if emptyLayer {
 		cmd := b.runConfig.Cmd
-		b.runConfig.Cmd = strslice.StrSlice(append(getShell(b.runConfig), "#(nop) ", comment))
+		b.runConfig.Cmd = b.cacheCmd(strslice.StrSlice(append(b.getShell(b.runConfig), "#(nop) ", comment)))
 		defer func(cmd strslice.StrSlice) { b.runConfig.Cmd = cmd }(cmd)
 
 		hit, err := b.probeCache()
@@ -58,7 +72,7 @@ func (b *Builder) commit(id string, autoCmd strslice.StrSlice, comment string) e
 		} else if hit {
 			return nil
 		}
-		id, err = b.create()
+		id, err = b.create(b.hostConfig())
 		if err != nil {
 			return err
 		}
@@ -74,6 +88,7 @@ func (b *Builder) commit(id string, autoCmd strslice.StrSlice, comment string) e
 			Pause:  true,
 			Config: &autoConfig,
 		},
+		EmptyLayer: emptyLayer,
 	}
 
 	// Commit the container
@@ -87,12 +102,62 @@ func (b *Builder) commit(id string, autoCmd strslice.StrSlice, comment string) e
 	return nil
 }
 
+// addLayer counts a layer added to the current image by the instruction being
+// dispatched, before it runs, whether it is then committed or used from the
+// cache, and returns an error if the image would have more layers than the
+// MaxLayers option allows.
+func (b *Builder) addLayer() error {
+	if max := b.options.MaxLayers; max > 0 && b.layers >= max {
+		return errors.Errorf("%s would add a layer to an image which has %d layers already, the maximum is %d", b.instruction, b.layers, max)
+	}
+	b.layers++
+	b.imageContexts.setLayers(b.layers)
+	return nil
+}
+
 type copyInfo struct {
 	builder.FileInfo
 	decompress bool
+	// the path of the source in the context it is copied from, empty for
+	// remote files and here-documents
+	contextPath string
+	// namedPath is the path the source was named by in the context, which is
+	// a symlink if it differs from contextPath
+	namedPath string
+}
+
+// contextRoot returns the root of the context the source is copied from.
+func (info copyInfo) contextRoot() string {
+	if info.contextPath == "" || info.contextPath == "." {
+		return info.Path()
+	}
+	return strings.TrimSuffix(info.Path(), string(os.PathSeparator)+info.contextPath)
+}
+
+// namedLink returns the target of the source if it was named by a symlink,
+// which the context resolved to get to the source.
+func (info copyInfo) namedLink() (string, bool, error) {
+	if info.namedPath == "" {
+		return "", false, nil
+	}
+	root := info.contextRoot()
+	dir, err := symlink.FollowSymlinkInScope(filepath.Join(root, filepath.Dir(info.namedPath)), root)
+	if err != nil {
+		return "", false, err
+	}
+	p := filepath.Join(dir, filepath.Base(info.namedPath))
+	st, err := os.Lstat(p)
+	if err != nil || st.Mode()&os.ModeSymlink == 0 {
+		return "", false, err
+	}
+	link, err := os.Readlink(p)
+	if err != nil {
+		return "", false, err
+	}
+	return link, true, nil
 }
 
-func (b *Builder) runContextCommand(args []string, allowRemote bool, allowLocalDecompression bool, cmdName string, imageSource *imageMount) error {
+func (b *Builder) runContextCommand(args []string, allowRemote bool, allowLocalDecompression bool, cmdName string, imageSource *imageMount, fileOpts copyFileOptions) error {
 	if len(args) < 2 {
 		return fmt.Errorf("Invalid %s format - at least two arguments required", cmdName)
 	}
@@ -103,6 +168,8 @@ func (b *Builder) runContextCommand(args []string, allowRemote bool, allowLocalD
 	b.runConfig.Image = b.image
 
 	var infos []copyInfo
+	// remote sources are not downloaded when only validating the Dockerfile
+	var remoteSrcs int
 
 	// Loop through each src file and calculate the info we need to
 	// do the copy (e.g. hash value if cached).  Don't actually do
@@ -110,10 +177,42 @@ func (b *Builder) runContextCommand(args []string, allowRemote bool, allowLocalD
 	var err error
 	for _, orig := range args[0 : len(args)-1] {
 		var fi builder.FileInfo
+		if heredoc, ok := b.heredocSource(orig); ok {
+			info, err := writeHeredoc(heredoc)
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(filepath.Dir(info.Path()))
+			infos = append(infos, info)
+			continue
+		}
+		if ref, ok := ociArtifactRef(orig); ok {
+			if cmdName != "ADD" {
+				return fmt.Errorf("Source can't be an OCI artifact for %s", cmdName)
+			}
+			if b.options.ValidateOnly {
+				remoteSrcs++
+				continue
+			}
+			info, err := b.artifactCopyInfos(ref)
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(info.Path())
+			infos = append(infos, info)
+			continue
+		}
 		if urlutil.IsURL(orig) {
 			if !allowRemote {
 				return fmt.Errorf("Source can't be a URL for %s", cmdName)
 			}
+			if b.options.ValidateOnly {
+				remoteSrcs++
+				continue
+			}
+			if cmdName == "ADD" {
+				b.deprecate(cmdName, "downloading remote URLs is deprecated, use COPY --url or fetch them in a RUN instruction instead")
+			}
 			fi, err = b.download(orig)
 			if err != nil {
 				return err
@@ -134,11 +233,38 @@ func (b *Builder) runContextCommand(args []string, allowRemote bool, allowLocalD
 		infos = append(infos, subInfos...)
 	}
 
-	if len(infos) == 0 {
+	numSrcs := len(infos) + remoteSrcs
+	if numSrcs == 0 {
 		return errors.New("No source files were specified")
 	}
-	if len(infos) > 1 && !strings.HasSuffix(dest, string(os.PathSeparator)) {
-		return fmt.Errorf("When using %s with more than one source file, the destination must be a directory and end with a /", cmdName)
+	if fileOpts.rename {
+		if err := b.checkRename(cmdName, numSrcs, infos, dest); err != nil {
+			return err
+		}
+	} else {
+		if numSrcs > 1 && !strings.HasSuffix(dest, string(os.PathSeparator)) {
+			return fmt.Errorf("When using %s with more than one source file, the destination must be a directory and end with a /", cmdName)
+		}
+		if len(infos) == 1 && !strings.HasSuffix(dest, string(os.PathSeparator)) {
+			b.warnOnWildcardToFile(cmdName, args[:len(args)-1], dest)
+		}
+	}
+	if b.options.ValidateOnly {
+		return nil
+	}
+
+	if b.needsStaging(fileOpts) {
+		tmpDir, err := ioutils.TempDir("", "docker-copy")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		if infos, err = b.stageCopyInfos(infos, tmpDir, fileOpts); err != nil {
+			return err
+		}
+		if len(infos) == 0 {
+			return errors.Errorf("All the source files are excluded by --ignorefile %s", fileOpts.ignoreFile)
+		}
 	}
 
 	// For backwards compat, if there's just one info then use it as the
@@ -168,10 +294,31 @@ func (b *Builder) runContextCommand(args []string, allowRemote bool, allowLocalD
 		origPaths = strings.Join(origs, " ")
 	}
 
+	// an archive is copied as it is by ADD --decompress=false, which must
+	// not share the cache of the extracted archive
+	cacheName := cmdName
+	if cmdName == "ADD" && !allowLocalDecompression {
+		cacheName += " --decompress=false"
+	}
+	owner, err := b.copyOwner()
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		cacheName += fmt.Sprintf(" --chown=%d:%d", owner.Uid, owner.Gid)
+	}
+	fileLabel := b.copyLabel(cmdName, fileOpts)
+	if fileLabel != "" {
+		cacheName += " --selinux-label=" + fileLabel
+	}
+
 	cmd := b.runConfig.Cmd
-	b.runConfig.Cmd = strslice.StrSlice(append(getShell(b.runConfig), fmt.Sprintf("#(nop) %s %s in %s ", cmdName, srcHash, dest)))
+	b.runConfig.Cmd = b.cacheCmd(strslice.StrSlice(append(b.getShell(b.runConfig), fmt.Sprintf("#(nop) %s %s in %s ", cacheName, srcHash, dest))))
 	defer func(cmd strslice.StrSlice) { b.runConfig.Cmd = cmd }(cmd)
 
+	if err := b.addLayer(); err != nil {
+		return err
+	}
 	if hit, err := b.probeCache(); err != nil {
 		return err
 	} else if hit {
@@ -196,13 +343,578 @@ func (b *Builder) runContextCommand(args []string, allowRemote bool, allowLocalD
 		return err
 	}
 
+	if b.options.StrictCopyDestinations {
+		if err := b.checkCopyDestinations(dest, infos); err != nil {
+			return err
+		}
+	}
+
 	for _, info := range infos {
-		if err := b.docker.CopyOnBuild(container.ID, dest, info.FileInfo, info.decompress); err != nil {
+		if fileLabel != "" {
+			uid, gid := 0, 0
+			if owner != nil {
+				uid, gid = owner.Uid, owner.Gid
+			}
+			err = b.docker.(builder.LabelBackend).CopyOnBuildWithLabel(container.ID, dest, info.FileInfo, info.decompress, uid, gid, fileLabel)
+		} else if owner != nil {
+			err = b.docker.(builder.ChownBackend).CopyOnBuildWithOwner(container.ID, dest, info.FileInfo, info.decompress, owner.Uid, owner.Gid)
+		} else {
+			err = b.docker.CopyOnBuild(container.ID, dest, info.FileInfo, info.decompress)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.commit(container.ID, cmd, comment)
+}
+
+// copyOwner returns the user and group which own the files copied by ADD and
+// COPY with the CopyAsUser option: those of the USER in effect, resolved
+// against the /etc/passwd and /etc/group files of the current image. It
+// returns nil when the files are owned by root.
+func (b *Builder) copyOwner() (*libcontainerUser.ExecUser, error) {
+	if !b.options.CopyAsUser || b.runConfig.User == "" || runtime.GOOS == "windows" {
+		return nil, nil
+	}
+
+	var passwdPath, groupPath string
+	if b.image != "" {
+		root, release, err := b.docker.MountImage(b.image)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to mount %s", b.image)
+		}
+		defer release()
+		if passwdPath, err = symlink.FollowSymlinkInScope(filepath.Join(root, "etc", "passwd"), root); err != nil {
+			return nil, err
+		}
+		if groupPath, err = symlink.FollowSymlinkInScope(filepath.Join(root, "etc", "group"), root); err != nil {
+			return nil, err
+		}
+	}
+	// without the files, or without an image, only numeric ids resolve
+	owner, err := libcontainerUser.GetExecUserPath(b.runConfig.User, nil, passwdPath, groupPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve the owner of the copied files, USER %s", b.runConfig.User)
+	}
+	if owner.Uid == 0 && owner.Gid == 0 {
+		return nil, nil
+	}
+	if _, ok := b.docker.(builder.ChownBackend); !ok {
+		return nil, errors.Errorf("copying files owned by USER %s is not supported by this builder", b.runConfig.User)
+	}
+	return owner, nil
+}
+
+// copyLabel returns the SELinux context which the files copied by ADD or COPY
+// --selinux-label are labeled with. The flag is ignored with a warning when
+// the backend can't label the files, as on hosts without SELinux.
+func (b *Builder) copyLabel(cmdName string, fileOpts copyFileOptions) string {
+	if fileOpts.selinuxLabel == "" {
+		return ""
+	}
+	if backend, ok := b.docker.(builder.LabelBackend); !ok || !backend.SELinuxEnabled() {
+		fmt.Fprintf(b.Stdout, "[Warning] %s --selinux-label=%s is ignored, SELinux is not enabled for this builder\n", cmdName, fileOpts.selinuxLabel)
+		return ""
+	}
+	return fileOpts.selinuxLabel
+}
+
+// heredocSource returns the here-document of the instruction which the source
+// src of ADD or COPY refers to, such as <<EOF.
+func (b *Builder) heredocSource(src string) (parser.Heredoc, bool) {
+	m := heredocToken.FindStringSubmatch(src)
+	if m == nil {
+		return parser.Heredoc{}, false
+	}
+	name := m[1] + m[2] + m[3]
+	for _, heredoc := range b.heredocs {
+		if heredoc.Name == name {
+			return heredoc, true
+		}
+	}
+	return parser.Heredoc{}, false
+}
+
+// writeHeredoc writes the content of heredoc to a file named after its
+// delimiter in a new temporary directory, with mode 0644. The file is hashed
+// from its content, so that the cache key changes with it.
+func writeHeredoc(heredoc parser.Heredoc) (info copyInfo, err error) {
+	content := heredoc.Content
+	if heredoc.Chomp {
+		content = trimHeredocTabs(content)
+	}
+
+	tmpDir, err := ioutils.TempDir("", "docker-heredoc")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	path := filepath.Join(tmpDir, heredoc.Name)
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		return
+	}
+	// the mode passed on creation is subject to the umask
+	if err = os.Chmod(path, 0644); err != nil {
+		return
+	}
+	st, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	hash, err := hashPath(path)
+	if err != nil {
+		return
+	}
+	info.FileInfo = &builder.HashedFileInfo{
+		FileInfo: builder.PathFileInfo{FileInfo: st, FilePath: path},
+		FileHash: "heredoc:" + hash,
+	}
+	return
+}
+
+// checkEntrypoint returns an error if the binary of the exec form ENTRYPOINT
+// of the current stage, or of its exec form CMD when there is no ENTRYPOINT,
+// does not exist or is not executable in the image. Commands in shell form,
+// and commands inherited from the base image, are not checked.
+func (b *Builder) checkEntrypoint() error {
+	var (
+		instruction string
+		cmd         strslice.StrSlice
+	)
+	switch {
+	case len(b.runConfig.Entrypoint) > 0:
+		if !b.entrypointExecForm {
+			return nil
+		}
+		instruction, cmd = "ENTRYPOINT", b.runConfig.Entrypoint
+	case len(b.runConfig.Cmd) > 0:
+		if !b.cmdExecForm {
+			return nil
+		}
+		instruction, cmd = "CMD", b.runConfig.Cmd
+	default:
+		return nil
+	}
+
+	root, release, err := b.docker.MountImage(b.image)
+	if err != nil {
+		return errors.Wrapf(err, "failed to mount %s", b.image)
+	}
+	defer release()
+
+	name := cmd[0]
+	var candidates []string
+	switch {
+	case strings.Contains(name, "/"):
+		p := name
+		if !system.IsAbs(p) {
+			p = filepath.Join(string(os.PathSeparator), b.runConfig.WorkingDir, p)
+		}
+		candidates = []string{p}
+	default:
+		for _, dir := range filepath.SplitList(b.runConfigEnvMapping()["PATH"]) {
+			candidates = append(candidates, filepath.Join(string(os.PathSeparator), dir, name))
+		}
+	}
+
+	var notExecutable string
+	for _, p := range candidates {
+		resolved, err := symlink.FollowSymlinkInScope(filepath.Join(root, filepath.FromSlash(p)), root)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(resolved)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if fi.IsDir() {
+			continue
+		}
+		if !isExecutable(fi) {
+			if notExecutable == "" {
+				notExecutable = p
+			}
+			continue
+		}
+		return nil
+	}
+	if notExecutable != "" {
+		return errors.Errorf("%s binary %s is not executable in the image", instruction, notExecutable)
+	}
+	return errors.Errorf("%s binary %s does not exist in the image", instruction, name)
+}
+
+// checkUser returns an error if the user or the group of spec, in the
+// user[:group] form of USER, is a name that the /etc/passwd or /etc/group
+// file of the current image does not define.
+func (b *Builder) checkUser(spec string) error {
+	userName, groupName := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userName, groupName = spec[:i], spec[i+1:]
+	}
+	userName, groupName = nonNumericID(userName), nonNumericID(groupName)
+	if userName == "" && groupName == "" {
+		return nil
+	}
+
+	var root string
+	if b.image != "" {
+		var (
+			release func() error
+			err     error
+		)
+		root, release, err = b.docker.MountImage(b.image)
+		if err != nil {
+			return errors.Wrapf(err, "failed to mount %s", b.image)
+		}
+		defer release()
+	}
+
+	if userName != "" {
+		users, err := parseImageFile(root, "/etc/passwd", func(r io.Reader) (int, error) {
+			users, err := libcontainerUser.ParsePasswdFilter(r, func(u libcontainerUser.User) bool { return u.Name == userName })
+			return len(users), err
+		})
+		if err != nil {
 			return err
 		}
+		if users == 0 {
+			return errors.Errorf("USER %s: user %s is not defined in /etc/passwd of the image", spec, userName)
+		}
+	}
+	if groupName != "" {
+		groups, err := parseImageFile(root, "/etc/group", func(r io.Reader) (int, error) {
+			groups, err := libcontainerUser.ParseGroupFilter(r, func(g libcontainerUser.Group) bool { return g.Name == groupName })
+			return len(groups), err
+		})
+		if err != nil {
+			return err
+		}
+		if groups == 0 {
+			return errors.Errorf("USER %s: group %s is not defined in /etc/group of the image", spec, groupName)
+		}
+	}
+	return nil
+}
+
+// nonNumericID returns id, or "" when id is numeric and needs no lookup.
+func nonNumericID(id string) string {
+	if _, err := strconv.ParseUint(id, 10, 32); err == nil {
+		return ""
+	}
+	return id
+}
+
+// parseImageFile calls parse with the content of the file at path in the
+// image mounted at root, and returns the number of entries it found. A
+// missing file, or an image without a root, has no entries.
+func parseImageFile(root, path string, parse func(io.Reader) (int, error)) (int, error) {
+	if root == "" {
+		return 0, nil
+	}
+	resolved, err := symlink.FollowSymlinkInScope(filepath.Join(root, filepath.FromSlash(path)), root)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(resolved)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	n, err := parse(f)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s of the image", path)
+	}
+	return n, nil
+}
+
+// warnOnWildcardToFile warns when a source with wildcards, that happens to
+// match a single file, is copied to a destination without a trailing slash
+// that is not a directory of the image: the file is then copied to a file
+// named like the destination, and the instruction fails as soon as the
+// wildcards match more files, which is almost never what was intended.
+func (b *Builder) warnOnWildcardToFile(cmdName string, srcs []string, dest string) {
+	var pattern string
+	for _, src := range srcs {
+		if !urlutil.IsURL(src) && containsWildcards(src) {
+			pattern = src
+			break
+		}
+	}
+	if pattern == "" {
+		return
+	}
+	normalisedDest, err := normaliseDest(cmdName, b.runConfig.WorkingDir, dest)
+	if err != nil {
+		return
+	}
+	isDir, err := b.isImageDir(normalisedDest)
+	if err != nil {
+		logrus.Debugf("[BUILDER] failed to check %s in %s: %v", normalisedDest, b.image, err)
+		return
+	}
+	if !isDir {
+		fmt.Fprintf(b.Stdout, "[Warning] %s destination %s does not end with a / and is not a directory, the file matching %s is copied to a file named %s\n", cmdName, dest, pattern, normalisedDest)
+	}
+}
+
+// checkRename checks the sources and destination of COPY --rename: a single
+// file, wildcards included, copied to a destination without a trailing slash.
+// A destination which is a directory of the image fails the instruction
+// instead of receiving the file, so that the file always ends up named like
+// the destination.
+func (b *Builder) checkRename(cmdName string, numSrcs int, infos []copyInfo, dest string) error {
+	if numSrcs != 1 {
+		return fmt.Errorf("%s --rename requires a single source file, the sources match %d files", cmdName, numSrcs)
+	}
+	if len(infos) == 1 && infos[0].IsDir() {
+		return fmt.Errorf("%s --rename requires a single source file, %s is a directory", cmdName, infos[0].Name())
+	}
+	if strings.HasSuffix(dest, string(os.PathSeparator)) {
+		return fmt.Errorf("%s --rename requires a destination file, %s ends with a /", cmdName, dest)
+	}
+	normalisedDest, err := normaliseDest(cmdName, b.runConfig.WorkingDir, dest)
+	if err != nil {
+		return err
+	}
+	isDir, err := b.isImageDir(normalisedDest)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		return fmt.Errorf("%s --rename destination %s is a directory in the image", cmdName, normalisedDest)
+	}
+	return nil
+}
+
+// isImageDir returns whether path is a directory in the current image.
+func (b *Builder) isImageDir(path string) (bool, error) {
+	if b.image == "" {
+		return false, nil
+	}
+	root, release, err := b.docker.MountImage(b.image)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	resolved, err := symlink.FollowSymlinkInScope(filepath.Join(root, path), root)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(resolved)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+// checkCopyDestinations returns an error if any of the paths infos are copied
+// to below dest resolves, through a symlink that exists in the current image,
+// to a path outside of the destination.
+func (b *Builder) checkCopyDestinations(dest string, infos []copyInfo) error {
+	if b.image == "" {
+		// there is no rootfs to resolve symlinks in
+		return nil
+	}
+	root, release, err := b.docker.MountImage(b.image)
+	if err != nil {
+		return errors.Wrapf(err, "failed to mount %s", b.image)
+	}
+	defer release()
+
+	sep := string(os.PathSeparator)
+	check := func(p string) error {
+		p = filepath.Clean(sep + p)
+		resolved, err := symlink.FollowSymlinkInScope(filepath.Join(root, p), root)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err != nil {
+			return err
+		}
+		if resolved = filepath.Join(sep, rel); resolved != p {
+			return errors.Errorf("destination %s resolves to %s through a symlink in the image", p, resolved)
+		}
+		return nil
+	}
+
+	if err := check(dest); err != nil {
+		return err
+	}
+	for _, info := range infos {
+		fi := info.FileInfo
+		if !fi.IsDir() {
+			if strings.HasSuffix(dest, sep) {
+				if err := check(filepath.Join(dest, fi.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		// the content of directories is copied into dest
+		err := filepath.Walk(fi.Path(), func(path string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(fi.Path(), path)
+			if err != nil {
+				return err
+			}
+			return check(filepath.Join(dest, rel))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readIgnoreFile returns a matcher for the patterns of the ignore file at path
+// in the build context, which has the syntax of .dockerignore.
+func (b *Builder) readIgnoreFile(path string) (*fileutils.PatternMatcher, error) {
+	if b.context == nil {
+		return nil, errors.New("No context given")
+	}
+	f, err := b.context.Open(path)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, errors.Errorf("%s not found in build context", path)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	patterns, err := dockerignore.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return fileutils.NewPatternMatcher(patterns)
+}
+
+// readContextFile returns the content of the file at path in the build
+// context, without a trailing newline.
+func (b *Builder) readContextFile(path string) (string, error) {
+	if b.context == nil {
+		return "", errors.New("No context given")
+	}
+	f, err := b.context.Open(path)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return "", errors.Errorf("%s not found in build context", path)
+		}
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSuffix(string(data), "\n")
+	return strings.TrimSuffix(value, "\r"), nil
+}
+
+// contextFileDigest returns the sha256 digest of the content of the file at
+// path in the build context.
+func (b *Builder) contextFileDigest(path string) (string, error) {
+	if b.context == nil {
+		return "", errors.New("No context given")
+	}
+	f, err := b.context.Open(path)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return "", errors.Errorf("%s not found in build context", path)
+		}
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contextMountSource returns the path on the host of path in the build
+// context, for RUN --mount. Symlinks are followed within the context.
+func (b *Builder) contextMountSource(path string) (string, error) {
+	if b.context == nil {
+		return "", errors.New("No context given")
+	}
+	_, fi, err := b.context.Stat(path)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return "", errors.Errorf("%s not found in build context", path)
+		}
+		return "", err
+	}
+	return fi.Path(), nil
+}
+
+// ociArtifactScheme prefixes the references of OCI artifacts used as ADD
+// sources.
+const ociArtifactScheme = "oci://"
+
+// ociArtifactRef returns the reference of the OCI artifact src, if it is one.
+func ociArtifactRef(src string) (string, bool) {
+	if !strings.HasPrefix(src, ociArtifactScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(src, ociArtifactScheme), true
+}
+
+// artifactCopyInfos pulls the files of the OCI artifact ref to a temporary
+// directory, and returns the copy info of that directory. The caller removes
+// the directory once the files are copied.
+func (b *Builder) artifactCopyInfos(ref string) (copyInfo, error) {
+	if _, err := reference.ParseNormalizedNamed(ref); err != nil {
+		return copyInfo{}, errors.Wrapf(err, "invalid OCI artifact reference %s", ref)
+	}
+	backend, ok := b.docker.(builder.ArtifactBackend)
+	if !ok {
+		return copyInfo{}, errors.Errorf("ADD %s%s: the daemon doesn't support pulling OCI artifacts", ociArtifactScheme, ref)
+	}
+
+	tmpDir, err := ioutils.TempDir("", "docker-artifact")
+	if err != nil {
+		return copyInfo{}, err
+	}
+	if err := backend.PullArtifactOnBuild(b.clientCtx, ref, b.options.AuthConfigs, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return copyInfo{}, errors.Wrapf(err, "failed to pull OCI artifact %s", ref)
+	}
+
+	context, err := remotecontext.NewLazyContext(tmpDir)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return copyInfo{}, err
+	}
+	statPath, fi, err := context.Stat(".")
+	if err == nil {
+		var hash string
+		if hash, err = dirContentHash(context, statPath); err == nil {
+			fi.(builder.Hashed).SetHash("dir:" + hash)
+		}
 	}
-
-	return b.commit(container.ID, cmd, comment)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return copyInfo{}, errors.Wrapf(err, "failed to read OCI artifact %s", ref)
+	}
+	return copyInfo{FileInfo: fi, contextPath: statPath, namedPath: statPath}, nil
 }
 
 func (b *Builder) download(srcURL string) (fi builder.FileInfo, err error) {
@@ -222,11 +934,22 @@ func (b *Builder) download(srcURL string) (fi builder.FileInfo, err error) {
 		return
 	}
 
-	// Initiate the download
-	resp, err := httputils.Download(srcURL)
+	// Initiate the download, unless the copy from a previous build is still
+	// valid
+	resp, cached, err := b.downloadCache.fetch(srcURL)
 	if err != nil {
 		return
 	}
+	body, contentLength, lastMod := resp.Body, resp.ContentLength, resp.Header.Get("Last-Modified")
+	if cached != nil {
+		resp.Body.Close()
+		if body, err = os.Open(cached.path); err != nil {
+			return
+		}
+		contentLength, lastMod = cached.size, cached.lastModified
+		fmt.Fprintf(b.Stdout, " ---> Using cached download of %s\n", srcURL)
+	}
+	defer body.Close()
 
 	// Prepare file in a tmp dir
 	tmpDir, err := ioutils.TempDir("", "docker-remote")
@@ -246,7 +969,7 @@ func (b *Builder) download(srcURL string) (fi builder.FileInfo, err error) {
 
 	stdoutFormatter := b.Stdout.(*streamformatter.StdoutFormatter)
 	progressOutput := stdoutFormatter.StreamFormatter.NewProgressOutput(stdoutFormatter.Writer, true)
-	progressReader := progress.NewProgressReader(resp.Body, progressOutput, resp.ContentLength, "", "Downloading")
+	progressReader := progress.NewProgressReader(body, progressOutput, contentLength, "", "Downloading")
 	// Download and dump result to tmp file
 	if _, err = io.Copy(tmpFile, progressReader); err != nil {
 		tmpFile.Close()
@@ -264,7 +987,6 @@ func (b *Builder) download(srcURL string) (fi builder.FileInfo, err error) {
 	// Otherwise just remove atime and mtime
 	mTime := time.Time{}
 
-	lastMod := resp.Header.Get("Last-Modified")
 	if lastMod != "" {
 		// If we can't parse it then just let it default to 'zero'
 		// otherwise use the parsed time value
@@ -279,6 +1001,12 @@ func (b *Builder) download(srcURL string) (fi builder.FileInfo, err error) {
 		return
 	}
 
+	if cached == nil {
+		if err := b.downloadCache.store(srcURL, resp.Header, tmpFileName); err != nil {
+			logrus.Warnf("failed to cache download of %s: %v", srcURL, err)
+		}
+	}
+
 	// Calc the checksum, even if we're using the cache
 	r, err := archive.Tar(tmpFileName, archive.Uncompressed)
 	if err != nil {
@@ -296,6 +1024,494 @@ func (b *Builder) download(srcURL string) (fi builder.FileInfo, err error) {
 	return &builder.HashedFileInfo{FileInfo: builder.PathFileInfo{FileInfo: tmpFileSt, FilePath: tmpFileName}, FileHash: hash}, nil
 }
 
+// defaultDownloadCacheSize is the size the downloadCache keeps its files
+// under, by removing the least recently used ones.
+const defaultDownloadCacheSize = 1 << 30
+
+// downloadCache keeps the remote files downloaded by ADD along with their
+// ETag and Last-Modified headers, so that a file is only downloaded again
+// when it changed on the server.
+type downloadCache struct {
+	mu    sync.Mutex
+	dir   string
+	items map[string]cachedDownload
+	// maxSize is the total size of the cached files, defaultDownloadCacheSize
+	// if zero
+	maxSize int64
+}
+
+type cachedDownload struct {
+	path         string
+	size         int64
+	etag         string
+	lastModified string
+	lastUsed     time.Time
+}
+
+// fetch requests srcURL, conditionally on the cached copy if there is one.
+// When the server replies that the cached copy is still valid, it is returned
+// along with the response. A nil cache always downloads srcURL.
+func (c *downloadCache) fetch(srcURL string) (*http.Response, *cachedDownload, error) {
+	if c == nil {
+		resp, err := httputils.Download(srcURL)
+		return resp, nil, err
+	}
+
+	header := http.Header{}
+	c.mu.Lock()
+	cached, ok := c.items[srcURL]
+	c.mu.Unlock()
+	if ok {
+		if cached.etag != "" {
+			header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := httputils.DownloadWithHeader(srcURL, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusNotModified {
+		return resp, nil, nil
+	}
+	if !ok {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("Got unexpected HTTP status code: %s", resp.Status)
+	}
+	c.mu.Lock()
+	if item, ok := c.items[srcURL]; ok && item.path == cached.path {
+		item.lastUsed = time.Now()
+		c.items[srcURL] = item
+	}
+	c.mu.Unlock()
+	return resp, &cached, nil
+}
+
+// store keeps a copy of the file downloaded from srcURL if the server sent
+// the headers needed to validate it later. The copy replaces the previous
+// one atomically, as other builds may be reading it.
+func (c *downloadCache) store(srcURL string, header http.Header, path string) error {
+	if c == nil {
+		return nil
+	}
+	etag, lastModified := header.Get("ETag"), header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	if c.dir == "" {
+		dir, err := ioutils.TempDir("", "docker-download-cache")
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		c.dir = dir
+	}
+	dir := c.dir
+	c.mu.Unlock()
+
+	tmpFile, err := ioutil.TempFile(dir, ".download")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	if err := copyFile(path, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	fi, err := os.Stat(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(srcURL))
+	cachePath := filepath.Join(dir, hex.EncodeToString(sum[:]))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if c.items == nil {
+		c.items = make(map[string]cachedDownload)
+	}
+	c.items[srcURL] = cachedDownload{path: cachePath, size: fi.Size(), etag: etag, lastModified: lastModified, lastUsed: time.Now()}
+	c.evict(srcURL)
+	return nil
+}
+
+// evict removes the least recently used files until the cached files fit in
+// the maximum size of the cache, other than the one of keep. It must be
+// called with the lock held.
+func (c *downloadCache) evict(keep string) {
+	maxSize := c.maxSize
+	if maxSize <= 0 {
+		maxSize = defaultDownloadCacheSize
+	}
+	var size int64
+	urls := make([]string, 0, len(c.items))
+	for srcURL, item := range c.items {
+		size += item.size
+		if srcURL != keep {
+			urls = append(urls, srcURL)
+		}
+	}
+	sort.Slice(urls, func(i, j int) bool { return c.items[urls[i]].lastUsed.Before(c.items[urls[j]].lastUsed) })
+	for _, srcURL := range urls {
+		if size <= maxSize {
+			return
+		}
+		item := c.items[srcURL]
+		// builds still reading the file keep it open until they are done
+		if err := os.Remove(item.path); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("failed to remove cached download of %s: %v", srcURL, err)
+			continue
+		}
+		delete(c.items, srcURL)
+		size -= item.size
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyFileOptions holds the modifications ADD and COPY apply to the source
+// files before they are copied into the container.
+type copyFileOptions struct {
+	// normalizePerms resets modes to 0644 for files, and to 0755 for
+	// directories and executable files.
+	normalizePerms bool
+	// chmod, if set, is the mode of all the copied files and directories.
+	chmod *os.FileMode
+	// chmodDir, if set, is the mode of the copied directories instead of
+	// chmod, usually to keep them searchable.
+	chmodDir *os.FileMode
+	// ignore, if set, excludes the files it matches from the copy, with the
+	// patterns of ignoreFile.
+	ignore     *fileutils.PatternMatcher
+	ignoreFile string
+	// followSymlinks, if set, makes the copy follow all the symlinks of the
+	// sources when true, and preserve them, including the sources named by
+	// a symlink, when false. By default the sources named by a symlink are
+	// followed, and the symlinks below them are preserved.
+	followSymlinks *bool
+	// timestamp, if set, is the access and modification time of the copied
+	// files, instead of the SOURCE_DATE_EPOCH build arg.
+	timestamp *time.Time
+	// rename copies a single file source to the destination as its new
+	// name, see checkRename.
+	rename bool
+	// selinuxLabel, if set, is the SELinux context of the copied files,
+	// which the backend sets when they are copied.
+	selinuxLabel string
+}
+
+// copyTimestamp returns the time the copied files are set to, if any.
+func (b *Builder) copyTimestamp(fileOpts copyFileOptions) *time.Time {
+	if fileOpts.timestamp != nil {
+		return fileOpts.timestamp
+	}
+	return b.sourceDateEpoch
+}
+
+// followsSymlinks returns whether the symlinks below the sources are
+// replaced with the content they point to.
+func (o copyFileOptions) followsSymlinks() bool {
+	return o.followSymlinks != nil && *o.followSymlinks
+}
+
+// preservesSymlinks returns whether the sources named by a symlink are
+// copied as a symlink.
+func (o copyFileOptions) preservesSymlinks() bool {
+	return o.followSymlinks != nil && !*o.followSymlinks
+}
+
+// isIgnored returns whether the file at rel below the source info is
+// excluded from the copy.
+func (o copyFileOptions) isIgnored(info copyInfo, rel string) (bool, error) {
+	if o.ignore == nil || info.contextPath == "" {
+		return false, nil
+	}
+	return o.ignore.Matches(filepath.Join(info.contextPath, rel))
+}
+
+// needsStaging returns true if the source files have to be staged in a
+// temporary directory to apply the copy options, the copy transformers or
+// the SOURCE_DATE_EPOCH timestamp, or to exclude ignored files.
+func (b *Builder) needsStaging(fileOpts copyFileOptions) bool {
+	return len(b.options.CopyTransformers) > 0 || fileOpts.normalizePerms || fileOpts.chmod != nil || fileOpts.chmodDir != nil || fileOpts.ignore != nil || fileOpts.followSymlinks != nil || b.copyTimestamp(fileOpts) != nil
+}
+
+// stageCopyInfos copies every source file below tmpDir, running its content
+// through the configured copy transformers and applying fileOpts. The
+// returned copyInfos point at the staged files and are hashed from their new
+// content and modes, so that the cache key reflects the modifications.
+func (b *Builder) stageCopyInfos(infos []copyInfo, tmpDir string, fileOpts copyFileOptions) ([]copyInfo, error) {
+	staged := make([]copyInfo, 0, len(infos))
+	for i, info := range infos {
+		fi := info.FileInfo
+		ignored, err := fileOpts.isIgnored(info, ".")
+		if err != nil {
+			return nil, err
+		}
+		if ignored && (!fi.IsDir() || !fileOpts.ignore.Exclusions()) {
+			continue
+		}
+		dest := filepath.Join(tmpDir, strconv.Itoa(i), fi.Name())
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return nil, err
+		}
+
+		link, isLink := "", false
+		if fileOpts.preservesSymlinks() {
+			if link, isLink, err = info.namedLink(); err != nil {
+				return nil, err
+			}
+		}
+		if isLink {
+			err = os.Symlink(link, dest)
+		} else {
+			following := map[string]bool{fi.Path(): true}
+			err = b.stageTree(info, fi.Path(), ".", dest, fileOpts, following)
+		}
+		if err != nil {
+			return nil, err
+		}
+		timestamp := b.copyTimestamp(fileOpts)
+		if timestamp != nil {
+			if err := setTimes(dest, *timestamp); err != nil {
+				return nil, err
+			}
+		}
+
+		st, err := os.Lstat(dest)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := hashPath(dest)
+		if err != nil {
+			return nil, err
+		}
+		if timestamp != nil {
+			// the hash of the files doesn't include their times
+			hash += fmt.Sprintf(";timestamp=%d", timestamp.Unix())
+		}
+		staged = append(staged, copyInfo{
+			FileInfo: &builder.HashedFileInfo{
+				FileInfo: builder.PathFileInfo{FileInfo: st, FilePath: dest, FileName: fi.Name()},
+				FileHash: "staged:" + hash,
+			},
+			decompress: info.decompress,
+		})
+	}
+	return staged, nil
+}
+
+// stageTree stages the tree at src, which is at base below the source info,
+// to dest. The symlinks to directories are walked when fileOpts follows
+// symlinks, following holds the directories being walked to detect loops.
+func (b *Builder) stageTree(info copyInfo, src, base, dest string, fileOpts copyFileOptions, following map[string]bool) error {
+	return filepath.Walk(src, func(path string, st os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.Join(base, rel)
+		if rel != "." {
+			ignored, err := fileOpts.isIgnored(info, rel)
+			if err != nil {
+				return err
+			}
+			// the content of an ignored directory is only walked when
+			// some patterns exclude files from being ignored
+			if ignored && !st.IsDir() {
+				return nil
+			}
+			if ignored && !fileOpts.ignore.Exclusions() {
+				return filepath.SkipDir
+			}
+		}
+		target := filepath.Join(dest, rel)
+		name := filepath.ToSlash(filepath.Join(info.Name(), rel))
+
+		if st.Mode()&os.ModeSymlink != 0 {
+			if !fileOpts.followsSymlinks() {
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				return os.Symlink(link, target)
+			}
+			resolved, err := symlink.FollowSymlinkInScope(path, info.contextRoot())
+			if err != nil {
+				return err
+			}
+			if st, err = os.Stat(resolved); err != nil {
+				return errors.Wrapf(err, "failed to follow symlink %s", name)
+			}
+			if st.IsDir() {
+				if following[resolved] {
+					return errors.Errorf("failed to follow symlink %s, it loops back to a parent directory", name)
+				}
+				following[resolved] = true
+				defer delete(following, resolved)
+				return b.stageTree(info, resolved, rel, dest, fileOpts, following)
+			}
+			path = resolved
+		}
+
+		perm := st.Mode().Perm()
+		if fileOpts.normalizePerms {
+			perm = normalizedPerm(st)
+		}
+		if fileOpts.chmod != nil {
+			perm = *fileOpts.chmod
+		}
+		if st.IsDir() && fileOpts.chmodDir != nil {
+			perm = *fileOpts.chmodDir
+		}
+		if st.IsDir() {
+			if err := os.MkdirAll(target, perm); err != nil {
+				return err
+			}
+		} else if err := b.stageFile(name, path, target, perm); err != nil {
+			return err
+		}
+		// the modes passed on creation are subject to the umask
+		return os.Chmod(target, perm)
+	})
+}
+
+// setTimes sets the access and modification times of path and of everything
+// below it to t. Directories are updated after their content, as creating
+// their entries changed their modification time.
+func setTimes(path string, t time.Time) error {
+	var paths []string
+	var links []bool
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+		links = append(links, fi.Mode()&os.ModeSymlink != 0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		// system.Chtimes doesn't support a NOFOLLOW flag atm
+		if !links[i] {
+			if err := system.Chtimes(paths[i], t, t); err != nil {
+				return err
+			}
+			continue
+		}
+		ts := []syscall.Timespec{syscall.NsecToTimespec(t.UnixNano()), syscall.NsecToTimespec(t.UnixNano())}
+		if err := system.LUtimesNano(paths[i], ts); err != nil && err != system.ErrNotSupportedPlatform {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizedPerm returns 0755 for directories and files with any executable
+// bit set, and 0644 for all other files.
+func normalizedPerm(fi os.FileInfo) os.FileMode {
+	if fi.IsDir() || fi.Mode().Perm()&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// stageFile writes the content of src to dest after passing it through
+// each copy transformer in order.
+func (b *Builder) stageFile(name, src, dest string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	for _, transform := range b.options.CopyTransformers {
+		if r, err = transform(name, r); err != nil {
+			return errors.Wrapf(err, "failed to transform %s", name)
+		}
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// hashPath returns a cache key for the file or directory at path, computed
+// the same way as for files read from a lazy build context.
+func hashPath(path string) (string, error) {
+	var sums []string
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		h, err := remotecontext.NewFileHash(p, rel, fi)
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		sums = append(sums, hex.EncodeToString(h.Sum(nil)))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(sums)
+	hasher := sha256.New()
+	hasher.Write([]byte(strings.Join(sums, ",")))
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 var windowsBlacklist = map[string]bool{
 	"c:\\":        true,
 	"c:\\windows": true,
@@ -376,7 +1592,7 @@ func (b *Builder) calcCopyInfo(cmdName, origPath string, allowLocalDecompression
 		return nil, err
 	}
 
-	copyInfos := []copyInfo{{FileInfo: fi, decompress: allowLocalDecompression}}
+	copyInfos := []copyInfo{{FileInfo: fi, decompress: allowLocalDecompression, contextPath: statPath, namedPath: origPath}}
 
 	hfi, handleHash := fi.(builder.Hashed)
 	if !handleHash {
@@ -396,33 +1612,57 @@ func (b *Builder) calcCopyInfo(cmdName, origPath string, allowLocalDecompression
 		return copyInfos, nil
 	}
 	// Must be a dir
+	hash, err := dirContentHash(context, statPath)
+	if err != nil {
+		return nil, err
+	}
+	hfi.SetHash("dir:" + hash)
+	if imageSource != nil {
+		b.imageContexts.setCache(imageSource.id, origPath, hfi.Hash())
+	}
+
+	return copyInfos, nil
+}
+
+// dirContentHash returns the hash of the files below the directory root of
+// context. It combines the hashes the context already has for the files, by
+// their path relative to root, so that the hash of a directory only changes
+// with what is copied from it.
+func dirContentHash(context builder.Context, root string) (string, error) {
 	var subfiles []string
-	err = context.Walk(statPath, func(path string, info builder.FileInfo, err error) error {
+	err := context.Walk(root, func(path string, info builder.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
 		if err != nil {
 			return err
 		}
-		// we already checked handleHash above
-		subfiles = append(subfiles, info.(builder.Hashed).Hash())
+		hashed, ok := info.(builder.Hashed)
+		if !ok {
+			return errors.Errorf("the build context has no hash for %s", path)
+		}
+		subfiles = append(subfiles, filepath.ToSlash(rel)+":"+hashed.Hash())
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	sort.Strings(subfiles)
 	hasher := sha256.New()
 	hasher.Write([]byte(strings.Join(subfiles, ",")))
-	hfi.SetHash("dir:" + hex.EncodeToString(hasher.Sum(nil)))
-	if imageSource != nil {
-		b.imageContexts.setCache(imageSource.id, origPath, hfi.Hash())
-	}
-
-	return copyInfos, nil
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 func (b *Builder) processImageFrom(img builder.Image) error {
+	b.layers = 0
 	if img != nil {
 		b.image = img.ImageID()
+		if li, ok := img.(builder.LayeredImage); ok {
+			b.layers = li.Layers()
+		}
+		b.imageContexts.setLayers(b.layers)
 
 		if img.RunConfig() != nil {
 			b.runConfig = img.RunConfig()
@@ -445,6 +1685,9 @@ func (b *Builder) processImageFrom(img builder.Image) error {
 
 	// Process ONBUILD triggers if they exist
 	if nTriggers := len(b.runConfig.OnBuild); nTriggers != 0 {
+		if max := b.maxOnBuildTriggers(); max > 0 && nTriggers > max {
+			return errors.Errorf("base image has %d ONBUILD triggers, the maximum is %d", nTriggers, max)
+		}
 		word := "trigger"
 		if nTriggers > 1 {
 			word = "triggers"
@@ -494,7 +1737,7 @@ func (b *Builder) processImageFrom(img builder.Image) error {
 // If there is any error, it returns `(false, err)`.
 func (b *Builder) probeCache() (bool, error) {
 	c := b.imageCache
-	if c == nil || b.options.NoCache || b.cacheBusted {
+	if c == nil || b.options.NoCache || b.cacheBusted || b.skipCacheOnce {
 		return false, nil
 	}
 	cache, err := c.GetCache(b.image, b.runConfig)
@@ -507,6 +1750,7 @@ func (b *Builder) probeCache() (bool, error) {
 		return false, nil
 	}
 
+	b.cacheHit = true
 	fmt.Fprint(b.Stdout, " ---> Using cache\n")
 	logrus.Debugf("[BUILDER] Use cached version: %s", b.runConfig.Cmd)
 	b.image = string(cache)
@@ -515,12 +1759,20 @@ func (b *Builder) probeCache() (bool, error) {
 	return true, nil
 }
 
-func (b *Builder) create() (string, error) {
-	if !b.hasFromImage() {
-		return "", errors.New("Please provide a source image with `from` prior to run")
+// cacheCmd folds the cache namespace of the build, if any, into the command
+// used for cache lookups, so that builds in different namespaces never share
+// cached layers. Like the build-time env vars, it is prefixed with "|" to
+// avoid conflicts with the command itself.
+func (b *Builder) cacheCmd(cmd strslice.StrSlice) strslice.StrSlice {
+	if b.options.CacheNamespace == "" {
+		return cmd
 	}
-	b.runConfig.Image = b.image
+	return strslice.StrSlice(append([]string{"|cache-namespace=" + b.options.CacheNamespace}, cmd...))
+}
 
+// hostConfig returns the host config used for the containers created during
+// the build, derived from the build options.
+func (b *Builder) hostConfig() *container.HostConfig {
 	resources := container.Resources{
 		CgroupParent: b.options.CgroupParent,
 		CPUShares:    b.options.CPUShares,
@@ -534,7 +1786,7 @@ func (b *Builder) create() (string, error) {
 	}
 
 	// TODO: why not embed a hostconfig in builder?
-	hostConfig := &container.HostConfig{
+	return &container.HostConfig{
 		SecurityOpt: b.options.SecurityOpt,
 		Isolation:   b.options.Isolation,
 		ShmSize:     b.options.ShmSize,
@@ -544,6 +1796,13 @@ func (b *Builder) create() (string, error) {
 		LogConfig:  defaultLogConfig,
 		ExtraHosts: b.options.ExtraHosts,
 	}
+}
+
+func (b *Builder) create(hostConfig *container.HostConfig) (string, error) {
+	if !b.hasFromImage() {
+		return "", errors.New("Please provide a source image with `from` prior to run")
+	}
+	b.runConfig.Image = b.image
 
 	config := *b.runConfig
 
@@ -572,12 +1831,66 @@ func (b *Builder) create() (string, error) {
 
 var errCancelled = errors.New("build cancelled")
 
-func (b *Builder) run(cID string) (err error) {
+// stopSignal returns the STOPSIGNAL of the image as a number, or 0 to kill
+// the container if there is none.
+func (b *Builder) stopSignal() uint64 {
+	if b.runConfig.StopSignal == "" {
+		return 0
+	}
+	sig, err := signal.ParseSignal(b.runConfig.StopSignal)
+	if err != nil {
+		return 0
+	}
+	return uint64(sig)
+}
+
+// lockedBuffer is a buffer which can be written to concurrently, to capture
+// the stdout and stderr of a container together.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Bytes returns the content written to the buffer.
+func (b *lockedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
+
+// runTimeoutKillDelay is how long a container which timed out is given to
+// exit after receiving its stop signal, before it is killed.
+var runTimeoutKillDelay = 10 * time.Second
+
+// run starts the container cID and waits for it to exit. A non-zero timeout
+// bounds how long the container runs: on expiry it is sent its stop signal,
+// then killed if it doesn't exit, and run returns a timeout error. When output
+// is not nil, the stdout and stderr of the container are also written to it.
+func (b *Builder) run(cID string, timeout time.Duration, output *lockedBuffer) (err error) {
+	stdout, stderr := b.Stdout, b.Stderr
+	if output != nil {
+		stdout, stderr = io.MultiWriter(stdout, output), io.MultiWriter(stderr, output)
+	}
 	errCh := make(chan error)
 	go func() {
-		errCh <- b.docker.ContainerAttachRaw(cID, nil, b.Stdout, b.Stderr, true)
+		errCh <- b.docker.ContainerAttachRaw(cID, nil, stdout, stderr, true)
 	}()
 
+	var timeoutCh <-chan time.Time
+	var errTimeout error
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+		errTimeout = fmt.Errorf("The command '%s' did not complete within %s", strings.Join(b.runConfig.Cmd, " "), timeout)
+	}
+
 	finished := make(chan struct{})
 	cancelErrCh := make(chan error, 1)
 	go func() {
@@ -587,6 +1900,15 @@ func (b *Builder) run(cID string) (err error) {
 			b.docker.ContainerKill(cID, 0)
 			b.removeContainer(cID)
 			cancelErrCh <- errCancelled
+		case <-timeoutCh:
+			logrus.Debugln("Command timed out, stopping container:", cID)
+			b.docker.ContainerKill(cID, b.stopSignal())
+			select {
+			case <-finished:
+			case <-time.After(runTimeoutKillDelay):
+				b.docker.ContainerKill(cID, 0)
+			}
+			cancelErrCh <- errTimeout
 		case <-finished:
 			cancelErrCh <- nil
 		}
@@ -614,6 +1936,9 @@ func (b *Builder) run(cID string) (err error) {
 	if ret, _ := b.docker.ContainerWait(cID, -1); ret != 0 {
 		close(finished)
 		if cancelErr := <-cancelErrCh; cancelErr != nil {
+			if cancelErr == errTimeout {
+				return cancelErr
+			}
 			logrus.Debugf("Build cancelled (%v) and got a non-zero code from ContainerWait: %d",
 				cancelErr, ret)
 		}
@@ -1,14 +1,32 @@
 package dockerfile
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/backend"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/docker/docker/builder/remotecontext"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 )
 
 func TestEmptyDockerfile(t *testing.T) {
@@ -81,3 +99,1040 @@ func readAndCheckDockerfile(t *testing.T, testName, contextDir, dockerfilePath,
 	_, err = b.readAndParseDockerfile()
 	assert.EqualError(t, err, expectedError)
 }
+
+func TestCopyTransformers(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+
+	createTestTempFile(t, contextDir, "hello.txt", "hello", 0644)
+	createTestTempFile(t, contextDir, "hello.bin", "hello", 0644)
+
+	context, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	upper := func(path string, content io.Reader) (io.Reader, error) {
+		if !strings.HasSuffix(path, ".txt") {
+			return content, nil
+		}
+		data, err := ioutil.ReadAll(content)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(bytes.ToUpper(data)), nil
+	}
+
+	copied := map[string]string{}
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = context
+	b.options.CopyTransformers = append(b.options.CopyTransformers, upper)
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		data, err := ioutil.ReadFile(src.Path())
+		if err != nil {
+			return err
+		}
+		copied[src.Name()] = string(data)
+		return nil
+	}
+
+	err = b.runContextCommand([]string{"hello.txt", "hello.bin", "/dest/"}, false, false, "COPY", nil, copyFileOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"hello.txt": "HELLO", "hello.bin": "hello"}, copied)
+}
+
+func TestCopyNormalizePerms(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+
+	srcDir := filepath.Join(contextDir, "src")
+	require.NoError(t, os.Mkdir(srcDir, 0700))
+	require.NoError(t, os.Chmod(srcDir, 0700))
+	createTestTempFile(t, srcDir, "run.sh", "#!/bin/sh", 0700)
+	createTestTempFile(t, srcDir, "secret.txt", "secret", 0600)
+	createTestTempFile(t, srcDir, "shared.txt", "shared", 0666)
+
+	context, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	modes := map[string]os.FileMode{}
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = context
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		return filepath.Walk(src.Path(), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src.Path(), path)
+			if err != nil {
+				return err
+			}
+			modes[filepath.ToSlash(rel)] = fi.Mode().Perm()
+			return nil
+		})
+	}
+
+	err = b.runContextCommand([]string{"src", "/dest/"}, false, false, "COPY", nil, copyFileOptions{normalizePerms: true})
+	require.NoError(t, err)
+
+	expected := map[string]os.FileMode{
+		".":          0755,
+		"run.sh":     0755,
+		"secret.txt": 0644,
+		"shared.txt": 0644,
+	}
+	assert.Equal(t, expected, modes)
+}
+
+func TestCopyChmodDir(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+
+	srcDir := filepath.Join(contextDir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "conf.d"), 0700))
+	require.NoError(t, os.Chmod(srcDir, 0700))
+	require.NoError(t, os.Chmod(filepath.Join(srcDir, "conf.d"), 0700))
+	createTestTempFile(t, srcDir, "app.conf", "debug = false", 0600)
+	createTestTempFile(t, filepath.Join(srcDir, "conf.d"), "log.conf", "level = info", 0700)
+
+	context, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		flags    []string
+		expected map[string]os.FileMode
+		err      string
+	}{
+		{
+			flags:    []string{"--chmod=0644", "--chmod-dir=0755"},
+			expected: map[string]os.FileMode{".": 0755, "app.conf": 0644, "conf.d": 0755, "conf.d/log.conf": 0644},
+		},
+		{
+			flags:    []string{"--chmod-dir=0750"},
+			expected: map[string]os.FileMode{".": 0750, "app.conf": 0600, "conf.d": 0750, "conf.d/log.conf": 0700},
+		},
+		{
+			flags:    []string{"--chmod=0640"},
+			expected: map[string]os.FileMode{".": 0640, "app.conf": 0640, "conf.d": 0640, "conf.d/log.conf": 0640},
+		},
+		{flags: []string{"--chmod=0644", "--chmod-dir=a+X"}, err: `Invalid --chmod-dir "a+X" for COPY, must be an octal mode such as 0755`},
+		{flags: []string{"--chmod-dir=10000"}, err: `Invalid --chmod-dir "10000" for COPY, must be an octal mode such as 0755`},
+	}
+	for _, testCase := range testCases {
+		modes := map[string]os.FileMode{}
+		b := newBuilderWithMockBackend()
+		b.disableCommit = true
+		b.context = context
+		b.flags.Args = testCase.flags
+		b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+			return filepath.Walk(src.Path(), func(path string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(src.Path(), path)
+				if err != nil {
+					return err
+				}
+				modes[filepath.ToSlash(rel)] = fi.Mode().Perm()
+				return nil
+			})
+		}
+
+		err := dispatchCopy(b, []string{"src", "/dest/"}, nil, "")
+		if testCase.err != "" {
+			assert.EqualError(t, err, testCase.err)
+			continue
+		}
+		require.NoError(t, err, "%v", testCase.flags)
+		assert.Equal(t, testCase.expected, modes, "%v", testCase.flags)
+	}
+}
+
+func TestCopySELinuxLabel(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "app.conf", "debug=false", 0644)
+
+	context, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	const fileLabel = "system_u:object_r:container_file_t:s0:c1,c2"
+	testCases := []struct {
+		cmdName        string
+		flags          []string
+		selinuxEnabled bool
+		copied         string
+		cacheName      string
+		warning        string
+		err            string
+	}{
+		{cmdName: "COPY", selinuxEnabled: true, copied: "root", cacheName: "COPY"},
+		{cmdName: "COPY", flags: []string{"--selinux-label=" + fileLabel}, selinuxEnabled: true, copied: fileLabel, cacheName: "COPY --selinux-label=" + fileLabel},
+		{cmdName: "ADD", flags: []string{"--selinux-label=" + fileLabel}, selinuxEnabled: true, copied: fileLabel, cacheName: "ADD --selinux-label=" + fileLabel},
+		{
+			cmdName:   "COPY",
+			flags:     []string{"--selinux-label=" + fileLabel},
+			copied:    "root",
+			cacheName: "COPY",
+			warning:   "[Warning] COPY --selinux-label=" + fileLabel + " is ignored, SELinux is not enabled for this builder\n",
+		},
+		{cmdName: "COPY", flags: []string{"--selinux-label=container_file_t"}, err: `Invalid --selinux-label "container_file_t" for COPY, must be an SELinux context such as system_u:object_r:container_file_t:s0`},
+		{cmdName: "ADD", flags: []string{"--selinux-label=system_u:object_r: container_file_t"}, err: `Invalid --selinux-label "system_u:object_r: container_file_t" for ADD, must be an SELinux context such as system_u:object_r:container_file_t:s0`},
+	}
+	for _, tc := range testCases {
+		var copied []string
+		var stdout bytes.Buffer
+		b := newBuilderWithMockBackend()
+		b.disableCommit = true
+		b.context = context
+		b.Stdout = &stdout
+		b.flags.Args = tc.flags
+		cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+		b.imageCache = cache
+		mockBackend := b.docker.(*MockBackend)
+		mockBackend.selinuxEnabled = tc.selinuxEnabled
+		mockBackend.copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+			copied = append(copied, "root")
+			return nil
+		}
+		mockBackend.copyWithLabelFunc = func(containerID string, destPath string, src builder.FileInfo, uid, gid int, label string) error {
+			assert.Equal(t, 0, uid)
+			assert.Equal(t, 0, gid)
+			copied = append(copied, label)
+			return nil
+		}
+
+		dispatcher := dispatchCopy
+		if tc.cmdName == "ADD" {
+			dispatcher = add
+		}
+		err := dispatcher(b, []string{"app.conf", "/app/"}, nil, "")
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+			continue
+		}
+		require.NoError(t, err, "%v", tc.flags)
+		assert.Equal(t, []string{tc.copied}, copied, "%v", tc.flags)
+		assert.Equal(t, tc.warning, stdout.String(), "%v", tc.flags)
+		require.Len(t, cache.keys, 1)
+		for key := range cache.keys {
+			assert.Contains(t, key, "#(nop) "+tc.cacheName+" file:", "%v", tc.flags)
+		}
+	}
+}
+
+func TestCopySourceDateEpoch(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+
+	srcDir := filepath.Join(contextDir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "lib"), 0755))
+	createTestTempFile(t, srcDir, "main.go", "package main", 0644)
+	createTestTempFile(t, filepath.Join(srcDir, "lib"), "lib.go", "package lib", 0644)
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	epoch := "1500000000"
+	b, err := NewBuilder(context.Background(), &types.ImageBuildOptions{BuildArgs: map[string]*string{"SOURCE_DATE_EPOCH": &epoch}}, &MockBackend{}, buildContext)
+	require.NoError(t, err)
+	b.disableCommit = true
+	assert.Empty(t, b.buildArgs.UnreferencedOptionArgs())
+
+	mtimes := map[string]int64{}
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		return filepath.Walk(src.Path(), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src.Path(), path)
+			if err != nil {
+				return err
+			}
+			mtimes[filepath.ToSlash(rel)] = fi.ModTime().Unix()
+			return nil
+		})
+	}
+
+	err = b.runContextCommand([]string{"src", "/dest/"}, false, false, "COPY", nil, copyFileOptions{})
+	require.NoError(t, err)
+
+	expected := map[string]int64{
+		".":          1500000000,
+		"main.go":    1500000000,
+		"lib":        1500000000,
+		"lib/lib.go": 1500000000,
+	}
+	assert.Equal(t, expected, mtimes)
+
+	epoch = "yesterday"
+	_, err = NewBuilder(context.Background(), &types.ImageBuildOptions{BuildArgs: map[string]*string{"SOURCE_DATE_EPOCH": &epoch}}, &MockBackend{}, buildContext)
+	assert.EqualError(t, err, `invalid SOURCE_DATE_EPOCH "yesterday", must be an integer number of seconds since the Unix epoch`)
+}
+
+func TestCopySourceDateEpochCache(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "main.go", "package main", 0644)
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	copyCached := func(epoch string) bool {
+		b, err := NewBuilder(context.Background(), &types.ImageBuildOptions{BuildArgs: map[string]*string{"SOURCE_DATE_EPOCH": &epoch}}, &MockBackend{}, buildContext)
+		require.NoError(t, err)
+		b.disableCommit = true
+		b.Stdout = ioutil.Discard
+		b.image = "baseimage"
+		b.imageCache = cache
+		b.imageContexts.add("")
+		require.NoError(t, b.runContextCommand([]string{"main.go", "/app/"}, false, false, "COPY", nil, copyFileOptions{}))
+		return b.cacheHit
+	}
+
+	assert.False(t, copyCached("1500000000"))
+	assert.True(t, copyCached("1500000000"))
+	// the files of the cached layer have the times of the previous epoch
+	assert.False(t, copyCached("1600000000"))
+}
+
+func TestCopyTimestamp(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "main.go", "package main", 0644)
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	var mtime int64
+	var cacheCmds []string
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = buildContext
+	b.docker.(*MockBackend).containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		cacheCmds = append(cacheCmds, strings.Join(config.Config.Cmd, " "))
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		st, err := os.Stat(src.Path())
+		if err != nil {
+			return err
+		}
+		mtime = st.ModTime().Unix()
+		return nil
+	}
+	copyWithTimestamp := func(timestamp string) error {
+		b.flags = NewBFlags()
+		b.flags.Args = []string{"--timestamp=" + timestamp}
+		return dispatchCopy(b, []string{"main.go", "/app/"}, nil, "")
+	}
+
+	require.NoError(t, copyWithTimestamp("1500000000"))
+	assert.Equal(t, int64(1500000000), mtime)
+
+	require.NoError(t, copyWithTimestamp("2017-07-14T02:40:00Z"))
+	assert.Equal(t, int64(1500000000), mtime)
+
+	require.NoError(t, copyWithTimestamp("2020-01-01T00:00:00+01:00"))
+	assert.Equal(t, int64(1577833200), mtime)
+
+	require.Len(t, cacheCmds, 3)
+	assert.Equal(t, cacheCmds[0], cacheCmds[1])
+	assert.NotEqual(t, cacheCmds[0], cacheCmds[2])
+
+	err = copyWithTimestamp("yesterday")
+	assert.EqualError(t, err, `Invalid --timestamp "yesterday" for COPY, must be an RFC 3339 date or a number of seconds since the Unix epoch`)
+}
+
+func TestAdditionalContextsResolvedLazily(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "foo", "foo", 0644)
+
+	resolved := map[string]int{}
+	resolver := func(name string) func() (string, error) {
+		return func() (string, error) {
+			resolved[name]++
+			return contextDir, nil
+		}
+	}
+
+	b := newBuilderWithMockBackend()
+	b.options.AdditionalContexts = map[string]func() (string, error){
+		"used":   resolver("used"),
+		"unused": resolver("unused"),
+	}
+
+	for i := 0; i < 2; i++ {
+		im, err := b.imageContexts.get("used")
+		require.NoError(t, err)
+		context, err := im.context()
+		require.NoError(t, err)
+		_, _, err = context.Stat("foo")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, map[string]int{"used": 1}, resolved)
+}
+
+// recordingImageCache is an image cache which records every lookup, so that a
+// later lookup with the same parent and command is a hit.
+type recordingImageCache struct {
+	keys   map[string]string
+	images map[string]struct{}
+}
+
+func (c *recordingImageCache) GetCache(parentID string, cfg *container.Config) (string, error) {
+	key := parentID + " " + strings.Join(cfg.Cmd, " ")
+	if id, ok := c.keys[key]; ok {
+		return id, nil
+	}
+	id := fmt.Sprintf("sha256:%d", len(c.keys))
+	c.keys[key] = id
+	c.images[id] = struct{}{}
+	return "", nil
+}
+
+func TestMaxLayers(t *testing.T) {
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	build := func(maxLayers int) error {
+		result, err := parser.Parse(strings.NewReader("FROM busybox\nRUN make\nENV GOPATH=/go\nRUN make install\n"))
+		require.NoError(t, err)
+
+		b := newBuilderWithMockBackend()
+		b.clientCtx = context.Background()
+		b.Stdout = ioutil.Discard
+		b.options.MaxLayers = maxLayers
+		b.imageCache = cache
+		b.docker.(*MockBackend).getImageOnBuildFunc = func(name string) (builder.Image, error) {
+			return &mockImage{id: "theid", config: &container.Config{}, layers: 2}, nil
+		}
+		b.docker.(*MockBackend).containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+			return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+		}
+		b.docker.(*MockBackend).commitFunc = func(containerID string, config *backend.ContainerCommitConfig) (string, error) {
+			return "sha256:committed", nil
+		}
+		n := result.AST
+		for i, child := range n.Children {
+			if err := b.dispatch(i, len(n.Children), child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	expectedErr := "RUN would add a layer to an image which has 3 layers already, the maximum is 3"
+	assert.EqualError(t, build(3), expectedErr)
+	// the layers used from the cache are counted as well
+	assert.EqualError(t, build(3), expectedErr)
+	assert.NoError(t, build(4))
+	assert.NoError(t, build(0))
+}
+
+func TestMaxLayersFromStage(t *testing.T) {
+	result, err := parser.Parse(strings.NewReader("FROM busybox AS base\nRUN make\nFROM base\nRUN make install\n"))
+	require.NoError(t, err)
+
+	var created []string
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.Stdout = ioutil.Discard
+	b.options.MaxLayers = 3
+	b.docker.(*MockBackend).getImageOnBuildFunc = func(name string) (builder.Image, error) {
+		return &mockImage{id: "theid", config: &container.Config{}, layers: 2}, nil
+	}
+	b.docker.(*MockBackend).containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		created = append(created, strings.Join(config.Config.Cmd, " "))
+		return container.ContainerCreateCreatedBody{ID: "12345"}, nil
+	}
+	b.docker.(*MockBackend).commitFunc = func(containerID string, config *backend.ContainerCommitConfig) (string, error) {
+		return "sha256:committed", nil
+	}
+	n := result.AST
+	for i, child := range n.Children[:len(n.Children)-1] {
+		require.NoError(t, b.dispatch(i, len(n.Children), child))
+	}
+	err = b.dispatch(len(n.Children)-1, len(n.Children), n.Children[len(n.Children)-1])
+	assert.EqualError(t, err, "RUN would add a layer to an image which has 3 layers already, the maximum is 3")
+	// the limit is checked before the container of the instruction is created
+	assert.Equal(t, []string{"/bin/sh -c make"}, created)
+}
+
+func TestCacheNamespace(t *testing.T) {
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	build := func(namespace string) bool {
+		b := newBuilderWithMockBackend()
+		b.options.CacheNamespace = namespace
+		b.imageCache = cache
+		b.Stdout = ioutil.Discard
+		require.NoError(t, from(b, []string{"busybox"}, nil, ""))
+
+		require.NoError(t, workdir(b, []string{"/app"}, nil, ""))
+		_, hit := cache.images[b.image]
+		return hit
+	}
+
+	assert.False(t, build("project-a"))
+	assert.True(t, build("project-a"))
+	assert.False(t, build("project-b"))
+	assert.False(t, build(""))
+	assert.True(t, build(""))
+}
+
+func TestDownloadCacheNotModified(t *testing.T) {
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "remote content")
+	}))
+	defer server.Close()
+
+	cacheDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	c := &downloadCache{dir: cacheDir}
+	srcURL := server.URL + "/file.txt"
+
+	resp, cached, err := c.fetch(srcURL)
+	require.NoError(t, err)
+	assert.Nil(t, cached)
+	content, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	downloaded := createTestTempFile(t, cacheDir, "downloaded", string(content), 0600)
+	require.NoError(t, c.store(srcURL, resp.Header, downloaded))
+
+	resp, cached, err = c.fetch(srcURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotNil(t, cached)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	content, err = ioutil.ReadFile(cached.path)
+	require.NoError(t, err)
+	assert.Equal(t, "remote content", string(content))
+	assert.Equal(t, 1, downloads)
+}
+
+func TestDownloadCacheUnexpectedNotModified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	c := &downloadCache{}
+	_, _, err := c.fetch(server.URL + "/file.txt")
+	assert.EqualError(t, err, "Got unexpected HTTP status code: 304 Not Modified")
+}
+
+func TestDownloadCacheEvict(t *testing.T) {
+	cacheDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	c := &downloadCache{dir: cacheDir, maxSize: 10}
+	header := http.Header{"Etag": []string{`"v1"`}}
+
+	for _, name := range []string{"a", "b", "c"} {
+		downloaded := createTestTempFile(t, cacheDir, name+".txt", "12345", 0600)
+		require.NoError(t, c.store("http://example.com/"+name, header, downloaded))
+	}
+
+	assert.Len(t, c.items, 2)
+	assert.NotContains(t, c.items, "http://example.com/a")
+	sum := sha256.Sum256([]byte("http://example.com/a"))
+	_, err := os.Stat(filepath.Join(cacheDir, hex.EncodeToString(sum[:])))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRunTimeout(t *testing.T) {
+	defer func(delay time.Duration) { runTimeoutKillDelay = delay }(runTimeoutKillDelay)
+	runTimeoutKillDelay = 10 * time.Millisecond
+
+	var signals []uint64
+	var exited chan struct{}
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.Stdout = ioutil.Discard
+	b.runConfig.Cmd = strslice.StrSlice{"/bin/sh", "-c", "sleep 60"}
+	b.runConfig.StopSignal = "SIGTERM"
+	mockBackend := b.docker.(*MockBackend)
+	mockBackend.containerWaitFunc = func(containerID string, timeout time.Duration) (int, error) {
+		<-exited
+		return 137, nil
+	}
+
+	for _, ignoreStopSignal := range []bool{false, true} {
+		signals = nil
+		exited = make(chan struct{})
+		mockBackend.containerKillFunc = func(containerID string, sig uint64) error {
+			signals = append(signals, sig)
+			if sig == 0 || !ignoreStopSignal {
+				close(exited)
+			}
+			return nil
+		}
+
+		err := b.run("container", 10*time.Millisecond, nil)
+		assert.EqualError(t, err, "The command '/bin/sh -c sleep 60' did not complete within 10ms")
+		if ignoreStopSignal {
+			assert.Equal(t, []uint64{uint64(syscall.SIGTERM), 0}, signals)
+		} else {
+			assert.Equal(t, []uint64{uint64(syscall.SIGTERM)}, signals)
+		}
+	}
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--timeout=500ms"}
+	b.image = "baseimage"
+	err := run(b, []string{"sleep 60"}, nil, "")
+	assert.EqualError(t, err, `Interval "timeout" cannot be less than 1 second`)
+}
+
+func TestCommitEmptyLayer(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "app.conf", "debug=false", 0644)
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	var emptyLayers []bool
+	b := newBuilderWithMockBackend()
+	b.clientCtx = context.Background()
+	b.Stdout = ioutil.Discard
+	b.context = buildContext
+	b.image = "baseimage"
+	b.imageContexts.add("")
+	b.docker.(*MockBackend).containerCreateFunc = func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+		return container.ContainerCreateCreatedBody{ID: "container"}, nil
+	}
+	b.docker.(*MockBackend).commitFunc = func(containerID string, config *backend.ContainerCommitConfig) (string, error) {
+		emptyLayers = append(emptyLayers, config.EmptyLayer)
+		return fmt.Sprintf("sha256:%d", len(emptyLayers)), nil
+	}
+
+	instructions := []struct {
+		dispatch   func(*Builder, []string, map[string]bool, string) error
+		args       []string
+		emptyLayer bool
+	}{
+		{dispatch: env, args: []string{"APP_ENV", "production"}, emptyLayer: true},
+		{dispatch: label, args: []string{"version", "1.0"}, emptyLayer: true},
+		{dispatch: workdir, args: []string{"/app"}},
+		{dispatch: run, args: []string{"make"}},
+		{dispatch: dispatchCopy, args: []string{"app.conf", "/app/"}},
+		{dispatch: cmd, args: []string{"./app"}, emptyLayer: true},
+	}
+
+	var expected []bool
+	for _, instruction := range instructions {
+		b.flags = NewBFlags()
+		require.NoError(t, instruction.dispatch(b, instruction.args, nil, ""))
+		expected = append(expected, instruction.emptyLayer)
+	}
+	assert.Equal(t, expected, emptyLayers)
+}
+
+func TestCopyURL(t *testing.T) {
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	args := []string{server.URL + "/release.tar.gz", "/downloads/"}
+
+	err := dispatchCopy(b, args, nil, "")
+	assert.EqualError(t, err, "Source can't be a URL for COPY")
+	assert.Empty(t, requested)
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--url"}
+	err = dispatchCopy(b, args, nil, "")
+	assert.EqualError(t, err, "Got HTTP status code >= 400: 404 Not Found")
+	assert.Equal(t, []string{"/release.tar.gz"}, requested)
+	assert.Empty(t, b.deprecations)
+}
+
+func TestCopyHeredoc(t *testing.T) {
+	type copied struct {
+		dest    string
+		content string
+		mode    os.FileMode
+	}
+	var files []copied
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.image = "baseimage"
+	b.imageCache = cache
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		data, err := ioutil.ReadFile(src.Path())
+		if err != nil {
+			return err
+		}
+		files = append(files, copied{destPath, string(data), src.Mode().Perm()})
+		return nil
+	}
+
+	copyHeredoc := func(content string, flags ...string) error {
+		b.cacheBusted = false
+		b.flags = NewBFlags()
+		b.flags.Args = flags
+		b.heredocs = []parser.Heredoc{{Name: "EOF", Content: content, Chomp: true}}
+		return dispatchCopy(b, []string{"<<-EOF", "/app/run.sh"}, nil, "")
+	}
+
+	require.NoError(t, copyHeredoc("\t#!/bin/sh\n\techo hello\n"))
+	require.NoError(t, copyHeredoc("#!/bin/sh\necho world\n", "--chmod=755"))
+	expected := []copied{
+		{"/app/run.sh", "#!/bin/sh\necho hello\n", 0644},
+		{"/app/run.sh", "#!/bin/sh\necho world\n", 0755},
+	}
+	assert.Equal(t, expected, files)
+	assert.Len(t, cache.keys, 2)
+
+	err := copyHeredoc("echo hello\n", "--chmod=u+x")
+	assert.EqualError(t, err, `Invalid --chmod "u+x" for COPY, must be an octal mode such as 0755`)
+}
+
+func TestCopyIgnoreFile(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+
+	srcDir := filepath.Join(contextDir, "api")
+	require.NoError(t, os.MkdirAll(filepath.Join(srcDir, "testdata"), 0755))
+	createTestTempFile(t, srcDir, "main.go", "package main", 0644)
+	createTestTempFile(t, srcDir, "main_test.go", "package main", 0644)
+	createTestTempFile(t, filepath.Join(srcDir, "testdata"), "fixture.json", "{}", 0644)
+	createTestTempFile(t, contextDir, "api.dockerignore", "**/*_test.go\napi/testdata\n", 0644)
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	var copied []string
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = buildContext
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		return filepath.Walk(src.Path(), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src.Path(), path)
+			if err != nil {
+				return err
+			}
+			copied = append(copied, filepath.ToSlash(rel))
+			return nil
+		})
+	}
+
+	b.flags.Args = []string{"--ignorefile=api.dockerignore"}
+	require.NoError(t, dispatchCopy(b, []string{"api", "/app/"}, nil, ""))
+	assert.Equal(t, []string{".", "main.go"}, copied)
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--ignorefile=api.dockerignore"}
+	err = dispatchCopy(b, []string{"api/*_test.go", "/app/"}, nil, "")
+	assert.EqualError(t, err, "All the source files are excluded by --ignorefile api.dockerignore")
+
+	b.flags = NewBFlags()
+	b.flags.Args = []string{"--ignorefile=web.dockerignore"}
+	err = dispatchCopy(b, []string{"api", "/app/"}, nil, "")
+	assert.EqualError(t, err, "failed to read --ignorefile: web.dockerignore not found in build context")
+}
+
+func TestCopyFromFirstContaining(t *testing.T) {
+	debugDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, debugDir, "app", "debug", 0755)
+
+	releaseDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, releaseDir, "app", "release", 0755)
+	createTestTempFile(t, releaseDir, "app.sig", "signature", 0644)
+
+	var copied []string
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.options.AdditionalContexts = map[string]func() (string, error){
+		"debug":   func() (string, error) { return debugDir, nil },
+		"release": func() (string, error) { return releaseDir, nil },
+	}
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		data, err := ioutil.ReadFile(src.Path())
+		if err != nil {
+			return err
+		}
+		copied = append(copied, src.Name()+"="+string(data))
+		return nil
+	}
+
+	copyFrom := func(from string, srcs ...string) error {
+		b.flags = NewBFlags()
+		b.flags.Args = []string{"--from=" + from}
+		return dispatchCopy(b, append(srcs, "/usr/local/bin/"), nil, "")
+	}
+
+	require.NoError(t, copyFrom("debug,release", "app"))
+	require.NoError(t, copyFrom("debug,release", "app*"))
+	require.NoError(t, copyFrom("debug,release", "app.sig"))
+	assert.Equal(t, []string{"app=debug", "app=debug", "app.sig=signature"}, copied)
+
+	err := copyFrom("debug,release", "app.sbom")
+	assert.EqualError(t, err, "none of debug, release contain app.sbom")
+}
+
+func TestAddOCIArtifact(t *testing.T) {
+	var pulled, pullDir string
+	var copied []string
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.image = "baseimage"
+	mockBackend := b.docker.(*MockBackend)
+	mockBackend.pullArtifactFunc = func(name string, dest string) error {
+		pulled, pullDir = name, dest
+		createTestTempFile(t, dest, "model.bin", "weights", 0644)
+		createTestTempFile(t, dest, "README", "model", 0644)
+		return nil
+	}
+	mockBackend.copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		assert.False(t, decompress)
+		assert.True(t, src.IsDir())
+		files, err := ioutil.ReadDir(src.Path())
+		require.NoError(t, err)
+		for _, f := range files {
+			copied = append(copied, f.Name())
+		}
+		copied = append(copied, destPath)
+		return nil
+	}
+
+	require.NoError(t, add(b, []string{"oci://registry.example.com/models/resnet:v1", "/models/"}, nil, ""))
+	assert.Equal(t, "registry.example.com/models/resnet:v1", pulled)
+	assert.Equal(t, []string{"README", "model.bin", "/models/"}, copied)
+	_, err := os.Stat(pullDir)
+	assert.True(t, os.IsNotExist(err), "the files of the artifact must be removed once copied")
+
+	mockBackend.pullArtifactFunc = func(name string, dest string) error {
+		return fmt.Errorf("artifacts of type application/vnd.oci.image.config.v1+json are not supported")
+	}
+	b.flags = NewBFlags()
+	err = add(b, []string{"oci://registry.example.com/images/app:v1", "/app/"}, nil, "")
+	assert.EqualError(t, err, "failed to pull OCI artifact registry.example.com/images/app:v1: artifacts of type application/vnd.oci.image.config.v1+json are not supported")
+
+	b.flags = NewBFlags()
+	err = add(b, []string{"oci://Registry/UPPER", "/sbom/"}, nil, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid OCI artifact reference Registry/UPPER")
+
+	b.flags = NewBFlags()
+	err = dispatchCopy(b, []string{"oci://registry.example.com/models/resnet:v1", "/models/"}, nil, "")
+	assert.EqualError(t, err, "Source can't be an OCI artifact for COPY")
+}
+
+func TestCopyStrictSources(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "src"), 0755))
+	createTestTempFile(t, filepath.Join(contextDir, "src"), "main.go", "package main", 0644)
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	var copied int
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = buildContext
+	b.options.StrictCopySources = true
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		copied++
+		return nil
+	}
+	copySources := func(args ...string) error {
+		b.flags = NewBFlags()
+		return dispatchCopy(b, args, nil, "")
+	}
+
+	require.NoError(t, copySources("src/*.go", "src", "/app/"))
+	assert.Equal(t, 2, copied)
+
+	copied = 0
+	err = copySources("src/*.go", "src/*.c", "/app/")
+	assert.EqualError(t, err, "COPY source src/*.c matches no file in the build context")
+	assert.Equal(t, 0, copied)
+
+	err = copySources("src", "scr/main.go", "/app/")
+	assert.EqualError(t, err, "COPY source scr/main.go matches no file in the build context")
+	assert.Equal(t, 0, copied)
+}
+
+func TestAddDecompress(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "app.tar", "archive", 0644)
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	var decompressed []bool
+	cache := &recordingImageCache{keys: map[string]string{}, images: map[string]struct{}{}}
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = buildContext
+	b.Stdout = ioutil.Discard
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		decompressed = append(decompressed, decompress)
+		return nil
+	}
+	require.NoError(t, from(b, []string{"busybox"}, nil, ""))
+	b.imageCache = cache
+	addWithFlags := func(flags ...string) error {
+		b.flags = NewBFlags()
+		b.flags.Args = flags
+		b.image = "theid"
+		b.cacheBusted = false
+		return add(b, []string{"app.tar", "/app/"}, nil, "")
+	}
+
+	require.NoError(t, addWithFlags())
+	require.NoError(t, addWithFlags("--decompress=false"))
+	require.NoError(t, addWithFlags("--decompress"))
+	assert.Equal(t, []bool{true, false}, decompressed)
+	// the third ADD uses the cache of the first one
+	assert.Len(t, cache.keys, 2)
+}
+
+func TestCopyRename(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "conf"), 0755))
+	createTestTempFile(t, filepath.Join(contextDir, "conf"), "app.conf", "debug = false", 0644)
+	createTestTempFile(t, filepath.Join(contextDir, "conf"), "db.conf", "host = db", 0644)
+	createTestTempFile(t, contextDir, "app.conf.prod", "debug = false", 0644)
+
+	rootfs, cleanupRootfs := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanupRootfs()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc", "app"), 0755))
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	var copied []string
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = buildContext
+	b.image = "baseimage"
+	b.docker.(*MockBackend).mountImageFunc = func(name string) (string, func() error, error) {
+		return rootfs, func() error { return nil }, nil
+	}
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		copied = append(copied, src.Name()+" "+destPath)
+		return nil
+	}
+	copyRename := func(args ...string) error {
+		b.flags = NewBFlags()
+		b.flags.Args = []string{"--rename"}
+		return dispatchCopy(b, args, nil, "")
+	}
+
+	require.NoError(t, copyRename("*.prod", "/etc/app.conf"))
+	assert.Equal(t, []string{"app.conf.prod /etc/app.conf"}, copied)
+
+	copied = nil
+	err = copyRename("conf/*.conf", "/etc/app.conf")
+	assert.EqualError(t, err, "COPY --rename requires a single source file, the sources match 2 files")
+
+	err = copyRename("conf", "/etc/app.conf")
+	assert.EqualError(t, err, "COPY --rename requires a single source file, conf is a directory")
+
+	err = copyRename("app.conf.prod", "/etc/app/")
+	assert.EqualError(t, err, "COPY --rename requires a destination file, /etc/app/ ends with a /")
+
+	err = copyRename("app.conf.prod", "/etc/app")
+	assert.EqualError(t, err, "COPY --rename destination /etc/app is a directory in the image")
+	assert.Empty(t, copied)
+}
+
+func TestCopyFromBuildContext(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "app.conf", "debug = false", 0644)
+
+	rootfs, cleanupRootfs := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanupRootfs()
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	var copied []string
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = buildContext
+	b.docker.(*MockBackend).mountImageFunc = func(name string) (string, func() error, error) {
+		return rootfs, func() error { return nil }, nil
+	}
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		copied = append(copied, src.Path())
+		return nil
+	}
+	_, err = b.imageContexts.add("build")
+	require.NoError(t, err)
+	b.imageContexts.update("buildimage", &container.Config{})
+	_, err = b.imageContexts.add("")
+	require.NoError(t, err)
+
+	copyFrom := func(from string, args ...string) error {
+		b.flags = NewBFlags()
+		b.flags.Args = []string{"--from=" + from}
+		return dispatchCopy(b, args, nil, "")
+	}
+
+	require.NoError(t, copyFrom("context", "app.conf", "/etc/"))
+	require.NoError(t, copyFrom("build,Context", "app.conf", "/etc/"))
+	require.Len(t, copied, 2)
+	for _, path := range copied {
+		assert.True(t, strings.HasPrefix(path, contextDir), path)
+	}
+
+	_, err = parseBuildStageName([]string{"busybox", "AS", "Context"})
+	assert.EqualError(t, err, `invalid name for build stage: "context", name is reserved for the build context`)
+}
+
+func TestCopyDirCacheKey(t *testing.T) {
+	dirHash := func(files map[string]string, src string) string {
+		contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+		defer cleanup()
+		for name, content := range files {
+			require.NoError(t, os.MkdirAll(filepath.Join(contextDir, filepath.Dir(name)), 0755))
+			createTestTempFile(t, filepath.Join(contextDir, filepath.Dir(name)), filepath.Base(name), content, 0644)
+		}
+		buildContext, err := remotecontext.NewLazyContext(contextDir)
+		require.NoError(t, err)
+
+		b := newBuilderWithMockBackend()
+		b.context = buildContext
+		infos, err := b.calcCopyInfo("ADD", src, false, true, nil)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		return infos[0].FileInfo.(builder.Hashed).Hash()
+	}
+
+	base := dirHash(map[string]string{"src/app/main.go": "package main", "src/app/lib/lib.go": "package lib", "README": "hello"}, "src/app")
+	assert.True(t, strings.HasPrefix(base, "dir:"), base)
+
+	// unrelated files of the context
+	assert.Equal(t, base, dirHash(map[string]string{"src/app/main.go": "package main", "src/app/lib/lib.go": "package lib", "README": "changed"}, "src/app"))
+	assert.Equal(t, base, dirHash(map[string]string{"src/app/main.go": "package main", "src/app/lib/lib.go": "package lib"}, "src/app"))
+
+	// the files which are copied
+	assert.NotEqual(t, base, dirHash(map[string]string{"src/app/main.go": "package main // changed", "src/app/lib/lib.go": "package lib", "README": "hello"}, "src/app"))
+	assert.NotEqual(t, base, dirHash(map[string]string{"src/app/main.go": "package main", "src/app/lib/lib2.go": "package lib", "README": "hello"}, "src/app"))
+}
@@ -25,6 +25,12 @@ func normaliseDest(cmdName, workingDir, requested string) (string, error) {
 	return dest, nil
 }
 
+// isExecutable returns whether any of the execute permission bits of fi are
+// set.
+func isExecutable(fi os.FileInfo) bool {
+	return fi.Mode()&0111 != 0
+}
+
 func containsWildcards(name string) bool {
 	for i := 0; i < len(name); i++ {
 		ch := name[i]
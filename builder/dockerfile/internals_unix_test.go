@@ -0,0 +1,334 @@
+// +build !windows
+
+package dockerfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/builder"
+	"github.com/docker/docker/builder/remotecontext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCopyDestinationsSymlinkEscape(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "passwd", "root:x:0:0::/root:/bin/sh", 0644)
+	require.NoError(t, os.Mkdir(filepath.Join(contextDir, "conf"), 0755))
+	createTestTempFile(t, filepath.Join(contextDir, "conf"), "app.conf", "debug=false", 0644)
+
+	rootfs, cleanupRootfs := createTestTempDir(t, "", "builder-dockerfile-rootfs")
+	defer cleanupRootfs()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "somewhere"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "app"), 0755))
+	createTestSymlink(t, rootfs, "etc", "/somewhere")
+	createTestSymlink(t, filepath.Join(rootfs, "app"), "app.conf", "/somewhere/app.conf")
+
+	context, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	copied := 0
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = context
+	b.image = "baseimage"
+	b.options.StrictCopyDestinations = true
+	b.docker.(*MockBackend).mountImageFunc = func(name string) (string, func() error, error) {
+		return rootfs, func() error { return nil }, nil
+	}
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		copied++
+		return nil
+	}
+
+	err = b.runContextCommand([]string{"passwd", "/etc/"}, false, false, "COPY", nil, copyFileOptions{})
+	assert.EqualError(t, err, "destination /etc resolves to /somewhere through a symlink in the image")
+
+	err = b.runContextCommand([]string{"conf", "/app/"}, false, false, "COPY", nil, copyFileOptions{})
+	assert.EqualError(t, err, "destination /app/app.conf resolves to /somewhere/app.conf through a symlink in the image")
+	assert.Equal(t, 0, copied)
+
+	err = b.runContextCommand([]string{"passwd", "/app/"}, false, false, "COPY", nil, copyFileOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, copied)
+}
+
+func TestCheckEntrypoint(t *testing.T) {
+	rootfs, cleanup := createTestTempDir(t, "", "builder-dockerfile-rootfs")
+	defer cleanup()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "usr", "bin"), 0755))
+	createTestTempFile(t, filepath.Join(rootfs, "usr", "bin"), "myapp", "#!/bin/sh", 0755)
+	createTestTempFile(t, filepath.Join(rootfs, "usr", "bin"), "config", "debug=false", 0644)
+
+	newBuilder := func() *Builder {
+		b := newBuilderWithMockBackend()
+		b.disableCommit = true
+		b.image = "theimage"
+		b.runConfig.Env = []string{"PATH=/usr/local/bin:/usr/bin"}
+		b.docker.(*MockBackend).mountImageFunc = func(name string) (string, func() error, error) {
+			return rootfs, func() error { return nil }, nil
+		}
+		return b
+	}
+
+	testCases := []struct {
+		instruction string
+		args        []string
+		json        bool
+		expectedErr string
+	}{
+		{instruction: "ENTRYPOINT", args: []string{"/usr/bin/myapp"}, json: true},
+		{instruction: "CMD", args: []string{"myapp", "--serve"}, json: true},
+		{instruction: "ENTRYPOINT", args: []string{"/usr/bin/myap"}, json: true, expectedErr: "ENTRYPOINT binary /usr/bin/myap does not exist in the image"},
+		{instruction: "CMD", args: []string{"myap"}, json: true, expectedErr: "CMD binary myap does not exist in the image"},
+		{instruction: "ENTRYPOINT", args: []string{"/usr/bin/config"}, json: true, expectedErr: "ENTRYPOINT binary /usr/bin/config is not executable in the image"},
+		{instruction: "ENTRYPOINT", args: []string{"/usr/bin/myap"}},
+	}
+
+	for _, tc := range testCases {
+		b := newBuilder()
+		attributes := map[string]bool{"json": tc.json}
+		if tc.instruction == "ENTRYPOINT" {
+			require.NoError(t, entrypoint(b, tc.args, attributes, ""))
+		} else {
+			require.NoError(t, cmd(b, tc.args, attributes, ""))
+		}
+
+		err := b.checkEntrypoint()
+		if tc.expectedErr == "" {
+			assert.NoError(t, err, "%s %v", tc.instruction, tc.args)
+		} else {
+			assert.EqualError(t, err, tc.expectedErr)
+		}
+	}
+}
+
+func TestCopyWildcardToFileWarning(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "app.conf", "debug=false", 0644)
+	createTestTempFile(t, contextDir, "app.txt", "app", 0644)
+
+	rootfs, cleanupRootfs := createTestTempDir(t, "", "builder-dockerfile-rootfs")
+	defer cleanupRootfs()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc", "app"), 0755))
+
+	context, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	stdout := &bytes.Buffer{}
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = context
+	b.image = "baseimage"
+	b.Stdout = stdout
+	b.docker.(*MockBackend).mountImageFunc = func(name string) (string, func() error, error) {
+		return rootfs, func() error { return nil }, nil
+	}
+
+	testCases := []struct {
+		args        []string
+		expectedErr string
+		warning     string
+	}{
+		{args: []string{"app.conf", "/etc/app.conf"}},
+		{args: []string{"*.conf", "/etc/app/"}},
+		{args: []string{"*.conf", "/etc/app"}},
+		{
+			args:    []string{"*.conf", "/etc/app.conf"},
+			warning: "[Warning] COPY destination /etc/app.conf does not end with a / and is not a directory, the file matching *.conf is copied to a file named /etc/app.conf\n",
+		},
+		{
+			args:        []string{"app.conf", "app.txt", "/etc/app"},
+			expectedErr: "When using COPY with more than one source file, the destination must be a directory and end with a /",
+		},
+	}
+
+	for _, tc := range testCases {
+		stdout.Reset()
+		err := b.runContextCommand(tc.args, false, false, "COPY", nil, copyFileOptions{})
+		if tc.expectedErr != "" {
+			assert.EqualError(t, err, tc.expectedErr)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, tc.warning, stdout.String(), "COPY %v", tc.args)
+	}
+}
+
+func TestCopyFollowSymlinks(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	confDir := filepath.Join(contextDir, "conf")
+	require.NoError(t, os.MkdirAll(confDir, 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(contextDir, "shared"), 0755))
+	createTestTempFile(t, confDir, "app.conf", "debug=false", 0644)
+	createTestTempFile(t, filepath.Join(contextDir, "shared"), "base.conf", "log=info", 0644)
+	createTestSymlink(t, confDir, "current.conf", "app.conf")
+	createTestSymlink(t, confDir, "shared", "../shared")
+	createTestSymlink(t, contextDir, "latest", "conf")
+
+	buildContext, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	var copied []string
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = buildContext
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		return filepath.Walk(src.Path(), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src.Path(), path)
+			if err != nil {
+				return err
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				rel += " -> " + link
+			}
+			copied = append(copied, filepath.ToSlash(rel))
+			return nil
+		})
+	}
+	copyWithFlags := func(src string, flags ...string) error {
+		copied = nil
+		b.flags = NewBFlags()
+		b.flags.Args = flags
+		return dispatchCopy(b, []string{src, "/etc/app/"}, nil, "")
+	}
+
+	require.NoError(t, copyWithFlags("latest"))
+	assert.Equal(t, []string{".", "app.conf", "current.conf -> app.conf", "shared -> ../shared"}, copied)
+
+	require.NoError(t, copyWithFlags("latest", "--follow-symlinks=false"))
+	assert.Equal(t, []string{". -> conf"}, copied)
+
+	require.NoError(t, copyWithFlags("conf", "--follow-symlinks=false"))
+	assert.Equal(t, []string{".", "app.conf", "current.conf -> app.conf", "shared -> ../shared"}, copied)
+
+	require.NoError(t, copyWithFlags("conf", "--follow-symlinks"))
+	assert.Equal(t, []string{".", "app.conf", "current.conf", "shared", "shared/base.conf"}, copied)
+
+	createTestSymlink(t, confDir, "loop", ".")
+	err = copyWithFlags("conf", "--follow-symlinks=true")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to follow symlink conf/loop, it loops back to a parent directory")
+}
+
+func TestStrictUser(t *testing.T) {
+	rootfs, cleanup := createTestTempDir(t, "", "builder-dockerfile-rootfs")
+	defer cleanup()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	createTestTempFile(t, filepath.Join(rootfs, "etc"), "passwd", "root:x:0:0::/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n", 0644)
+	createTestTempFile(t, filepath.Join(rootfs, "etc"), "group", "root:x:0:\nstaff:x:50:app\n", 0644)
+
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.image = "theimage"
+	b.options.StrictUser = true
+	b.docker.(*MockBackend).mountImageFunc = func(name string) (string, func() error, error) {
+		return rootfs, func() error { return nil }, nil
+	}
+
+	testCases := []struct {
+		user        string
+		expectedErr string
+	}{
+		{user: "app"},
+		{user: "app:staff"},
+		{user: "1001:2000"},
+		{user: "app:2000"},
+		{user: "web", expectedErr: "USER web: user web is not defined in /etc/passwd of the image"},
+		{user: "app:wheel", expectedErr: "USER app:wheel: group wheel is not defined in /etc/group of the image"},
+	}
+
+	for _, tc := range testCases {
+		b.flags = NewBFlags()
+		err := user(b, []string{tc.user}, nil, "")
+		if tc.expectedErr == "" {
+			require.NoError(t, err, tc.user)
+			assert.Equal(t, tc.user, b.runConfig.User)
+		} else {
+			assert.EqualError(t, err, tc.expectedErr)
+		}
+	}
+
+	b.image = ""
+	b.flags = NewBFlags()
+	assert.EqualError(t, user(b, []string{"app"}, nil, ""), "USER app: user app is not defined in /etc/passwd of the image")
+	b.flags = NewBFlags()
+	assert.NoError(t, user(b, []string{"0:0"}, nil, ""))
+}
+
+func TestCopyAsUser(t *testing.T) {
+	contextDir, cleanup := createTestTempDir(t, "", "builder-dockerfile-test")
+	defer cleanup()
+	createTestTempFile(t, contextDir, "app.conf", "debug=false", 0644)
+
+	rootfs, cleanupRootfs := createTestTempDir(t, "", "builder-dockerfile-rootfs")
+	defer cleanupRootfs()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	createTestTempFile(t, filepath.Join(rootfs, "etc"), "passwd", "root:x:0:0::/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n", 0644)
+	createTestTempFile(t, filepath.Join(rootfs, "etc"), "group", "root:x:0:\nstaff:x:50:app\n", 0644)
+
+	context, err := remotecontext.NewLazyContext(contextDir)
+	require.NoError(t, err)
+
+	var copied []string
+	b := newBuilderWithMockBackend()
+	b.disableCommit = true
+	b.context = context
+	b.image = "baseimage"
+	b.options.CopyAsUser = true
+	b.docker.(*MockBackend).mountImageFunc = func(name string) (string, func() error, error) {
+		return rootfs, func() error { return nil }, nil
+	}
+	b.docker.(*MockBackend).copyOnBuildFunc = func(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+		copied = append(copied, "root")
+		return nil
+	}
+	b.docker.(*MockBackend).copyWithOwnerFunc = func(containerID string, destPath string, src builder.FileInfo, uid, gid int) error {
+		copied = append(copied, fmt.Sprintf("%d:%d", uid, gid))
+		return nil
+	}
+
+	testCases := []struct {
+		user     string
+		expected string
+	}{
+		{user: "", expected: "root"},
+		{user: "root", expected: "root"},
+		{user: "app", expected: "1000:1000"},
+		{user: "app:staff", expected: "1000:50"},
+		{user: "1234:1234", expected: "1234:1234"},
+	}
+	for _, tc := range testCases {
+		copied = nil
+		b.runConfig.User = tc.user
+		b.flags = NewBFlags()
+		require.NoError(t, dispatchCopy(b, []string{"app.conf", "/app/"}, nil, ""), tc.user)
+		assert.Equal(t, []string{tc.expected}, copied, tc.user)
+	}
+
+	b.runConfig.User = "web"
+	b.flags = NewBFlags()
+	err = dispatchCopy(b, []string{"app.conf", "/app/"}, nil, "")
+	assert.EqualError(t, err, "failed to resolve the owner of the copied files, USER web: unable to find user web: no matching entries in passwd file")
+
+	copied = nil
+	b.options.CopyAsUser = false
+	b.runConfig.User = "app"
+	b.flags = NewBFlags()
+	require.NoError(t, dispatchCopy(b, []string{"app.conf", "/app/"}, nil, ""))
+	assert.Equal(t, []string{"root"}, copied)
+}
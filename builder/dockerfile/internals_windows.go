@@ -64,3 +64,9 @@ func containsWildcards(name string) bool {
 	}
 	return false
 }
+
+// isExecutable returns whether fi can be executed. Windows has no execute
+// permission bits, so every file is considered executable.
+func isExecutable(fi os.FileInfo) bool {
+	return true
+}
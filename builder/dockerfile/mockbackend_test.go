@@ -10,12 +10,25 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/image"
+	"github.com/opencontainers/go-digest"
 	"golang.org/x/net/context"
 )
 
 // MockBackend implements the builder.Backend interface for unit testing
 type MockBackend struct {
-	getImageOnBuildFunc func(string) (builder.Image, error)
+	getImageOnBuildFunc    func(string) (builder.Image, error)
+	containerCreateFunc    func(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error)
+	copyOnBuildFunc        func(containerID string, destPath string, src builder.FileInfo, decompress bool) error
+	mountImageFunc         func(name string) (string, func() error, error)
+	commitFunc             func(containerID string, config *backend.ContainerCommitConfig) (string, error)
+	containerKillFunc      func(containerID string, sig uint64) error
+	containerWaitFunc      func(containerID string, timeout time.Duration) (int, error)
+	containerAttachRawFunc func(cID string, stdout, stderr io.Writer) error
+	pullOnBuildFunc        func(name string) (builder.Image, error)
+	pullArtifactFunc       func(name string, dest string) error
+	copyWithOwnerFunc      func(containerID string, destPath string, src builder.FileInfo, uid, gid int) error
+	copyWithLabelFunc      func(containerID string, destPath string, src builder.FileInfo, uid, gid int, label string) error
+	selinuxEnabled         bool
 }
 
 func (m *MockBackend) GetImageOnBuild(name string) (builder.Image, error) {
@@ -30,14 +43,30 @@ func (m *MockBackend) TagImageWithReference(image.ID, reference.Named) error {
 }
 
 func (m *MockBackend) PullOnBuild(ctx context.Context, name string, authConfigs map[string]types.AuthConfig, output io.Writer) (builder.Image, error) {
+	if m.pullOnBuildFunc != nil {
+		return m.pullOnBuildFunc(name)
+	}
 	return nil, nil
 }
 
+func (m *MockBackend) PullArtifactOnBuild(ctx context.Context, name string, authConfigs map[string]types.AuthConfig, dest string) error {
+	if m.pullArtifactFunc != nil {
+		return m.pullArtifactFunc(name, dest)
+	}
+	return nil
+}
+
 func (m *MockBackend) ContainerAttachRaw(cID string, stdin io.ReadCloser, stdout, stderr io.Writer, stream bool) error {
+	if m.containerAttachRawFunc != nil {
+		return m.containerAttachRawFunc(cID, stdout, stderr)
+	}
 	return nil
 }
 
 func (m *MockBackend) ContainerCreate(config types.ContainerCreateConfig) (container.ContainerCreateCreatedBody, error) {
+	if m.containerCreateFunc != nil {
+		return m.containerCreateFunc(config)
+	}
 	return container.ContainerCreateCreatedBody{}, nil
 }
 
@@ -45,11 +74,17 @@ func (m *MockBackend) ContainerRm(name string, config *types.ContainerRmConfig)
 	return nil
 }
 
-func (m *MockBackend) Commit(string, *backend.ContainerCommitConfig) (string, error) {
+func (m *MockBackend) Commit(containerID string, config *backend.ContainerCommitConfig) (string, error) {
+	if m.commitFunc != nil {
+		return m.commitFunc(containerID, config)
+	}
 	return "", nil
 }
 
 func (m *MockBackend) ContainerKill(containerID string, sig uint64) error {
+	if m.containerKillFunc != nil {
+		return m.containerKillFunc(containerID, sig)
+	}
 	return nil
 }
 
@@ -58,6 +93,9 @@ func (m *MockBackend) ContainerStart(containerID string, hostConfig *container.H
 }
 
 func (m *MockBackend) ContainerWait(containerID string, timeout time.Duration) (int, error) {
+	if m.containerWaitFunc != nil {
+		return m.containerWaitFunc(containerID, timeout)
+	}
 	return 0, nil
 }
 
@@ -70,6 +108,27 @@ func (m *MockBackend) ContainerCreateWorkdir(containerID string) error {
 }
 
 func (m *MockBackend) CopyOnBuild(containerID string, destPath string, src builder.FileInfo, decompress bool) error {
+	if m.copyOnBuildFunc != nil {
+		return m.copyOnBuildFunc(containerID, destPath, src, decompress)
+	}
+	return nil
+}
+
+func (m *MockBackend) CopyOnBuildWithOwner(containerID string, destPath string, src builder.FileInfo, decompress bool, uid, gid int) error {
+	if m.copyWithOwnerFunc != nil {
+		return m.copyWithOwnerFunc(containerID, destPath, src, uid, gid)
+	}
+	return nil
+}
+
+func (m *MockBackend) SELinuxEnabled() bool {
+	return m.selinuxEnabled
+}
+
+func (m *MockBackend) CopyOnBuildWithLabel(containerID string, destPath string, src builder.FileInfo, decompress bool, uid, gid int, label string) error {
+	if m.copyWithLabelFunc != nil {
+		return m.copyWithLabelFunc(containerID, destPath, src, uid, gid, label)
+	}
 	return nil
 }
 
@@ -82,12 +141,18 @@ func (m *MockBackend) SquashImage(from string, to string) (string, error) {
 }
 
 func (m *MockBackend) MountImage(name string) (string, func() error, error) {
+	if m.mountImageFunc != nil {
+		return m.mountImageFunc(name)
+	}
 	return "", func() error { return nil }, nil
 }
 
 type mockImage struct {
-	id     string
-	config *container.Config
+	id          string
+	config      *container.Config
+	repoDigests []digest.Digest
+	layers      int
+	platform    string
 }
 
 func (i *mockImage) ImageID() string {
@@ -97,3 +162,15 @@ func (i *mockImage) ImageID() string {
 func (i *mockImage) RunConfig() *container.Config {
 	return i.config
 }
+
+func (i *mockImage) RepoDigests() []digest.Digest {
+	return i.repoDigests
+}
+
+func (i *mockImage) Layers() int {
+	return i.layers
+}
+
+func (i *mockImage) Platform() string {
+	return i.platform
+}
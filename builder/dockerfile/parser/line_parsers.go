@@ -200,6 +200,17 @@ func parseEnv(rest string, d *Directive) (*Node, map[string]bool, error) {
 	return node, nil, err
 }
 
+// parseUnsetNames parses the names of ENV and LABEL --unset into nodes with
+// an empty value, as the nodes of ENV and LABEL are name value pairs.
+func parseUnsetNames(rest string, d *Directive) (*Node, map[string]bool, error) {
+	var rootNode *Node
+	var prevNode *Node
+	for _, word := range parseWords(rest, d) {
+		rootNode, prevNode = appendKeyValueNode(newKeyValueNode(word, ""), rootNode, prevNode)
+	}
+	return rootNode, nil, nil
+}
+
 func parseLabel(rest string, d *Directive) (*Node, map[string]bool, error) {
 	node, err := parseNameVal(rest, commandLabel, d)
 	return node, nil, err
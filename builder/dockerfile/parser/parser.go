@@ -36,6 +36,15 @@ type Node struct {
 	Flags      []string        // only top Node should have this set
 	StartLine  int             // the line in the original dockerfile where the node begins
 	endLine    int             // the line in the original dockerfile where the node ends
+	Heredocs   []Heredoc       // only top Node should have this set
+}
+
+// Heredoc is a here-document of an instruction, such as the lines following
+// RUN <<EOF up to the EOF line.
+type Heredoc struct {
+	Name    string // the delimiter, EOF in the example above
+	Content string // the lines of the here-document, each ending with a newline
+	Chomp   bool   // whether the delimiter was written <<-EOF, to strip leading tabs
 }
 
 // Dump dumps the AST defined by `node` as a list of sexps.
@@ -80,6 +89,7 @@ func (node *Node) AddChild(child *Node, startLine, endLine int) {
 
 var (
 	dispatch           map[string]func(string, *Directive) (*Node, map[string]bool, error)
+	tokenHeredoc       = regexp.MustCompile(`^<<(-?)(?:'(\w+)'|"(\w+)"|(\w+))`)
 	tokenWhitespace    = regexp.MustCompile(`[\t\v\f\r ]+`)
 	tokenEscapeCommand = regexp.MustCompile(`^#[ \t]*escape[ \t]*=[ \t]*(?P<escapechar>.).*$`)
 	tokenComment       = regexp.MustCompile(`^#.*$`)
@@ -161,6 +171,7 @@ func init() {
 		command.Maintainer:  parseString,
 		command.Onbuild:     parseSubCommand,
 		command.Run:         parseMaybeJSON,
+		command.Secret:      parseStringsWhitespaceDelimited,
 		command.Shell:       parseMaybeJSON,
 		command.StopSignal:  parseString,
 		command.User:        parseString,
@@ -169,6 +180,59 @@ func init() {
 	}
 }
 
+// The instructions which can be followed by here-documents.
+var heredocCommands = map[string]bool{
+	command.Copy: true,
+	command.Run:  true,
+}
+
+// parseHeredocs returns the here-documents opened on the line, in order,
+// without their content. Like in a shell, << only opens a here-document
+// outside of quotes and of arithmetic expansions such as $((1<<4)), and
+// <<< is a here-string.
+func parseHeredocs(line string, escapeToken rune) []Heredoc {
+	var heredocs []Heredoc
+	var quote rune
+	arithmetic := 0 // depth of the parentheses of $(( ))
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		ch := runes[i]
+		switch {
+		case quote == '\'':
+			if ch == quote {
+				quote = 0
+			}
+		case ch == escapeToken:
+			i++
+		case quote == '"':
+			if ch == quote {
+				quote = 0
+			}
+		case arithmetic > 0:
+			if ch == '(' {
+				arithmetic++
+			} else if ch == ')' {
+				arithmetic--
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case strings.HasPrefix(string(runes[i:]), "$(("):
+			arithmetic = 2
+			i += 2
+		case strings.HasPrefix(string(runes[i:]), "<<<"):
+			i += 2
+		default:
+			m := tokenHeredoc.FindStringSubmatch(string(runes[i:]))
+			if m == nil {
+				continue
+			}
+			heredocs = append(heredocs, Heredoc{Name: m[2] + m[3] + m[4], Chomp: m[1] == "-"})
+			i += len([]rune(m[0])) - 1
+		}
+	}
+	return heredocs
+}
+
 // newNodeFromLine splits the line into parts, and dispatches to a function
 // based on the command and command arguments. A Node is created from the
 // result of the dispatch.
@@ -183,6 +247,10 @@ func newNodeFromLine(line string, directive *Directive) (*Node, error) {
 	if fn == nil {
 		fn = parseIgnore
 	}
+	// ENV and LABEL --unset take names instead of name=value pairs
+	if (cmd == command.Env || cmd == command.Label) && hasBoolFlag(flags, "unset") {
+		fn = parseUnsetNames
+	}
 	next, attrs, err := fn(args, directive)
 	if err != nil {
 		return nil, err
@@ -197,6 +265,17 @@ func newNodeFromLine(line string, directive *Directive) (*Node, error) {
 	}, nil
 }
 
+// hasBoolFlag returns whether the boolean flag name is set to true in flags.
+func hasBoolFlag(flags []string, name string) bool {
+	for _, flag := range flags {
+		switch strings.ToLower(flag) {
+		case "--" + name, "--" + name + "=true":
+			return true
+		}
+	}
+	return false
+}
+
 // Result is the result of parsing a Dockerfile
 type Result struct {
 	AST         *Node
@@ -249,6 +328,31 @@ func Parse(rwc io.Reader) (*Result, error) {
 		if err != nil {
 			return nil, err
 		}
+
+		if heredocCommands[child.Value] && !child.Attributes["json"] {
+			for _, heredoc := range parseHeredocs(line, d.escapeToken) {
+				content := ""
+				terminated := false
+				for scanner.Scan() {
+					currentLine++
+					bodyLine := scanner.Text()
+					delimiter := bodyLine
+					if heredoc.Chomp {
+						delimiter = strings.TrimLeft(bodyLine, "\t")
+					}
+					if delimiter == heredoc.Name {
+						terminated = true
+						break
+					}
+					content += bodyLine + "\n"
+				}
+				if !terminated {
+					return nil, errors.Errorf("Dockerfile parse error line %d: unterminated heredoc %s", startLine, heredoc.Name)
+				}
+				heredoc.Content = content
+				child.Heredocs = append(child.Heredocs, heredoc)
+			}
+		}
 		root.AddChild(child, startLine, currentLine)
 	}
 
@@ -133,3 +133,86 @@ func TestLineInformation(t *testing.T) {
 		}
 	}
 }
+
+func TestParseHeredoc(t *testing.T) {
+	dockerfile := "FROM busybox\n" +
+		"RUN <<EOF\n" +
+		"echo hello\n" +
+		"echo world\n" +
+		"EOF\n" +
+		"RUN cat <<-'ONE' && cat <<\"TWO\"\n" +
+		"\tfirst\n" +
+		"\tONE\n" +
+		"second\n" +
+		"TWO\n" +
+		"RUN echo <<EOF\n" +
+		"EOF\n" +
+		"COPY <<EOF /dest\n" +
+		"hello\n" +
+		"EOF\n" +
+		"CMD cat <<EOF\n"
+
+	result, err := Parse(bytes.NewBufferString(dockerfile))
+	require.NoError(t, err)
+
+	children := result.AST.Children
+	require.Len(t, children, 6)
+	assert.Equal(t, []Heredoc{
+		{Name: "EOF", Content: "echo hello\necho world\n"},
+	}, children[1].Heredocs)
+	assert.Equal(t, 2, children[1].StartLine)
+	assert.Equal(t, 5, children[1].endLine)
+	assert.Equal(t, []Heredoc{
+		{Name: "ONE", Content: "\tfirst\n", Chomp: true},
+		{Name: "TWO", Content: "second\n"},
+	}, children[2].Heredocs)
+	assert.Equal(t, 11, children[3].StartLine)
+	assert.Equal(t, 12, children[3].endLine)
+	assert.Equal(t, []Heredoc{{Name: "EOF", Content: "hello\n"}}, children[4].Heredocs)
+	assert.Len(t, children[5].Heredocs, 0)
+}
+
+func TestParseHeredocShellSyntax(t *testing.T) {
+	dockerfile := "FROM busybox\n" +
+		"RUN echo $((1<<4))\n" +
+		"RUN echo $(( (1 << 2) + 1<<3 ))\n" +
+		"RUN echo '<<EOF' \"<<EOF\" \\<<EOF\n" +
+		"RUN cat <<<word\n" +
+		"RUN echo $((1<<4)) && cat<<EOF\n" +
+		"hello\n" +
+		"EOF\n"
+
+	result, err := Parse(bytes.NewBufferString(dockerfile))
+	require.NoError(t, err)
+
+	children := result.AST.Children
+	require.Len(t, children, 6)
+	for _, child := range children[1:5] {
+		assert.Len(t, child.Heredocs, 0, child.Original)
+	}
+	assert.Equal(t, []Heredoc{{Name: "EOF", Content: "hello\n"}}, children[5].Heredocs)
+}
+
+func TestParseHeredocUnterminated(t *testing.T) {
+	_, err := Parse(bytes.NewBufferString("FROM busybox\nRUN <<EOF\necho hello\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2: unterminated heredoc EOF")
+}
+
+func TestParseUnset(t *testing.T) {
+	result, err := Parse(bytes.NewBufferString("FROM busybox\nENV --unset HTTP_PROXY NO_PROXY\nLABEL --unset=true maintainer\n"))
+	require.NoError(t, err)
+
+	node := result.AST.Children[1]
+	assert.Equal(t, []string{"--unset"}, node.Flags)
+	assert.Equal(t, "HTTP_PROXY", node.Next.Value)
+	assert.Equal(t, "", node.Next.Next.Value)
+	assert.Equal(t, "NO_PROXY", node.Next.Next.Next.Value)
+	assert.Equal(t, "", node.Next.Next.Next.Next.Value)
+	assert.Nil(t, node.Next.Next.Next.Next.Next)
+
+	node = result.AST.Children[2]
+	assert.Equal(t, "maintainer", node.Next.Value)
+	assert.Equal(t, "", node.Next.Next.Value)
+	assert.Nil(t, node.Next.Next.Next)
+}
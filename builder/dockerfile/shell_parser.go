@@ -21,6 +21,11 @@ type shellWord struct {
 	envs        []string
 	pos         int
 	escapeToken rune
+	// references are the names of the variables referenced by word, in
+	// the order they are processed
+	references []string
+	// literal leaves the variable references of word as they are
+	literal bool
 }
 
 // ProcessWord will use the 'env' list of environment variables,
@@ -42,6 +47,33 @@ func ProcessWords(word string, env []string, escapeToken rune) ([]string, error)
 	return words, err
 }
 
+// ProcessQuotes removes the quotes and escapes of 'word' like ProcessWord,
+// but leaves its variable references, such as $FOO, as they are.
+func ProcessQuotes(word string, escapeToken rune) (string, error) {
+	sw := &shellWord{
+		word:        word,
+		escapeToken: escapeToken,
+		literal:     true,
+	}
+	sw.scanner.Init(strings.NewReader(word))
+	word, _, err := sw.process()
+	return word, err
+}
+
+// ProcessWordReferences returns the names of the variables referenced by
+// 'word', such as FOO for $FOO or ${FOO:-bar}, without replacing them. If word
+// has a syntax error, the names referenced before it are returned with the
+// error.
+func ProcessWordReferences(word string, escapeToken rune) ([]string, error) {
+	sw := &shellWord{
+		word:        word,
+		escapeToken: escapeToken,
+	}
+	sw.scanner.Init(strings.NewReader(word))
+	_, _, err := sw.process()
+	return sw.references, err
+}
+
 func process(word string, env []string, escapeToken rune) (string, []string, error) {
 	sw := &shellWord{
 		word:        word,
@@ -238,6 +270,10 @@ func (sw *shellWord) processDoubleQuote() (string, error) {
 
 func (sw *shellWord) processDollar() (string, error) {
 	sw.scanner.Next()
+	if sw.literal {
+		// the rest of the reference is processed as plain text
+		return "$", nil
+	}
 
 	// $xxx case
 	if sw.scanner.Peek() != '{' {
@@ -245,11 +281,13 @@ func (sw *shellWord) processDollar() (string, error) {
 		if name == "" {
 			return "$", nil
 		}
+		sw.references = append(sw.references, name)
 		return sw.getEnv(name), nil
 	}
 
 	sw.scanner.Next()
 	name := sw.processName()
+	sw.references = append(sw.references, name)
 	ch := sw.scanner.Peek()
 	if ch == '}' {
 		// Normal ${xx} case
@@ -151,3 +151,43 @@ func TestGetEnv(t *testing.T) {
 		t.Fatal("8 - 'car' should map to 'hat'")
 	}
 }
+
+func TestProcessWordReferences(t *testing.T) {
+	testCases := []struct {
+		word       string
+		references []string
+		err        bool
+	}{
+		{word: "plain"},
+		{word: "$FOO and ${BAR}", references: []string{"FOO", "BAR"}},
+		{word: "${FOO:-$BAR} ${BAZ:+x}", references: []string{"FOO", "BAR", "BAZ"}},
+		{word: `'$FOO' \$BAR "$BAZ"`, references: []string{"BAZ"}},
+		{word: "$FOO ${BAR%.*} $BAZ", references: []string{"FOO", "BAR"}, err: true},
+	}
+
+	for _, testCase := range testCases {
+		references, err := ProcessWordReferences(testCase.word, '\\')
+		assert.Equal(t, testCase.references, references, testCase.word)
+		assert.Equal(t, testCase.err, err != nil, testCase.word)
+	}
+}
+
+func TestProcessQuotes(t *testing.T) {
+	testCases := []struct {
+		word     string
+		expected string
+	}{
+		{word: "plain", expected: "plain"},
+		{word: `"quoted key"`, expected: "quoted key"},
+		{word: "$FOO.${BAR}", expected: "$FOO.${BAR}"},
+		{word: `"${FOO:-bar}"`, expected: "${FOO:-bar}"},
+		{word: `'$FOO'`, expected: "$FOO"},
+		{word: `a\ b`, expected: "a b"},
+	}
+
+	for _, testCase := range testCases {
+		word, err := ProcessQuotes(testCase.word, '\\')
+		assert.NoError(t, err, testCase.word)
+		assert.Equal(t, testCase.expected, word, testCase.word)
+	}
+}
@@ -0,0 +1,201 @@
+package dockerfile
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/builder/dockerfile/command"
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// buildStage describes a build stage as declared in the Dockerfile, before
+// any instruction has been dispatched.
+type buildStage struct {
+	name        string // empty for anonymous stages
+	line        int
+	allowUnused bool // set with FROM --allow-unused
+	internal    bool // set with FROM --internal, see checkTarget()
+	used        bool // referenced by a later FROM or COPY --from
+}
+
+// parseStages returns the build stages declared in dockerfile, marking the
+// ones referenced from a later FROM or COPY --from instruction as used.
+func parseStages(dockerfile *parser.Node) ([]*buildStage, error) {
+	var stages []*buildStage
+	byName := make(map[string]*buildStage)
+
+	for _, n := range dockerfile.Children {
+		switch n.Value {
+		case command.From:
+			args := nodeArgs(n)
+			name, err := parseBuildStageName(args)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Dockerfile parse error line %d", n.StartLine)
+			}
+			if s, ok := byName[strings.ToLower(args[0])]; ok {
+				s.used = true
+			}
+			if _, ok := byName[name]; ok && name != "" {
+				return nil, errors.Errorf("Dockerfile parse error line %d: duplicate build stage name: %s", n.StartLine, name)
+			}
+			allowUnused, err := nodeFlagBool(n, "allow-unused")
+			if err != nil {
+				return nil, err
+			}
+			internal, err := nodeFlagBool(n, "internal")
+			if err != nil {
+				return nil, err
+			}
+			stage := &buildStage{
+				name:        name,
+				line:        n.StartLine,
+				allowUnused: allowUnused,
+				internal:    internal,
+			}
+			stages = append(stages, stage)
+			if name != "" {
+				byName[name] = stage
+			}
+		case command.Copy:
+			from := nodeFlagValue(n, "from")
+			if from == nil {
+				continue
+			}
+			// COPY --from may list several stages to copy from the first
+			// one containing the sources, any of them may be used
+			for _, f := range strings.Split(*from, ",") {
+				f = strings.TrimSpace(f)
+				if index, err := strconv.Atoi(f); err == nil {
+					if index >= 0 && index < len(stages) {
+						stages[index].used = true
+					}
+				} else if s, ok := byName[strings.ToLower(f)]; ok {
+					s.used = true
+				}
+			}
+		}
+	}
+	return stages, nil
+}
+
+// nodeArgs returns the unprocessed arguments of an instruction.
+func nodeArgs(n *parser.Node) []string {
+	var args []string
+	for next := n.Next; next != nil; next = next.Next {
+		args = append(args, next.Value)
+	}
+	return args
+}
+
+// nodeFlagValue returns the value of the flag called name on an instruction,
+// or nil if the flag isn't set. Boolean flags without a value return an
+// empty string.
+func nodeFlagValue(n *parser.Node, name string) *string {
+	for _, f := range n.Flags {
+		if f == "--"+name {
+			v := ""
+			return &v
+		}
+		if strings.HasPrefix(f, "--"+name+"=") {
+			v := strings.TrimPrefix(f, "--"+name+"=")
+			return &v
+		}
+	}
+	return nil
+}
+
+// nodeFlagBool returns the value of the boolean flag called name on an
+// instruction, false if the flag isn't set. Like BFlags, a flag without a
+// value is true.
+func nodeFlagBool(n *parser.Node, name string) (bool, error) {
+	v := nodeFlagValue(n, name)
+	if v == nil {
+		return false, nil
+	}
+	if *v == "" {
+		return true, nil
+	}
+	value, err := strconv.ParseBool(*v)
+	if err != nil {
+		return false, errors.Errorf("Dockerfile parse error line %d: expecting boolean value for flag --%s, not: %s", n.StartLine, name, *v)
+	}
+	return value, nil
+}
+
+// checkUnusedStages returns an error listing the named stages which are
+// neither referenced by a later stage nor the stage that is built, unless
+// they are declared with FROM --allow-unused.
+func checkUnusedStages(stages []*buildStage, target string) error {
+	var unused []string
+	for _, s := range unusedStages(stages, target) {
+		unused = append(unused, s.name+" (line "+strconv.Itoa(s.line)+")")
+	}
+	if len(unused) > 0 {
+		return errors.Errorf("unused build stages: %s; reference them or declare them with FROM --allow-unused", strings.Join(unused, ", "))
+	}
+	return nil
+}
+
+// unusedStages returns the named stages built before the final one which
+// are not referenced by a later stage, and not declared with
+// FROM --allow-unused.
+func unusedStages(stages []*buildStage, target string) []*buildStage {
+	if len(stages) == 0 {
+		return nil
+	}
+	final := finalStage(stages, target)
+
+	// stages after the final one are never built
+	var unused []*buildStage
+	for _, s := range stages[:final] {
+		if s.name == "" || s.used || s.allowUnused {
+			continue
+		}
+		unused = append(unused, s)
+	}
+	return unused
+}
+
+// finalStage returns the index of the stage which is built, the last one
+// unless target names another.
+func finalStage(stages []*buildStage, target string) int {
+	if target != "" {
+		for i, s := range stages {
+			if strings.EqualFold(s.name, target) {
+				return i
+			}
+		}
+	}
+	return len(stages) - 1
+}
+
+// baseImageNames returns the distinct base images of the stages up to the one
+// which is built, leaving out build stages, scratch and the names which
+// depend on an arg.
+func baseImageNames(dockerfile *parser.Node, stages []*buildStage, target string) []string {
+	final := finalStage(stages, target)
+	names := []string{}
+	seen := make(map[string]bool)
+	stageNames := make(map[string]bool)
+	index := 0
+	for _, n := range dockerfile.Children {
+		if n.Value != command.From {
+			continue
+		}
+		if index > final {
+			break
+		}
+		name := nodeArgs(n)[0]
+		if !stageNames[strings.ToLower(name)] && name != api.NoBaseImageSpecifier && !strings.Contains(name, "$") && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		if stages[index].name != "" {
+			stageNames[stages[index].name] = true
+		}
+		index++
+	}
+	return names
+}
@@ -0,0 +1,107 @@
+package dockerfile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/builder/dockerfile/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckUnusedStagesUsed(t *testing.T) {
+	dockerfile := `FROM busybox AS base
+FROM base AS build
+RUN make
+FROM busybox AS assets
+FROM scratch
+COPY --from=build /app /app
+COPY --from=2 /assets /assets
+`
+	assert.NoError(t, checkUnusedStages(parseTestStages(t, dockerfile), ""))
+}
+
+func TestCheckUnusedStagesCopyFromList(t *testing.T) {
+	dockerfile := `FROM busybox AS cache
+FROM golang AS build
+FROM busybox AS assets
+FROM busybox AS unused
+FROM scratch
+COPY --from=cache,build /out /out
+COPY --from=Assets,3 /assets /assets
+`
+	stages := parseTestStages(t, dockerfile)
+	assert.NoError(t, checkUnusedStages(stages, ""))
+
+	dockerfile = `FROM busybox AS cache
+FROM golang AS build
+FROM busybox AS debug
+FROM scratch
+COPY --from=cache,build /out /out
+`
+	err := checkUnusedStages(parseTestStages(t, dockerfile), "")
+	assert.EqualError(t, err, "unused build stages: debug (line 3); reference them or declare them with FROM --allow-unused")
+}
+
+func TestCheckUnusedStagesUnused(t *testing.T) {
+	dockerfile := `FROM busybox AS build
+RUN make
+FROM busybox AS debug
+FROM --allow-unused busybox AS tools
+FROM --allow-unused=false busybox AS lint
+FROM --allow-unused=true busybox AS docs
+FROM scratch
+`
+	err := checkUnusedStages(parseTestStages(t, dockerfile), "")
+	assert.EqualError(t, err, "unused build stages: build (line 1), debug (line 3), lint (line 5); reference them or declare them with FROM --allow-unused")
+
+	result, err := parser.Parse(strings.NewReader("FROM --allow-unused=maybe busybox AS tools\n"))
+	require.NoError(t, err)
+	_, err = parseStages(result.AST)
+	assert.EqualError(t, err, "Dockerfile parse error line 1: expecting boolean value for flag --allow-unused, not: maybe")
+}
+
+func TestCheckUnusedStagesFinalStage(t *testing.T) {
+	dockerfile := `FROM busybox AS build
+FROM busybox AS final
+`
+	stages := parseTestStages(t, dockerfile)
+	assert.EqualError(t, checkUnusedStages(stages, ""), "unused build stages: build (line 1); reference them or declare them with FROM --allow-unused")
+	assert.NoError(t, checkUnusedStages(parseTestStages(t, "FROM busybox AS final\n"), ""))
+
+	dockerfile = `FROM busybox AS build
+FROM build AS test
+`
+	assert.NoError(t, checkUnusedStages(parseTestStages(t, dockerfile), "build"))
+}
+
+func TestParseStagesDuplicateName(t *testing.T) {
+	dockerfile := `FROM busybox AS build
+FROM alpine AS Build
+FROM scratch
+`
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	require.NoError(t, err)
+	_, err = parseStages(result.AST)
+	assert.EqualError(t, err, "Dockerfile parse error line 2: duplicate build stage name: build")
+}
+
+func TestBaseImageNames(t *testing.T) {
+	dockerfile := `ARG GO_VERSION=1.8
+FROM golang:${GO_VERSION} AS build
+FROM busybox AS Base
+FROM base AS test
+FROM alpine:3.6
+FROM busybox
+FROM scratch
+COPY --from=build /app /app
+FROM debian AS docs
+`
+	result, err := parser.Parse(strings.NewReader(dockerfile))
+	require.NoError(t, err)
+	stages, err := parseStages(result.AST)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"busybox", "alpine:3.6", "debian"}, baseImageNames(result.AST, stages, ""))
+	assert.Equal(t, []string{"busybox"}, baseImageNames(result.AST, stages, "test"))
+}
@@ -440,6 +440,21 @@ func (container *Container) StopSignal() int {
 	return int(stopSignal)
 }
 
+// StopSignals returns the signals used to stop the container, in order: its
+// stop signal, followed by the ones of the signal.StopSignalsLabel label. The
+// next one is sent when the container did not exit after the previous one.
+func (container *Container) StopSignals() []int {
+	stopSignals := []int{container.StopSignal()}
+	if value := container.Config.Labels[signal.StopSignalsLabel]; value != "" {
+		if signals, err := signal.ParseSignals(value); err == nil {
+			for _, s := range signals {
+				stopSignals = append(stopSignals, int(s))
+			}
+		}
+	}
+	return stopSignals
+}
+
 // StopTimeout returns the timeout (in seconds) used to stop the container.
 func (container *Container) StopTimeout() int {
 	if container.Config.StopTimeout != nil {
@@ -1,6 +1,7 @@
 package container
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/docker/docker/api/types/container"
@@ -35,6 +36,29 @@ func TestContainerStopSignal(t *testing.T) {
 	}
 }
 
+func TestContainerStopSignals(t *testing.T) {
+	c := &Container{
+		CommonContainer: CommonContainer{
+			Config: &container.Config{
+				StopSignal: "SIGTERM",
+				Labels:     map[string]string{signal.StopSignalsLabel: "SIGINT"},
+			},
+		},
+	}
+	if s := c.StopSignal(); s != 15 {
+		t.Fatalf("Expected 15, got %v", s)
+	}
+	if s := c.StopSignals(); !reflect.DeepEqual(s, []int{15, 2}) {
+		t.Fatalf("Expected [15 2], got %v", s)
+	}
+
+	c.Config.StopSignal = "SIGKILL"
+	c.Config.Labels = nil
+	if s := c.StopSignals(); !reflect.DeepEqual(s, []int{9}) {
+		t.Fatalf("Expected [9], got %v", s)
+	}
+}
+
 func TestContainerStopTimeout(t *testing.T) {
 	c := &Container{
 		CommonContainer: CommonContainer{
@@ -1,6 +1,7 @@
 package daemon
 
 import (
+	"archive/tar"
 	"io"
 	"os"
 	"path/filepath"
@@ -16,6 +17,7 @@ import (
 	"github.com/docker/docker/pkg/ioutils"
 	"github.com/docker/docker/pkg/stringid"
 	"github.com/docker/docker/pkg/system"
+	"github.com/opencontainers/runc/libcontainer/label"
 	"github.com/pkg/errors"
 )
 
@@ -370,10 +372,43 @@ func (daemon *Daemon) containerCopy(container *container.Container, resource str
 // TODO: make sure callers don't unnecessarily convert destPath with filepath.FromSlash (Copy does it already).
 // CopyOnBuild should take in abstract paths (with slashes) and the implementation should convert it to OS-specific paths.
 func (daemon *Daemon) CopyOnBuild(cID string, destPath string, src builder.FileInfo, decompress bool) error {
+	rootUID, rootGID := daemon.GetRemappedUIDGID()
+	return daemon.copyOnBuild(cID, destPath, src, decompress, rootUID, rootGID, "")
+}
+
+// CopyOnBuildWithOwner is like CopyOnBuild, but the copied files are owned by
+// the given user and group of the container instead of root.
+func (daemon *Daemon) CopyOnBuildWithOwner(cID string, destPath string, src builder.FileInfo, decompress bool, uid, gid int) error {
+	return daemon.CopyOnBuildWithLabel(cID, destPath, src, decompress, uid, gid, "")
+}
+
+// CopyOnBuildWithLabel is like CopyOnBuildWithOwner, with the copied files
+// labeled with the SELinux context fileLabel.
+func (daemon *Daemon) CopyOnBuildWithLabel(cID string, destPath string, src builder.FileInfo, decompress bool, uid, gid int, fileLabel string) error {
+	uidMaps, gidMaps := daemon.GetUIDGIDMaps()
+	hostUID, err := idtools.ToHost(uid, uidMaps)
+	if err != nil {
+		return err
+	}
+	hostGID, err := idtools.ToHost(gid, gidMaps)
+	if err != nil {
+		return err
+	}
+	return daemon.copyOnBuild(cID, destPath, src, decompress, hostUID, hostGID, fileLabel)
+}
+
+// SELinuxEnabled returns whether SELinux is enabled on the host and by the
+// daemon, so that the files copied by the builder can be labeled.
+func (daemon *Daemon) SELinuxEnabled() bool {
+	return selinuxEnabled()
+}
+
+// copyOnBuild copies src like CopyOnBuild, with the copied files owned by the
+// host ids ownerUID and ownerGID, and labeled with fileLabel if it is set.
+func (daemon *Daemon) copyOnBuild(cID string, destPath string, src builder.FileInfo, decompress bool, ownerUID, ownerGID int, fileLabel string) error {
 	srcPath := src.Path()
 	destExists := true
 	destDir := false
-	rootUID, rootGID := daemon.GetRemappedUIDGID()
 
 	// Work in daemon-local OS specific file paths
 	destPath = filepath.FromSlash(destPath)
@@ -423,7 +458,10 @@ func (daemon *Daemon) CopyOnBuild(cID string, destPath string, src builder.FileI
 		if err := archiver.CopyWithTar(srcPath, destPath); err != nil {
 			return err
 		}
-		return fixPermissions(srcPath, destPath, rootUID, rootGID, destExists)
+		if err := fixPermissions(srcPath, destPath, ownerUID, ownerGID, destExists); err != nil {
+			return err
+		}
+		return labelCopiedFiles(srcPath, destPath, fileLabel, destExists)
 	}
 	if decompress && archive.IsArchivePath(srcPath) {
 		// Only try to untar if it is a file and that we've been told to decompress (when ADD-ing a remote file)
@@ -444,7 +482,17 @@ func (daemon *Daemon) CopyOnBuild(cID string, destPath string, src builder.FileI
 				logrus.Errorf("Couldn't untar to %s: %v", tarDest, err)
 			}
 		*/
-		return err
+		if err != nil {
+			return err
+		}
+		// the extracted files keep the owners of the archive, unless they
+		// are copied as another user than root
+		if rootUID, rootGID := daemon.GetRemappedUIDGID(); ownerUID != rootUID || ownerGID != rootGID {
+			if err := fixExtractedPermissions(srcPath, tarDest, ownerUID, ownerGID); err != nil {
+				return err
+			}
+		}
+		return labelExtractedFiles(srcPath, tarDest, fileLabel)
 	}
 
 	// only needed for fixPermissions, but might as well put it before CopyFileWithTar
@@ -452,14 +500,116 @@ func (daemon *Daemon) CopyOnBuild(cID string, destPath string, src builder.FileI
 		destPath = filepath.Join(destPath, src.Name())
 	}
 
-	if err := idtools.MkdirAllNewAs(filepath.Dir(destPath), 0755, rootUID, rootGID); err != nil {
+	if err := idtools.MkdirAllNewAs(filepath.Dir(destPath), 0755, ownerUID, ownerGID); err != nil {
 		return err
 	}
+	if src.Mode()&os.ModeSymlink != 0 {
+		// the symlink itself is copied, as with COPY --follow-symlinks=false
+		if err := copySymlink(srcPath, destPath, ownerUID, ownerGID); err != nil {
+			return err
+		}
+		return labelCopiedFiles(srcPath, destPath, fileLabel, destExists)
+	}
 	if err := archiver.CopyFileWithTar(srcPath, destPath); err != nil {
 		return err
 	}
 
-	return fixPermissions(srcPath, destPath, rootUID, rootGID, destExists)
+	if err := fixPermissions(srcPath, destPath, ownerUID, ownerGID, destExists); err != nil {
+		return err
+	}
+	return labelCopiedFiles(srcPath, destPath, fileLabel, destExists)
+}
+
+// labelCopiedFiles sets the SELinux label of the files copied from source to
+// destination. Like fixPermissions, it walks the source so that only the
+// copied files are labeled, and not a destination directory which existed
+// before. Symlinks are labeled themselves, not their target.
+func labelCopiedFiles(source, destination, fileLabel string, destExisted bool) error {
+	if fileLabel == "" {
+		return nil
+	}
+	destStat, err := os.Lstat(destination)
+	if err != nil {
+		return err
+	}
+	labelDestination := !destExisted || !destStat.IsDir()
+
+	return filepath.Walk(source, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !labelDestination && source == fullpath {
+			return nil
+		}
+		cleaned, err := filepath.Rel(source, fullpath)
+		if err != nil {
+			return err
+		}
+		return label.SetFileLabel(filepath.Join(destination, cleaned), fileLabel)
+	})
+}
+
+// labelExtractedFiles sets the SELinux label of the files extracted from the
+// archive srcPath to destination, reading their names from the archive so
+// that the other files of destination, and destination itself, keep theirs.
+func labelExtractedFiles(srcPath, destination, fileLabel string) error {
+	if fileLabel == "" {
+		return nil
+	}
+	return walkExtractedFiles(srcPath, destination, func(path string) error {
+		return label.SetFileLabel(path, fileLabel)
+	})
+}
+
+// walkExtractedFiles calls walkFn with the path of each file extracted from
+// the archive srcPath to destination, in the order of the archive.
+func walkExtractedFiles(srcPath, destination string, walkFn func(path string) error) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := archive.DecompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if name == "." || name == ".." || strings.HasPrefix(name, ".."+string(os.PathSeparator)) {
+			continue
+		}
+		if err := walkFn(filepath.Join(destination, name)); err != nil {
+			return err
+		}
+	}
+}
+
+// copySymlink creates a symlink at destPath pointing to the target of the
+// symlink srcPath, replacing any file at destPath.
+func copySymlink(srcPath, destPath string, rootUID, rootGID int) error {
+	link, err := os.Readlink(srcPath)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(destPath); err == nil && !fi.IsDir() {
+		if err := os.Remove(destPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink(link, destPath); err != nil {
+		return err
+	}
+	return os.Lchown(destPath, rootUID, rootGID)
 }
 
 // MountImage returns mounted path with rootfs of an image.
@@ -57,6 +57,15 @@ func fixPermissions(source, destination string, uid, gid int, destExisted bool)
 	})
 }
 
+// fixExtractedPermissions changes the owner of the files extracted from the
+// archive source to destination, leaving the other files of destination, and
+// destination itself, as they were.
+func fixExtractedPermissions(source, destination string, uid, gid int) error {
+	return walkExtractedFiles(source, destination, func(path string) error {
+		return os.Lchown(path, uid, gid)
+	})
+}
+
 // isOnlineFSOperationPermitted returns an error if an online filesystem operation
 // is not permitted.
 func (daemon *Daemon) isOnlineFSOperationPermitted(container *container.Container) error {
@@ -0,0 +1,66 @@
+// +build !windows
+
+package daemon
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixExtractedPermissions(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of files requires root")
+	}
+
+	tmp, err := ioutil.TempDir("", "docker-archive-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	// the archive source holds app/bin/run and app/README
+	src := filepath.Join(tmp, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "app", "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "app", "bin", "run"), []byte("#!/bin/sh"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "app", "README"), []byte("readme"), 0644))
+	rc, err := archive.Tar(src, archive.Gzip)
+	require.NoError(t, err)
+	tarPath := filepath.Join(tmp, "app.tar.gz")
+	f, err := os.Create(tarPath)
+	require.NoError(t, err)
+	_, err = io.Copy(f, rc)
+	rc.Close()
+	f.Close()
+	require.NoError(t, err)
+
+	// the destination already holds a file, which the archive doesn't have
+	dest := filepath.Join(tmp, "dest")
+	require.NoError(t, os.MkdirAll(dest, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "existing"), []byte("existing"), 0644))
+	require.NoError(t, archive.UntarPath(tarPath, dest))
+
+	require.NoError(t, fixExtractedPermissions(tarPath, dest, 1234, 5678))
+
+	owner := func(path string) (uint32, uint32) {
+		fi, err := os.Lstat(filepath.Join(dest, path))
+		require.NoError(t, err)
+		st := fi.Sys().(*syscall.Stat_t)
+		return st.Uid, st.Gid
+	}
+	for _, path := range []string{"app", "app/bin", "app/bin/run", "app/README"} {
+		uid, gid := owner(path)
+		assert.Equal(t, uint32(1234), uid, path)
+		assert.Equal(t, uint32(5678), gid, path)
+	}
+	for _, path := range []string{".", "existing"} {
+		uid, gid := owner(path)
+		assert.Equal(t, uint32(0), uid, path)
+		assert.Equal(t, uint32(0), gid, path)
+	}
+}
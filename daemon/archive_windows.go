@@ -22,6 +22,11 @@ func fixPermissions(source, destination string, uid, gid int, destExisted bool)
 	return nil
 }
 
+func fixExtractedPermissions(source, destination string, uid, gid int) error {
+	// chown is not supported on Windows
+	return nil
+}
+
 // isOnlineFSOperationPermitted returns an error if an online filesystem operation
 // is not permitted (such as stat or for copying). Running Hyper-V containers
 // cannot have their file-system interrogated from the host as the filter is
@@ -100,6 +100,9 @@ func merge(userConf, imageConf *containertypes.Config) error {
 			if userConf.Healthcheck.Retries == 0 {
 				userConf.Healthcheck.Retries = imageConf.Healthcheck.Retries
 			}
+			if len(userConf.Healthcheck.SuccessExitCodes) == 0 {
+				userConf.Healthcheck.SuccessExitCodes = imageConf.Healthcheck.SuccessExitCodes
+			}
 		}
 	}
 
@@ -150,16 +153,6 @@ func (daemon *Daemon) Commit(name string, c *backend.ContainerCommitConfig) (str
 		}
 	}
 
-	rwTar, err := daemon.exportContainerRw(container)
-	if err != nil {
-		return "", err
-	}
-	defer func() {
-		if rwTar != nil {
-			rwTar.Close()
-		}
-	}()
-
 	var history []image.History
 	rootFS := image.NewRootFS()
 	osVersion := ""
@@ -176,12 +169,6 @@ func (daemon *Daemon) Commit(name string, c *backend.ContainerCommitConfig) (str
 		osFeatures = img.OSFeatures
 	}
 
-	l, err := daemon.layerStore.Register(rwTar, rootFS.ChainID())
-	if err != nil {
-		return "", err
-	}
-	defer layer.ReleaseAndLog(daemon.layerStore, l)
-
 	h := image.History{
 		Author:     c.Author,
 		Created:    time.Now().UTC(),
@@ -190,9 +177,23 @@ func (daemon *Daemon) Commit(name string, c *backend.ContainerCommitConfig) (str
 		EmptyLayer: true,
 	}
 
-	if diffID := l.DiffID(); layer.DigestSHA256EmptyTar != diffID {
-		h.EmptyLayer = false
-		rootFS.Append(diffID)
+	if !c.EmptyLayer {
+		rwTar, err := daemon.exportContainerRw(container)
+		if err != nil {
+			return "", err
+		}
+		defer rwTar.Close()
+
+		l, err := daemon.layerStore.Register(rwTar, rootFS.ChainID())
+		if err != nil {
+			return "", err
+		}
+		defer layer.ReleaseAndLog(daemon.layerStore, l)
+
+		if diffID := l.DiffID(); layer.DigestSHA256EmptyTar != diffID {
+			h.EmptyLayer = false
+			rootFS.Append(diffID)
+		}
 	}
 
 	history = append(history, h)
@@ -234,6 +234,11 @@ func (daemon *Daemon) verifyContainerSettings(hostConfig *containertypes.HostCon
 				return nil, err
 			}
 		}
+		if stopSignals := config.Labels[signal.StopSignalsLabel]; stopSignals != "" {
+			if _, err := signal.ParseSignals(stopSignals); err != nil {
+				return nil, fmt.Errorf("invalid %s label: %v", signal.StopSignalsLabel, err)
+			}
+		}
 
 		// Validate if Env contains empty variable or not (e.g., ``, `=foo`)
 		for _, env := range config.Env {
@@ -134,7 +134,7 @@ func handleProbeResult(d *Daemon, c *container.Container, result *types.Healthch
 		h.Log = append(h.Log, result)
 	}
 
-	if result.ExitCode == exitStatusHealthy {
+	if isHealthyExitCode(c.Config.Healthcheck, result.ExitCode) {
 		h.FailingStreak = 0
 		h.Status = types.Healthy
 	} else { // Failure (including invalid exit code)
@@ -345,6 +345,20 @@ func timeoutWithDefault(configuredValue time.Duration, defaultValue time.Duratio
 	return configuredValue
 }
 
+// isHealthyExitCode returns whether exitCode is one of the success exit codes
+// of the healthcheck, which defaults to exitStatusHealthy only.
+func isHealthyExitCode(healthcheck *containertypes.HealthConfig, exitCode int) bool {
+	if len(healthcheck.SuccessExitCodes) == 0 {
+		return exitCode == exitStatusHealthy
+	}
+	for _, code := range healthcheck.SuccessExitCodes {
+		if exitCode == code {
+			return true
+		}
+	}
+	return false
+}
+
 func min(x, y int) int {
 	if x < y {
 		return x
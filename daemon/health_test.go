@@ -143,3 +143,17 @@ func TestHealthStates(t *testing.T) {
 		t.Errorf("Expecting FailingStreak=0, but got %d\n", c.State.Health.FailingStreak)
 	}
 }
+
+func TestIsHealthyExitCode(t *testing.T) {
+	healthcheck := &containertypes.HealthConfig{}
+	if !isHealthyExitCode(healthcheck, 0) || isHealthyExitCode(healthcheck, 2) {
+		t.Error("Expecting only exit code 0 to be healthy by default")
+	}
+
+	healthcheck.SuccessExitCodes = []int{0, 2}
+	for code, expected := range map[int]bool{0: true, 1: false, 2: true, 3: false} {
+		if healthy := isHealthyExitCode(healthcheck, code); healthy != expected {
+			t.Errorf("Expecting exit code %d to be healthy=%v, but got %v", code, expected, healthy)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/docker/docker/builder"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/pkg/stringid"
+	"github.com/opencontainers/go-digest"
 )
 
 // ErrImageDoesNotExist is error returned when no image can be found for a reference.
@@ -82,5 +83,43 @@ func (daemon *Daemon) GetImageOnBuild(name string) (builder.Image, error) {
 	if err != nil {
 		return nil, err
 	}
-	return img, nil
+	return daemon.newBuildImage(img), nil
+}
+
+// buildImage is an image used by the builder, along with the repository
+// digests it is known by.
+type buildImage struct {
+	*image.Image
+	repoDigests []digest.Digest
+}
+
+// RepoDigests returns the repository digests of the image.
+func (i *buildImage) RepoDigests() []digest.Digest {
+	return i.repoDigests
+}
+
+// Layers returns the number of layers of the image.
+func (i *buildImage) Layers() int {
+	if i.RootFS == nil {
+		return 0
+	}
+	return len(i.RootFS.DiffIDs)
+}
+
+// Platform returns the platform of the image as os/architecture.
+func (i *buildImage) Platform() string {
+	if i.OS == "" && i.Architecture == "" {
+		return ""
+	}
+	return i.OS + "/" + i.Architecture
+}
+
+func (daemon *Daemon) newBuildImage(img *image.Image) *buildImage {
+	var repoDigests []digest.Digest
+	for _, ref := range daemon.referenceStore.References(img.ID().Digest()) {
+		if canonical, ok := ref.(reference.Canonical); ok {
+			repoDigests = append(repoDigests, canonical.Digest())
+		}
+	}
+	return &buildImage{Image: img, repoDigests: repoDigests}
 }
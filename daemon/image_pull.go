@@ -54,6 +54,41 @@ func (daemon *Daemon) PullOnBuild(ctx context.Context, name string, authConfigs
 	}
 	ref = reference.TagNameOnly(ref)
 
+	pullRegistryAuth, err := daemon.authConfigOnBuild(ref, authConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := daemon.pullImageWithReference(ctx, ref, nil, pullRegistryAuth, output); err != nil {
+		return nil, err
+	}
+	return daemon.GetImageOnBuild(name)
+}
+
+// PullArtifactOnBuild tells Docker to pull the files of the OCI artifact name
+// to the directory dest, for ADD sources of the form oci://<reference>.
+func (daemon *Daemon) PullArtifactOnBuild(ctx context.Context, name string, authConfigs map[string]types.AuthConfig, dest string) error {
+	ref, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return err
+	}
+	ref = reference.TagNameOnly(ref)
+
+	pullRegistryAuth, err := daemon.authConfigOnBuild(ref, authConfigs)
+	if err != nil {
+		return err
+	}
+
+	config := &distribution.Config{
+		AuthConfig:      pullRegistryAuth,
+		RegistryService: daemon.RegistryService,
+	}
+	return distribution.PullArtifact(ctx, ref, config, dest)
+}
+
+// authConfigOnBuild returns the auth config to pull ref with, out of the
+// auth configs a build came with.
+func (daemon *Daemon) authConfigOnBuild(ref reference.Named, authConfigs map[string]types.AuthConfig) (*types.AuthConfig, error) {
 	pullRegistryAuth := &types.AuthConfig{}
 	if len(authConfigs) > 0 {
 		// The request came with a full auth config file, we prefer to use that
@@ -68,11 +103,7 @@ func (daemon *Daemon) PullOnBuild(ctx context.Context, name string, authConfigs
 		)
 		pullRegistryAuth = &resolvedConfig
 	}
-
-	if err := daemon.pullImageWithReference(ctx, ref, nil, pullRegistryAuth, output); err != nil {
-		return nil, err
-	}
-	return daemon.GetImage(name)
+	return pullRegistryAuth, nil
 }
 
 func (daemon *Daemon) pullImageWithReference(ctx context.Context, ref reference.Named, metaHeaders map[string][]string, authConfig *types.AuthConfig, outStream io.Writer) error {
@@ -69,12 +69,14 @@ func (daemon *Daemon) killWithSignal(container *container.Container, sig int) er
 	}
 
 	if container.Config.StopSignal != "" {
-		containerStopSignal, err := signal.ParseSignal(container.Config.StopSignal)
-		if err != nil {
+		if _, err := signal.ParseSignal(container.Config.StopSignal); err != nil {
 			return err
 		}
-		if containerStopSignal == syscall.Signal(sig) {
-			container.ExitOnNext()
+		for _, containerStopSignal := range container.StopSignals() {
+			if containerStopSignal == sig {
+				container.ExitOnNext()
+				break
+			}
 		}
 	} else {
 		container.ExitOnNext()
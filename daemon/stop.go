@@ -37,8 +37,10 @@ func (daemon *Daemon) ContainerStop(name string, seconds *int) error {
 
 // containerStop halts a container by sending a stop signal, waiting for the given
 // duration in seconds, and then calling SIGKILL and waiting for the
-// process to exit. If a negative duration is given, Stop will wait
-// for the initial signal forever. If the container is not running Stop returns
+// process to exit. When the container has several stop signals, they are sent
+// in turn and share the duration evenly, so that it still bounds the time
+// before SIGKILL. If a negative duration is given, Stop will wait for the
+// initial signal forever. If the container is not running Stop returns
 // immediately.
 func (daemon *Daemon) containerStop(container *container.Container, seconds int) error {
 	if !container.IsRunning() {
@@ -47,29 +49,52 @@ func (daemon *Daemon) containerStop(container *container.Container, seconds int)
 
 	daemon.stopHealthchecks(container)
 
-	stopSignal := container.StopSignal()
-	// 1. Send a stop signal
-	if err := daemon.killPossiblyDeadProcess(container, stopSignal); err != nil {
-		// While normally we might "return err" here we're not going to
-		// because if we can't stop the container by this point then
-		// it's probably because it's already stopped. Meaning, between
-		// the time of the IsRunning() call above and now it stopped.
-		// Also, since the err return will be environment specific we can't
-		// look for any particular (common) error that would indicate
-		// that the process is already dead vs something else going wrong.
-		// So, instead we'll give it up to 2 more seconds to complete and if
-		// by that time the container is still running, then the error
-		// we got is probably valid and so we force kill it.
-		if _, err := container.WaitStop(2 * time.Second); err != nil {
-			logrus.Infof("Container failed to stop after sending signal %d to the process, force killing", stopSignal)
-			if err := daemon.killPossiblyDeadProcess(container, 9); err != nil {
-				return err
+	stopSignals := container.StopSignals()
+	timeout := time.Duration(seconds) * time.Second
+	wait := timeout
+	if seconds > 0 {
+		wait = timeout / time.Duration(len(stopSignals))
+	}
+	var stopSignal int
+	// 1. Send the stop signals, escalating to the next one when the process
+	// did not exit on its own
+	for i := range stopSignals {
+		if i > 0 {
+			if _, err := container.WaitStop(wait); err == nil {
+				daemon.LogContainerEvent(container, "stop")
+				return nil
+			}
+			timeout -= wait
+			logrus.Infof("Container %v failed to exit within %s of signal %d - sending signal %d", container.ID, wait, stopSignal, stopSignals[i])
+		}
+		stopSignal = stopSignals[i]
+		if err := daemon.killPossiblyDeadProcess(container, stopSignal); err != nil {
+			// While normally we might "return err" here we're not going to
+			// because if we can't stop the container by this point then
+			// it's probably because it's already stopped. Meaning, between
+			// the time of the IsRunning() call above and now it stopped.
+			// Also, since the err return will be environment specific we can't
+			// look for any particular (common) error that would indicate
+			// that the process is already dead vs something else going wrong.
+			// So, instead we'll give it up to 2 more seconds to complete and if
+			// by that time the container is still running, then the error
+			// we got is probably valid and so we force kill it.
+			if _, err := container.WaitStop(2 * time.Second); err != nil {
+				logrus.Infof("Container failed to stop after sending signal %d to the process, force killing", stopSignal)
+				if err := daemon.killPossiblyDeadProcess(container, 9); err != nil {
+					return err
+				}
 			}
+			break
+		}
+		if seconds < 0 {
+			// the first signal is waited for forever
+			break
 		}
 	}
 
 	// 2. Wait for the process to exit on its own
-	if _, err := container.WaitStop(time.Duration(seconds) * time.Second); err != nil {
+	if _, err := container.WaitStop(timeout); err != nil {
 		logrus.Infof("Container %v failed to exit within %d seconds of signal %d - using the force", container.ID, seconds, stopSignal)
 		// 3. If it doesn't, then send SIGKILL
 		if err := daemon.Kill(container); err != nil {
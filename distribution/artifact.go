@@ -0,0 +1,264 @@
+package distribution
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/docker/registry"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// MediaTypeOCIManifest is the media type of the manifests of OCI
+	// artifacts.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// annotationTitle is the annotation holding the file name of a blob.
+	annotationTitle = "org.opencontainers.image.title"
+
+	// maxArtifactManifestSize is the size above which the manifest of an
+	// artifact is rejected.
+	maxArtifactManifestSize = 4 << 20
+)
+
+// ArtifactConfigTypes are the config media types of the OCI artifacts whose
+// blobs are files, which can be pulled with PullArtifact. The blobs of images
+// are layers instead, and are pulled with Pull.
+var ArtifactConfigTypes = []string{
+	"application/vnd.oci.empty.v1+json",
+	"application/vnd.oras.config.v1+json",
+	"application/vnd.unknown.config.v1+json",
+}
+
+// artifactDescriptor describes a blob of an OCI artifact.
+type artifactDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// artifactManifest is the manifest of an OCI artifact.
+type artifactManifest struct {
+	MediaType    string               `json:"mediaType"`
+	ArtifactType string               `json:"artifactType,omitempty"`
+	Config       artifactDescriptor   `json:"config"`
+	Layers       []artifactDescriptor `json:"layers"`
+}
+
+// PullArtifact pulls the OCI artifact ref, and writes its blobs to the
+// directory dest as files named by their title annotation. It fails on
+// artifacts whose config media type isn't one of ArtifactConfigTypes.
+func PullArtifact(ctx context.Context, ref reference.Named, config *Config, dest string) error {
+	repoInfo, err := config.RegistryService.ResolveRepository(ref)
+	if err != nil {
+		return err
+	}
+	if err := ValidateRepoName(repoInfo.Name); err != nil {
+		return err
+	}
+
+	endpoints, err := config.RegistryService.LookupPullEndpoints(reference.Domain(repoInfo.Name))
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, endpoint := range endpoints {
+		if endpoint.Version == registry.APIVersion1 {
+			continue
+		}
+		logrus.Debugf("Trying to pull artifact %s from %s", reference.FamiliarString(ref), endpoint.URL)
+
+		err := pullArtifactFromEndpoint(ctx, ref, repoInfo, endpoint, config, dest)
+		if err == nil {
+			return nil
+		}
+		fallbackErr, ok := err.(fallbackError)
+		if !ok {
+			return err
+		}
+		lastErr = fallbackErr.err
+		logrus.Infof("Attempting next endpoint for artifact pull after error: %v", lastErr)
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no endpoints found for %s", reference.FamiliarString(ref))
+	}
+	return lastErr
+}
+
+func pullArtifactFromEndpoint(ctx context.Context, ref reference.Named, repoInfo *registry.RepositoryInfo, endpoint registry.APIEndpoint, config *Config, dest string) error {
+	repoName, tr, _, err := newV2Transport(ctx, repoInfo, endpoint, config.MetaHeaders, config.AuthConfig, "pull")
+	if err != nil {
+		return err
+	}
+	ub, err := v2.NewURLBuilderFromString(endpoint.URL.String(), false)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{Transport: tr}
+
+	manifestRef, err := artifactManifestRef(repoName, ref)
+	if err != nil {
+		return err
+	}
+	manifest, err := fetchArtifactManifest(httpClient, ub, manifestRef)
+	if err != nil {
+		return err
+	}
+	if err := checkArtifactManifest(manifest); err != nil {
+		return errors.Wrapf(err, "unsupported artifact %s", reference.FamiliarString(ref))
+	}
+
+	written := make(map[string]struct{})
+	for _, blob := range manifest.Layers {
+		name, err := artifactFileName(blob)
+		if err != nil {
+			return err
+		}
+		if _, ok := written[name]; ok {
+			return errors.Errorf("artifact %s has several files named %s", reference.FamiliarString(ref), name)
+		}
+		written[name] = struct{}{}
+
+		blobRef, err := reference.WithDigest(repoName, blob.Digest)
+		if err != nil {
+			return err
+		}
+		if err := fetchArtifactBlob(httpClient, ub, blobRef, blob, filepath.Join(dest, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// artifactManifestRef returns the reference of the manifest of ref in the
+// repository repoName, by digest if ref has one, and by tag otherwise.
+// References without either are pulled by the latest tag.
+func artifactManifestRef(repoName reference.Named, ref reference.Named) (reference.Named, error) {
+	if canonical, ok := ref.(reference.Canonical); ok {
+		return reference.WithDigest(repoName, canonical.Digest())
+	}
+	return reference.WithTag(repoName, reference.TagNameOnly(ref).(reference.Tagged).Tag())
+}
+
+func fetchArtifactManifest(httpClient *http.Client, ub *v2.URLBuilder, ref reference.Named) (*artifactManifest, error) {
+	u, err := ub.BuildManifestURL(ref)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", MediaTypeOCIManifest)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if !client.SuccessStatus(resp.StatusCode) {
+		return nil, client.HandleErrorResponse(resp)
+	}
+
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if mediaType != MediaTypeOCIManifest {
+		return nil, errors.Errorf("unsupported manifest media type %s, artifacts must have a manifest of type %s", mediaType, MediaTypeOCIManifest)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxArtifactManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxArtifactManifestSize {
+		return nil, errors.Errorf("the manifest of %s is larger than %d bytes", reference.FamiliarString(ref), maxArtifactManifestSize)
+	}
+	if canonical, ok := ref.(reference.Canonical); ok {
+		verifier := canonical.Digest().Verifier()
+		verifier.Write(body)
+		if !verifier.Verified() {
+			return nil, errors.Errorf("the manifest of %s doesn't match its digest", reference.FamiliarString(ref))
+		}
+	}
+
+	var manifest artifactManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "invalid manifest for %s", reference.FamiliarString(ref))
+	}
+	return &manifest, nil
+}
+
+// checkArtifactManifest checks that manifest is the manifest of an artifact
+// whose blobs are files.
+func checkArtifactManifest(manifest *artifactManifest) error {
+	artifactType := manifest.ArtifactType
+	if artifactType == "" {
+		artifactType = manifest.Config.MediaType
+	}
+	for _, t := range ArtifactConfigTypes {
+		if manifest.Config.MediaType == t {
+			return nil
+		}
+	}
+	return errors.Errorf("artifacts of type %s are not supported, the config media type must be one of %s", artifactType, strings.Join(ArtifactConfigTypes, ", "))
+}
+
+// artifactFileName returns the path of the file of blob, relative to the
+// directory the artifact is pulled to.
+func artifactFileName(blob artifactDescriptor) (string, error) {
+	title := blob.Annotations[annotationTitle]
+	if title == "" {
+		return "", errors.Errorf("blob %s has no %s annotation to name its file", blob.Digest, annotationTitle)
+	}
+	name := filepath.Clean(filepath.FromSlash(title))
+	if filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("invalid file name %q for blob %s", title, blob.Digest)
+	}
+	return name, nil
+}
+
+func fetchArtifactBlob(httpClient *http.Client, ub *v2.URLBuilder, ref reference.Canonical, blob artifactDescriptor, path string) error {
+	u, err := ub.BuildBlobURL(ref)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !client.SuccessStatus(resp.StatusCode) {
+		return client.HandleErrorResponse(resp)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	verifier := blob.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(f, verifier), io.LimitReader(resp.Body, blob.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != blob.Size || !verifier.Verified() {
+		return errors.Errorf("blob %s doesn't match its size or digest", blob.Digest)
+	}
+	return nil
+}
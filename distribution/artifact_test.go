@@ -0,0 +1,144 @@
+package distribution
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	registrytypes "github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/registry"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+// testArtifactRegistry serves the manifest of a single artifact, tagged
+// latest in the repository library/testartifact, and its blobs.
+func testArtifactRegistry(t *testing.T, configType string, files map[string]string) *httptest.Server {
+	blobs := make(map[digest.Digest][]byte)
+	manifest := artifactManifest{
+		MediaType: MediaTypeOCIManifest,
+		Config:    artifactDescriptor{MediaType: configType, Digest: digest.FromString("{}"), Size: 2},
+	}
+	for name, content := range files {
+		dgst := digest.FromString(content)
+		blobs[dgst] = []byte(content)
+		manifest.Layers = append(manifest.Layers, artifactDescriptor{
+			MediaType:   "application/octet-stream",
+			Digest:      dgst,
+			Size:        int64(len(content)),
+			Annotations: map[string]string{annotationTitle: name},
+		})
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		case r.URL.Path == "/v2/library/testartifact/manifests/latest":
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			w.Write(body)
+		case strings.HasPrefix(r.URL.Path, "/v2/library/testartifact/blobs/"):
+			blob, ok := blobs[digest.Digest(strings.TrimPrefix(r.URL.Path, "/v2/library/testartifact/blobs/"))]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(blob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func testPullArtifact(t *testing.T, ts *httptest.Server, dest string) error {
+	uri, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("could not parse url from test server: %v", err)
+	}
+	endpoint := registry.APIEndpoint{URL: uri, Version: 2, TrimHostname: true}
+	n, _ := reference.ParseNormalizedNamed("testartifact")
+	repoInfo := &registry.RepositoryInfo{
+		Name:  n,
+		Index: &registrytypes.IndexInfo{Name: "testrepo"},
+	}
+	config := &Config{
+		MetaHeaders: http.Header{},
+		AuthConfig:  &types.AuthConfig{},
+	}
+	return pullArtifactFromEndpoint(context.Background(), n, repoInfo, endpoint, config, dest)
+}
+
+func TestPullArtifact(t *testing.T) {
+	ts := testArtifactRegistry(t, "application/vnd.oci.empty.v1+json", map[string]string{
+		"hello.txt":     "hello",
+		"sub/world.txt": "world",
+	})
+	defer ts.Close()
+
+	dest, err := ioutil.TempDir("", "artifact-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	if err := testPullArtifact(t, ts, dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"hello.txt": "hello", "sub/world.txt": "world"} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Fatalf("Expected %s to contain %q, got %q", name, expected, content)
+		}
+	}
+}
+
+func TestPullArtifactUnsupportedType(t *testing.T) {
+	ts := testArtifactRegistry(t, "application/vnd.oci.image.config.v1+json", map[string]string{"layer": "content"})
+	defer ts.Close()
+
+	dest, err := ioutil.TempDir("", "artifact-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	err = testPullArtifact(t, ts, dest)
+	if err == nil || !strings.Contains(err.Error(), "artifacts of type application/vnd.oci.image.config.v1+json are not supported") {
+		t.Fatalf("Expected an unsupported artifact type error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "layer")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file to be written for an unsupported artifact, got %v", err)
+	}
+}
+
+func TestArtifactFileName(t *testing.T) {
+	for _, title := range []string{"", "/etc/passwd", ".", "..", "../escape", "a/../../escape"} {
+		blob := artifactDescriptor{Annotations: map[string]string{annotationTitle: title}}
+		if name, err := artifactFileName(blob); err == nil {
+			t.Fatalf("Expected an error for the title %q, got %s", title, name)
+		}
+	}
+	blob := artifactDescriptor{Annotations: map[string]string{annotationTitle: "dir/./file"}}
+	name, err := artifactFileName(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != filepath.Join("dir", "file") {
+		t.Fatalf("Expected dir/file, got %s", name)
+	}
+}
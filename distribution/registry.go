@@ -55,6 +55,25 @@ func init() {
 // providing timeout settings and authentication support, and also verifies the
 // remote API version.
 func NewV2Repository(ctx context.Context, repoInfo *registry.RepositoryInfo, endpoint registry.APIEndpoint, metaHeaders http.Header, authConfig *types.AuthConfig, actions ...string) (repo distribution.Repository, foundVersion bool, err error) {
+	repoNameRef, tr, foundVersion, err := newV2Transport(ctx, repoInfo, endpoint, metaHeaders, authConfig, actions...)
+	if err != nil {
+		return nil, foundVersion, err
+	}
+
+	repo, err = client.NewRepository(ctx, repoNameRef, endpoint.URL.String(), tr)
+	if err != nil {
+		err = fallbackError{
+			err:         err,
+			confirmedV2: foundVersion,
+			transportOK: true,
+		}
+	}
+	return
+}
+
+// newV2Transport returns the name of the repository on the endpoint, and an
+// HTTP transport to the endpoint authenticated for actions on it.
+func newV2Transport(ctx context.Context, repoInfo *registry.RepositoryInfo, endpoint registry.APIEndpoint, metaHeaders http.Header, authConfig *types.AuthConfig, actions ...string) (reference.Named, http.RoundTripper, bool, error) {
 	repoName := repoInfo.Name.Name()
 	// If endpoint does not support CanonicalName, use the RemoteName instead
 	if endpoint.TrimHostname {
@@ -92,7 +111,7 @@ func NewV2Repository(ctx context.Context, repoInfo *registry.RepositoryInfo, end
 			transportOK = true
 			err = responseErr.Err
 		}
-		return nil, foundVersion, fallbackError{
+		return nil, nil, foundVersion, fallbackError{
 			err:         err,
 			confirmedV2: foundVersion,
 			transportOK: transportOK,
@@ -124,22 +143,13 @@ func NewV2Repository(ctx context.Context, repoInfo *registry.RepositoryInfo, end
 
 	repoNameRef, err := reference.WithName(repoName)
 	if err != nil {
-		return nil, foundVersion, fallbackError{
-			err:         err,
-			confirmedV2: foundVersion,
-			transportOK: true,
-		}
-	}
-
-	repo, err = client.NewRepository(ctx, repoNameRef, endpoint.URL.String(), tr)
-	if err != nil {
-		err = fallbackError{
+		return nil, nil, foundVersion, fallbackError{
 			err:         err,
 			confirmedV2: foundVersion,
 			transportOK: true,
 		}
 	}
-	return
+	return repoNameRef, tr, foundVersion, nil
 }
 
 type existingTokenHandler struct {
@@ -17,10 +17,24 @@ var (
 
 // Download requests a given URL and returns an io.Reader.
 func Download(url string) (resp *http.Response, err error) {
-	if resp, err = http.Get(url); err != nil {
+	return DownloadWithHeader(url, nil)
+}
+
+// DownloadWithHeader requests a given URL with additional request headers,
+// such as the ones of a conditional request, and returns an io.Reader.
+func DownloadWithHeader(url string, header http.Header) (resp *http.Response, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if resp, err = http.DefaultClient.Do(req); err != nil {
 		return nil, err
 	}
 	if resp.StatusCode >= 400 {
+		resp.Body.Close()
 		return nil, fmt.Errorf("Got HTTP status code >= 400: %s", resp.Status)
 	}
 	return resp, nil
@@ -28,6 +28,23 @@ func TestDownload(t *testing.T) {
 	}
 }
 
+func TestDownloadWithHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+		}
+	}))
+	defer ts.Close()
+	response, err := DownloadWithHeader(ts.URL, http.Header{"If-None-Match": []string{`"v1"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotModified {
+		t.Fatalf("Expected the status code %d, got %d", http.StatusNotModified, response.StatusCode)
+	}
+}
+
 func TestDownload400Errors(t *testing.T) {
 	expectedError := "Got HTTP status code >= 400: 403 Forbidden"
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -43,6 +43,27 @@ func ParseSignal(rawSignal string) (syscall.Signal, error) {
 	return signal, nil
 }
 
+// StopSignalsLabel is the label of a container or image config holding the
+// signals sent to stop the container after its StopSignal, as a
+// comma-separated list. StopSignal itself stays a single signal, which
+// runtimes without support for the label keep using on their own.
+const StopSignalsLabel = "com.docker.stop-signals"
+
+// ParseSignals translates a comma-separated list of signals, such as
+// "SIGTERM,SIGINT", to valid syscall signals, in the same order.
+// It returns an error if the signal map doesn't include one of them.
+func ParseSignals(rawSignals string) ([]syscall.Signal, error) {
+	var signals []syscall.Signal
+	for _, rawSignal := range strings.Split(rawSignals, ",") {
+		signal, err := ParseSignal(strings.TrimSpace(rawSignal))
+		if err != nil {
+			return nil, err
+		}
+		signals = append(signals, signal)
+	}
+	return signals, nil
+}
+
 // ValidSignalForPlatform returns true if a signal is valid on the platform
 func ValidSignalForPlatform(sig syscall.Signal) bool {
 	for _, v := range SignalMap {